@@ -1,18 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/lfkeitel/yobot/pkg/announce"
 	"github.com/lfkeitel/yobot/pkg/bot"
 	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/external"
+	"github.com/lfkeitel/yobot/pkg/health"
+	"github.com/lfkeitel/yobot/pkg/jobs"
 	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/oncall"
 	"github.com/lfkeitel/yobot/pkg/plugins"
+	"github.com/lfkeitel/yobot/pkg/remind"
+	"github.com/lfkeitel/yobot/pkg/script"
+	"github.com/lfkeitel/yobot/pkg/storage"
 	"github.com/lfkeitel/yobot/pkg/utils"
 )
 
@@ -20,6 +34,12 @@ var (
 	configFile     string
 	testPluginFlag bool
 	testConfig     bool
+	testOnline     bool
+	printConfig    bool
+	hashPassword   bool
+	listCaptures   string
+	replayCapture  string
+	replayOutput   string
 
 	debug       bool
 	extraDebug  bool
@@ -36,8 +56,14 @@ func init() {
 	flag.BoolVar(&debug, "debug", false, "Debug mode")
 	flag.BoolVar(&extraDebug, "debug2", false, "Extra debug mode")
 	flag.BoolVar(&testPluginFlag, "tp", false, "Test loading plugins")
-	flag.BoolVar(&testConfig, "t", false, "Test configuration syntax")
+	flag.BoolVar(&testConfig, "t", false, "Test the configuration")
+	flag.BoolVar(&testOnline, "online", false, "With -t, check that channels exist in Mattermost")
+	flag.BoolVar(&printConfig, "print", false, "Print the configuration with secrets redacted")
 	flag.BoolVar(&versionInfo, "v", false, "Print version information")
+	flag.BoolVar(&hashPassword, "hash", false, "Hash a password read from standard input")
+	flag.StringVar(&listCaptures, "captures", "", "List the captured requests of a route")
+	flag.StringVar(&replayCapture, "replay", "", "Dry run a captured request given as ROUTE/ID and print it as a fixture")
+	flag.StringVar(&replayOutput, "o", "", "With -replay, save the fixture to a file")
 
 	rand.Seed(time.Now().UnixNano())
 }
@@ -50,38 +76,88 @@ func main() {
 		return
 	}
 
+	if hashPassword {
+		if err := printPasswordHash(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if testConfig {
+		if !testConfiguration() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	conf, err := config.LoadConfig(configFile)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	if testConfig {
+	applyFlags(conf)
+	msgbus.RegisterConfigOverride(applyFlags)
+
+	if printConfig {
+		fmt.Print(conf)
 		return
 	}
 
-	if extraDebug {
-		conf.Main.ExtraDebug = extraDebug
+	if err := os.MkdirAll(conf.Main.DataDir, 0755); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	if debug {
-		conf.Main.Debug = debug
+
+	if listCaptures != "" {
+		if err := printCaptures(conf, listCaptures); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	if conf.Main.ExtraDebug {
-		conf.Main.Debug = true
+	if err := plugins.Load(conf.Main.ModulesDir, conf.Main.Modules); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	if err := os.MkdirAll(conf.Main.DataDir, 0755); err != nil {
+	if testPluginFlag {
+		return
+	}
+
+	// Replays are dry runs, they don't change stored values
+	if replayCapture != "" {
+		storage.OpenMemory()
+	} else if err := storage.Open(conf); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer storage.Close()
 
-	if err := plugins.Load(conf.Main.ModulesDir, conf.Main.Modules); err != nil {
+	if err := external.Load(conf); err != nil {
 		fmt.Println(err)
+		external.Shutdown()
 		os.Exit(1)
 	}
 
-	if testPluginFlag {
+	if err := script.Load(conf); err != nil {
+		fmt.Println(err)
+		external.Shutdown()
+		os.Exit(1)
+	}
+
+	if replayCapture != "" {
+		result, err := replay(conf, replayCapture)
+		external.Shutdown()
+		if err == nil {
+			err = saveReplay(result, replayOutput)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -97,7 +173,24 @@ func main() {
 		os.Exit(1)
 	}
 
-	plugins.Init(conf, bot.GetBot())
+	if err := oncall.Start(conf, quit); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := announce.Start(conf); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := remind.Start(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	jobs.Start()
+	plugins.Start(conf, bot.GetBot())
+	health.SetStarted()
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
@@ -109,6 +202,8 @@ func main() {
 	}
 
 	fmt.Println("Stopping")
+	// Jobs stop first so plugins removing their jobs keep the last runs
+	jobs.Stop()
 	plugins.Shutdown()
 
 	timer := time.NewTimer(5 * time.Second)
@@ -124,6 +219,174 @@ func main() {
 	}
 }
 
+// applyFlags overrides the configuration with command line flags.
+func applyFlags(conf *config.Config) {
+	if extraDebug {
+		conf.Main.ExtraDebug = extraDebug
+	}
+	if debug {
+		conf.Main.Debug = debug
+	}
+
+	if conf.Main.ExtraDebug {
+		conf.Main.Debug = true
+	}
+}
+
+// testConfiguration prints the problems found in the configuration file and
+// returns if it's usable.
+func testConfiguration() bool {
+	conf, diags := config.Validate(configFile)
+	if conf != nil {
+		// Modules and scripts register handlers and checks, validate again
+		// once they're loaded. External plugins aren't started, their
+		// settings are checked without running them.
+		storage.OpenMemory()
+		var loadErrs []*config.Diagnostic
+		if len(conf.Main.Modules) > 0 {
+			if err := plugins.Load(conf.Main.ModulesDir, conf.Main.Modules); err != nil {
+				loadErrs = append(loadErrs, conf.Problem("main.modules", "%s", err))
+			}
+		}
+		if err := script.Load(conf); err != nil && !hasErrorsIn(diags, "scripts.") {
+			// Scripts that don't compile are already reported
+			loadErrs = append(loadErrs, conf.Problem("scripts", "%s", err))
+		}
+
+		conf, diags = config.Validate(configFile)
+		diags = append(diags, loadErrs...)
+	}
+
+	for _, d := range diags {
+		fmt.Println(d)
+	}
+	failed := hasErrors(diags)
+
+	if conf != nil && !failed && testOnline {
+		if !checkChannelsOnline(conf) {
+			failed = true
+		}
+	}
+
+	if !failed {
+		fmt.Printf("%s: configuration OK\n", strings.Join(conf.Files(), ", "))
+	}
+	return !failed
+}
+
+func hasErrors(diags []*config.Diagnostic) bool {
+	return hasErrorsIn(diags, "")
+}
+
+// hasErrorsIn returns if diags has errors about settings starting with prefix.
+func hasErrorsIn(diags []*config.Diagnostic, prefix string) bool {
+	for _, d := range diags {
+		if !d.Warning && strings.HasPrefix(d.Key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChannelsOnline reports channels in the configuration that don't
+// exist in Mattermost.
+func checkChannelsOnline(conf *config.Config) bool {
+	used := conf.Channels()
+	channels := make([]string, 0, len(used))
+	for channel := range used {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	missing, err := bot.CheckChannels(conf, channels)
+	if err != nil {
+		fmt.Println(conf.Problem("mattermost", "%s", err))
+		return false
+	}
+
+	ok := true
+	for _, channel := range channels {
+		err, exists := missing[channel]
+		if !exists {
+			continue
+		}
+
+		key := used[channel]
+		if key == "mattermost.debugchannel" {
+			// The bot creates the debug channel if the team exists
+			fmt.Println(conf.Warning(key, "channel %s not found, it will be created: %s", channel, err))
+			continue
+		}
+		fmt.Println(conf.Problem(key, "channel %s not found: %s", channel, err))
+		ok = false
+	}
+	return ok
+}
+
+// printPasswordHash hashes the first line of standard input for use in
+// the configuration file.
+func printPasswordHash() error {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("no password given")
+	}
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+func printCaptures(conf *config.Config, route string) error {
+	captures, err := msgbus.Captures(conf, route)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range captures {
+		fmt.Printf("%s  %s  %s %s (%d bytes)\n",
+			c.ID, c.Time.Format(time.RFC3339), c.Method, c.URL, len(c.Body))
+	}
+	return nil
+}
+
+// replay runs a captured request through its route without sending
+// messages.
+func replay(conf *config.Config, capture string) (*msgbus.Replay, error) {
+	split := strings.SplitN(capture, "/", 2)
+	if len(split) != 2 {
+		return nil, errors.New("capture must be given as ROUTE/ID")
+	}
+
+	c, err := msgbus.GetCapture(conf, split[0], split[1])
+	if err != nil {
+		return nil, err
+	}
+	return msgbus.ReplayCapture(conf, c, false)
+}
+
+// saveReplay saves a replay as a test fixture in file, or prints it if file
+// is empty.
+func saveReplay(replay *msgbus.Replay, file string) error {
+	if file != "" {
+		return utils.SaveJSONFile(file, replay)
+	}
+
+	out, err := json.MarshalIndent(replay, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
 func displayVersionInfo() {
 	pluginSupport := "Disabled"
 	if plugins.PluginsSupported {
@@ -156,6 +156,27 @@ func (c *Client) GetDevice(name string) (*Device, error) {
 	return nil, nil
 }
 
+// AckAlert acknowledges an alert so LibreNMS stops sending notifications for it.
+func (c *Client) AckAlert(id int) error {
+	r := c.makeReq(http.MethodPut, c.makeURL(fmt.Sprintf("/alerts/%d", id)))
+	resp, err := c.doReq(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var data BaseAPI
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return err
+	}
+
+	if data.Status != "ok" {
+		return fmt.Errorf("failed to acknowledge alert %d", id)
+	}
+	return nil
+}
+
 func copyURL(u *url.URL) *url.URL {
 	uu, _ := url.Parse(u.String())
 	return uu
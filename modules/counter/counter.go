@@ -6,16 +6,22 @@ import (
 	"net/http"
 
 	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/storage"
 )
 
 func init() {
 	msgbus.RegisterMsgBus("counter", handleCounter)
 }
 
-var counter = 0
+var store = storage.Namespace("counter")
 
 func handleCounter(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	counter++
+	counter, err := store.In(ctx).Incr("counter", 1)
+	if err != nil {
+		fmt.Printf("Counter: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	msgbus.DispatchMessage(ctx, fmt.Sprintf("Counter: %d", counter))
 }
 
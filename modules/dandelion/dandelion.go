@@ -1,41 +1,181 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/jobs"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
 	"github.com/lfkeitel/yobot/pkg/plugins"
+	"github.com/lfkeitel/yobot/pkg/storage"
 
 	"github.com/lfkeitel/yobot/pkg/config"
-	"github.com/lfkeitel/yobot/pkg/utils"
 )
 
 type dandelionConfig struct {
-	URL, ApiKey string
-	Channels    []string
+	URL      string        `setting:"url,required"`
+	ApiKey   string        `setting:"apikey,required"`
+	Channels []string      `setting:"channels"`
+	Interval time.Duration `setting:"interval" default:"10s"`
 }
 
 func init() {
-	plugins.RegisterInit(dandelionInit)
+	plugins.Register(&dandelionModule{})
+	config.RegisterModuleSettings("dandelion", dandelionConfig{})
+	config.RegisterValidator(validateDandelion)
 }
 
-func dandelionInit(conf *config.Config, bot *bot.Bot) {
-	for _, instance := range conf.Modules["dandelion"] {
+// validateDandelion warns about instances that can't post. Other problems
+// are found by decoding the settings.
+func validateDandelion(conf *config.Config) []*config.Diagnostic {
+	var diags []*config.Diagnostic
+	urls := make(map[string]bool)
+	for i, instance := range conf.Modules["dandelion"] {
+		key := fmt.Sprintf("modules.dandelion[%d]", i)
+
 		var dc dandelionConfig
-		if err := utils.FillStruct(&dc, instance); err != nil {
-			panic(err)
+		if err := config.DecodeSettings(key, instance, &dc); err != nil {
+			continue
+		}
+		if len(dc.Channels) == 0 {
+			diags = append(diags, conf.Warning(key+".channels", "no channels, logs won't be posted"))
+		}
+		if dc.Interval < time.Second {
+			diags = append(diags, conf.Problem(key+".interval", "must be at least 1s"))
 		}
+		if urls[dc.URL] {
+			diags = append(diags, conf.Problem(key+".url", "%s is already configured", dc.URL))
+		}
+		urls[dc.URL] = true
+	}
+	return diags
+}
+
+// dandelionModule posts new logs of each configured Dandelion instance.
+// Each instance is polled by a job named dandelion/URL.
+type dandelionModule struct {
+	lock      sync.Mutex
+	instances []*dandelionPlugin
+	store     *storage.Store
+}
+
+func (m *dandelionModule) Name() string { return "dandelion" }
 
-		fmt.Printf("Starting Dandelion for %s\n", dc.URL)
-		inst := dandelionPlugin{
-			conf: &dc,
+func (m *dandelionModule) Init(ctx context.Context, conf *plugins.Config) error {
+	m.store = conf.Store()
+	instances, err := decodeInstances(conf, m.store)
+	if err != nil {
+		return err
+	}
+	m.instances = instances
+	return nil
+}
+
+func (m *dandelionModule) Start(ctx context.Context, b *bot.Bot) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.run()
+}
+
+// run adds the job of each instance. It must be called with the lock held.
+func (m *dandelionModule) run() error {
+	for i, inst := range m.instances {
+		fmt.Printf("Starting Dandelion for %s\n", inst.conf.URL)
+		err := jobs.Add(&jobs.Job{
+			Name:  inst.jobName(),
+			Every: inst.conf.Interval,
+			Run:   inst.check(),
+		})
+		if err != nil {
+			m.stop(m.instances[:i])
+			return err
 		}
-		go inst.check(bot)
 	}
+	return nil
+}
+
+func (m *dandelionModule) Stop(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stop(m.instances)
+	return nil
+}
+
+// stop removes the jobs of instances.
+func (m *dandelionModule) stop(instances []*dandelionPlugin) {
+	for _, inst := range instances {
+		jobs.Remove(inst.jobName())
+	}
+}
+
+// Reload restarts the instances if their settings changed.
+func (m *dandelionModule) Reload(ctx context.Context, conf *plugins.Config) error {
+	instances, err := decodeInstances(conf, m.store)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if sameInstances(m.instances, instances) {
+		return nil
+	}
+	m.stop(m.instances)
+	m.instances = instances
+	return m.run()
+}
+
+// Health reports the instances whose last API request failed.
+func (m *dandelionModule) Health() error {
+	m.lock.Lock()
+	instances := m.instances
+	m.lock.Unlock()
+
+	var problems []string
+	for _, inst := range instances {
+		if err := inst.health(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", inst.conf.URL, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func decodeInstances(conf *plugins.Config, store *storage.Store) ([]*dandelionPlugin, error) {
+	var configs []*dandelionConfig
+	if err := conf.Decode(&configs); err != nil {
+		return nil, err
+	}
+
+	instances := make([]*dandelionPlugin, len(configs))
+	for i, dc := range configs {
+		instances[i] = &dandelionPlugin{conf: dc, store: store}
+	}
+	return instances, nil
+}
+
+func sameInstances(a, b []*dandelionPlugin) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i].conf, b[i].conf) {
+			return false
+		}
+	}
+	return true
 }
 
 type dandelionResp struct {
@@ -70,69 +210,96 @@ type dandelionMetadata struct {
 }
 
 type dandelionPlugin struct {
-	conf   *dandelionConfig
-	lastID int
+	conf  *dandelionConfig
+	store *storage.Store
+
+	errLock sync.Mutex
+	lastErr error
+}
+
+// health reports the error of the last API request.
+func (d *dandelionPlugin) health() error {
+	d.errLock.Lock()
+	defer d.errLock.Unlock()
+	return d.lastErr
+}
+
+func (d *dandelionPlugin) setError(err error) {
+	d.errLock.Lock()
+	d.lastErr = err
+	d.errLock.Unlock()
+}
+
+func (d *dandelionPlugin) jobName() string {
+	return "dandelion/" + d.conf.URL
+}
+
+// check returns the job posting new logs.
+func (d *dandelionPlugin) check() func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		err := d.poll(ctx)
+		d.setError(err)
+		return err
+	}
 }
 
-func (d dandelionPlugin) check(bot *bot.Bot) {
-	readAPI := d.conf.URL + "/api/logs/read"
+func (d *dandelionPlugin) poll(ctx context.Context) error {
 	params := make(url.Values)
 	params.Set("apikey", d.conf.ApiKey)
 	params.Set("limit", "10")
-	readAPI = readAPI + "?" + params.Encode()
 
-	for {
-		var decoder *json.Decoder
-		var apiResp dandelionResp
-		var newID int
+	req, err := http.NewRequest(http.MethodGet, d.conf.URL+"/api/logs/read?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
 
-		resp, err := http.Get(readAPI)
-		if err != nil {
-			fmt.Println(err)
-			goto sleep
-		}
-		defer resp.Body.Close()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-		decoder = json.NewDecoder(resp.Body)
-		if err := decoder.Decode(&apiResp); err != nil {
-			fmt.Println(err)
-			goto sleep
-		}
+	var apiResp dandelionResp
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return err
+	}
 
-		// Bad API request
-		if apiResp.Errorcode != 0 {
-			fmt.Println(apiResp.Status)
-			goto sleep
-		}
+	// Bad API request
+	if apiResp.Errorcode != 0 {
+		return fmt.Errorf("API error: %s", apiResp.Status)
+	}
 
-		// No returned logs
-		if apiResp.Data.Metadata.ResultCount == 0 {
-			goto sleep
-		}
+	// No returned logs
+	if len(apiResp.Data.Logs) == 0 {
+		return nil
+	}
 
-		newID = apiResp.Data.Logs[0].ID
-		if d.lastID == 0 {
-			d.lastID = newID
-			goto sleep
-		}
-		if newID <= d.lastID {
-			goto sleep
-		}
+	// The ID of the last posted log is kept per instance so logs created
+	// while Yobot is stopped are posted when it starts
+	key := "last_id/" + d.conf.URL
+	lastID := 0
+	if _, err := d.store.Get(key, &lastID); err != nil {
+		return err
+	}
 
-		for _, log := range apiResp.Data.Logs {
-			if log.ID > d.lastID {
-				msg := fmt.Sprintf("### Dandelion\n\n**%s** (%s) <%s/log/%d>", log.Title, log.Fullname, d.conf.URL, log.ID)
+	newID := apiResp.Data.Logs[0].ID
+	if lastID == 0 {
+		return d.store.Set(key, newID)
+	}
+	if newID <= lastID {
+		return nil
+	}
 
-				for _, channel := range d.conf.Channels {
-					bot.SendMsgTeamChannel(channel, msg)
-				}
+	for _, log := range apiResp.Data.Logs {
+		if log.ID > lastID {
+			msg := fmt.Sprintf("### Dandelion\n\n**%s** (%s) <%s/log/%d>", log.Title, log.Fullname, d.conf.URL, log.ID)
+
+			for _, channel := range d.conf.Channels {
+				msgbus.SendMessage(channel, msg, "")
 			}
 		}
-		d.lastID = newID
-
-	sleep:
-		time.Sleep(10 * time.Second)
 	}
+	return d.store.Set(key, newID)
 }
 
 func main() {}
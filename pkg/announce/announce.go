@@ -0,0 +1,253 @@
+// Package announce posts messages to channels on a schedule. Announcements
+// are defined in the configuration file or created in chat.
+package announce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/jobs"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/schedule"
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+func init() {
+	msgbus.RegisterReloadHook(reloadConfig)
+	config.RegisterValidator(validateAnnouncements)
+}
+
+// Announcement is a message posted on a schedule. Announcements created in
+// chat have the user who created them.
+type Announcement struct {
+	Name      string    `json:"name"`
+	Schedule  string    `json:"schedule"`
+	Timezone  string    `json:"timezone,omitempty"`
+	Channels  []string  `json:"channels"`
+	Message   string    `json:"message"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Created   time.Time `json:"created"`
+
+	cron     *schedule.Cron
+	location *time.Location
+}
+
+var (
+	lock          sync.Mutex
+	started       bool
+	announcements = map[string]*Announcement{}
+
+	// Announcements created in chat
+	store = storage.Namespace("announcements")
+)
+
+// Start schedules the announcements in the configuration and the ones
+// created in chat.
+func Start(conf *config.Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	names, err := store.Keys("")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		a := &Announcement{}
+		if _, err := store.Get(name, a); err != nil {
+			return err
+		}
+		if err := a.compile(); err != nil {
+			fmt.Printf("Announcement %s: %s\n", name, err)
+			continue
+		}
+		if _, exists := conf.Announcements[name]; exists {
+			fmt.Printf("Announcement %s created in chat is replaced by the configuration\n", name)
+			continue
+		}
+		if err := scheduleJob(a); err != nil {
+			return err
+		}
+	}
+
+	started = true
+	return scheduleConfigured(conf)
+}
+
+// reloadConfig replaces the announcements from the configuration file.
+func reloadConfig(conf *config.Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	// Check all of them before replacing any
+	for name, ac := range conf.Announcements {
+		if _, err := fromConfig(name, ac); err != nil {
+			return fmt.Errorf("announcement %s: %s", name, err)
+		}
+	}
+
+	for name, a := range announcements {
+		if a.CreatedBy == "" {
+			unscheduleJob(name)
+		}
+	}
+	return scheduleConfigured(conf)
+}
+
+// scheduleConfigured must be called with the lock held.
+func scheduleConfigured(conf *config.Config) error {
+	for name, ac := range conf.Announcements {
+		a, err := fromConfig(name, ac)
+		if err != nil {
+			return fmt.Errorf("announcement %s: %s", name, err)
+		}
+		if announcements[name] != nil {
+			unscheduleJob(name) // Created in chat
+		}
+		if err := scheduleJob(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAnnouncements(conf *config.Config) []*config.Diagnostic {
+	var diags []*config.Diagnostic
+	for name, ac := range conf.Announcements {
+		if _, err := fromConfig(name, ac); err != nil {
+			diags = append(diags, conf.Problem("announcements."+name, "%s", err))
+		}
+	}
+	return diags
+}
+
+func fromConfig(name string, ac *config.AnnouncementConfig) (*Announcement, error) {
+	a := &Announcement{
+		Name:     name,
+		Schedule: ac.Schedule,
+		Timezone: ac.Timezone,
+		Channels: ac.Channels,
+		Message:  ac.Message,
+	}
+	return a, a.compile()
+}
+
+// compile checks an announcement and parses its schedule.
+func (a *Announcement) compile() error {
+	if a.Schedule == "" {
+		return errors.New("schedule is required")
+	}
+	if len(a.Channels) == 0 {
+		return errors.New("channels are required")
+	}
+	if strings.TrimSpace(a.Message) == "" {
+		return errors.New("message is required")
+	}
+
+	var err error
+	if a.cron, err = schedule.ParseCron(a.Schedule); err != nil {
+		return err
+	}
+	if a.location, err = schedule.LoadLocation(a.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Next returns the next time the announcement is posted.
+func (a *Announcement) Next(now time.Time) time.Time {
+	return a.cron.Next(now.In(a.location))
+}
+
+// scheduleJob adds the job posting an announcement. It must be called with
+// the lock held.
+func scheduleJob(a *Announcement) error {
+	err := jobs.Add(&jobs.Job{
+		Name:     "announce/" + a.Name,
+		Cron:     a.Schedule,
+		Location: a.location,
+		Run:      a.post,
+	})
+	if err != nil {
+		return err
+	}
+	announcements[a.Name] = a
+	return nil
+}
+
+// unscheduleJob must be called with the lock held.
+func unscheduleJob(name string) {
+	jobs.Remove("announce/" + name)
+	delete(announcements, name)
+}
+
+// post queues the announcement so it's retried if Mattermost is down.
+func (a *Announcement) post(ctx context.Context) error {
+	for _, channel := range a.Channels {
+		msgbus.SendMessage(channel, a.Message, "")
+	}
+	return nil
+}
+
+// Add creates an announcement from chat. It's saved so it survives restarts.
+func Add(a *Announcement) error {
+	if err := a.compile(); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, exists := announcements[a.Name]; exists {
+		return fmt.Errorf("announcement %s already exists", a.Name)
+	}
+	if err := store.Set(a.Name, a); err != nil {
+		return err
+	}
+	if err := scheduleJob(a); err != nil {
+		store.Delete(a.Name)
+		return err
+	}
+	return nil
+}
+
+// Cancel removes an announcement created in chat.
+func Cancel(name string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	a := announcements[name]
+	if a == nil {
+		return fmt.Errorf("announcement %s doesn't exist", name)
+	}
+	if a.CreatedBy == "" {
+		return fmt.Errorf("announcement %s is in the configuration file, remove it there", name)
+	}
+	if err := store.Delete(name); err != nil {
+		return err
+	}
+	unscheduleJob(name)
+	return nil
+}
+
+// List returns the announcements sorted by name.
+func List() []*Announcement {
+	lock.Lock()
+	defer lock.Unlock()
+
+	list := make([]*Announcement, 0, len(announcements))
+	for _, a := range announcements {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,137 @@
+package announce
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+)
+
+const (
+	usage    = "Usage: announce list | announce add NAME CHANNEL[,CHANNEL] SCHEDULE [tz=ZONE] | MESSAGE | announce cancel NAME"
+	addUsage = "Usage: announce add NAME CHANNEL[,CHANNEL] SCHEDULE [tz=ZONE] | MESSAGE, where SCHEDULE is a cron expression or a phrase like \"every friday at 3pm\""
+)
+
+func init() {
+	bot.RegisterCommand("announce", &bot.Command{
+		Help:    "Post messages on a schedule: " + strings.TrimPrefix(usage, "Usage: "),
+		Handler: announceCmd,
+	})
+}
+
+func announceCmd(b *bot.Bot, event *bot.CommandEvent) error {
+	if len(event.Args) == 0 {
+		return b.Reply(event.Post, usage)
+	}
+
+	switch event.Args[0] {
+	case "list":
+		return b.Reply(event.Post, listCmd())
+
+	case "add":
+		return b.Reply(event.Post, addCmd(b, event))
+
+	case "cancel", "delete":
+		if len(event.Args) != 2 {
+			return b.Reply(event.Post, "Usage: announce cancel NAME")
+		}
+		if err := Cancel(event.Args[1]); err != nil {
+			return b.Reply(event.Post, err.Error())
+		}
+		return b.Reply(event.Post, fmt.Sprintf("Cancelled announcement %s", event.Args[1]))
+	}
+	return b.Reply(event.Post, usage)
+}
+
+func listCmd() string {
+	list := List()
+	if len(list) == 0 {
+		return "There are no announcements."
+	}
+
+	now := time.Now()
+	var msg strings.Builder
+	msg.WriteString("Announcements:\n")
+	for _, a := range list {
+		source := "configuration file"
+		if a.CreatedBy != "" {
+			source = "@" + a.CreatedBy
+		}
+		fmt.Fprintf(&msg, "\n- **%s** %s to %s, next %s (%s): %s", a.Name, a.Schedule,
+			strings.Join(a.Channels, ", "), a.Next(now).Format(time.RFC1123), source, firstLine(a.Message))
+	}
+	return msg.String()
+}
+
+// addCmd parses "add NAME CHANNELS SCHEDULE... [tz=ZONE] | MESSAGE".
+func addCmd(b *bot.Bot, event *bot.CommandEvent) string {
+	args := event.Args[1:]
+	sep := -1
+	for i, arg := range args {
+		if arg == "|" {
+			sep = i
+			break
+		}
+	}
+	if len(args) < 3 || sep < 3 || sep == len(args)-1 {
+		return addUsage
+	}
+
+	a := &Announcement{
+		Name:      args[0],
+		Channels:  strings.Split(args[1], ","),
+		Message:   messageText(event.Post.Message, args[:sep], args[sep+1:]),
+		CreatedBy: b.Username(event.Post.UserId),
+		Created:   time.Now(),
+	}
+
+	var when []string
+	for _, arg := range args[2:sep] {
+		if strings.HasPrefix(arg, "tz=") {
+			a.Timezone = arg[3:]
+		} else {
+			when = append(when, arg)
+		}
+	}
+	a.Schedule = strings.Join(when, " ")
+
+	for _, channel := range a.Channels {
+		if err := checkChannel(b, channel); err != nil {
+			return fmt.Sprintf("Channel %s: %s", channel, err)
+		}
+	}
+
+	if err := Add(a); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Added announcement %s, next posted %s", a.Name, a.Next(time.Now()).Format(time.RFC1123))
+}
+
+// checkChannel returns an error if the bot can't find a team:channel or
+// @user channel.
+func checkChannel(b *bot.Bot, name string) error {
+	if strings.HasPrefix(name, "@") {
+		_, err := b.FindDirectChannel(name[1:])
+		return err
+	}
+	_, err := b.FindChannelWithTeam(name)
+	return err
+}
+
+// messageText returns the text after the separator in the post so the
+// message keeps its formatting.
+func messageText(post string, before, after []string) string {
+	i := strings.Index(post, "|")
+	if i < 0 || strings.Contains(strings.Join(before, " "), "|") {
+		return strings.Join(after, " ")
+	}
+	return strings.TrimSpace(post[i+1:])
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + "..."
+	}
+	return s
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lfkeitel/yobot/pkg/config"
@@ -13,7 +15,10 @@ import (
 
 var (
 	bot     *Bot
-	appconf *config.Config
+	appconf struct {
+		sync.RWMutex
+		conf *config.Config
+	}
 )
 
 type Bot struct {
@@ -24,11 +29,27 @@ type Bot struct {
 	UserID       string
 	debugChannel *model.Channel
 	chanCache    map[string]*model.Channel
+	cacheLock    sync.Mutex
 	wsClient     *model.WebSocketClient
+	wsConnected  int32
 }
 
 func GetBot() *Bot { return bot }
 
+// SetConfig replaces the configuration given to commands, such as when the
+// configuration is reloaded.
+func SetConfig(conf *config.Config) {
+	appconf.Lock()
+	defer appconf.Unlock()
+	appconf.conf = conf
+}
+
+func currentConfig() *config.Config {
+	appconf.RLock()
+	defer appconf.RUnlock()
+	return appconf.conf
+}
+
 // Start will attempt to the start the Mattermost client.
 func Start(conf *config.Config, quit, done chan bool) error {
 	ready := make(chan bool)
@@ -54,7 +75,7 @@ func start(conf *config.Config, quit, done, ready chan bool) {
 		c:         model.NewAPIv4Client(conf.Mattermost.Server),
 		chanCache: make(map[string]*model.Channel),
 	}
-	appconf = conf
+	SetConfig(conf)
 
 	// Check server is available
 	props, resp := bot.c.GetOldClientConfig("")
@@ -73,6 +94,10 @@ func start(conf *config.Config, quit, done, ready chan bool) {
 
 	// team:channel
 	debugChan := strings.SplitN(conf.Mattermost.DebugChannel, ":", 2)
+	if len(debugChan) != 2 {
+		fmt.Printf("Debug channel %s must be in team:channel form\n", conf.Mattermost.DebugChannel)
+		return
+	}
 
 	// Get debug team info
 	team, err := bot.FindTeam(debugChan[0])
@@ -127,7 +152,8 @@ func makeDebugChannel(client *model.Client4, name, teamID string) (*model.Channe
 }
 
 func (b *Bot) login() error {
-	user, resp := bot.c.Login(appconf.Mattermost.Login.Username, appconf.Mattermost.Login.Password)
+	conf := currentConfig()
+	user, resp := bot.c.Login(conf.Mattermost.Login.Username, conf.Mattermost.Login.Password)
 	if resp.Error != nil {
 		return fmt.Errorf("There was a problem logging into the Mattermost server.  Are you sure ran the setup steps from the README.md?\n%s", resp.Error.Error())
 	}
@@ -143,6 +169,7 @@ func (b *Bot) startWebsocket() error {
 	fmt.Printf("Connecting to websocket %s\n", bot.wsURL.String())
 	if b.wsClient != nil {
 		reconnect = true
+		websocketReconnects.Inc()
 		b.wsClient.Close()
 	}
 
@@ -155,20 +182,25 @@ func (b *Bot) startWebsocket() error {
 
 	if !reconnect {
 		bot.RegisterEventHandler(bot.handleMsgFromDebuggingChannel, bot.debugChannel.Id, model.WEBSOCKET_EVENT_POSTED)
+		bot.RegisterEventHandler(bot.handleCommandMessage, "*", model.WEBSOCKET_EVENT_POSTED)
 	}
 	bot.wsClient = webSocketClient
+	atomic.StoreInt32(&b.wsConnected, 1)
 
 	go func() {
 		for {
 			select {
-			case resp, ok := <-bot.wsClient.EventChannel:
+			case resp, ok := <-webSocketClient.EventChannel:
 				if !ok { // Event channel is closed
+					if b.wsClient == webSocketClient {
+						atomic.StoreInt32(&b.wsConnected, 0)
+					}
 					bot.debugMsg("_Yobot has closed its websocket_", "")
 					return
 				}
 
 				bot.handleEvents(resp)
-			case <-bot.wsClient.ResponseChannel:
+			case <-webSocketClient.ResponseChannel:
 				continue
 			}
 		}
@@ -176,7 +208,13 @@ func (b *Bot) startWebsocket() error {
 	return nil
 }
 
+// WebsocketConnected returns if the bot is receiving events from Mattermost.
+func (b *Bot) WebsocketConnected() bool {
+	return atomic.LoadInt32(&b.wsConnected) == 1
+}
+
 func (b *Bot) relogin() error {
+	relogins.Inc()
 	if err := b.login(); err != nil {
 		return errors.New("session expired and failed to login again, please check credentials")
 	}
@@ -192,18 +230,47 @@ func (b *Bot) debugMsg(msg, replyID string) {
 	b.sendMsg(b.debugChannel.Id, msg, replyID)
 }
 
+// SendDebugMsg posts a message to the debug channel.
+func (b *Bot) SendDebugMsg(msg string) {
+	b.debugMsg(msg, "")
+}
+
 func (b *Bot) SendMsgTeamChannel(name, msg string) error {
+	_, err := b.PostToTeamChannel(name, &model.Post{Message: msg})
+	return err
+}
+
+// PostToTeamChannel creates a post in a team:channel and returns the created post.
+// If name is @username, the post is sent as a direct message to the user.
+func (b *Bot) PostToTeamChannel(name string, post *model.Post) (*model.Post, error) {
+	b.cacheLock.Lock()
 	c, cached := b.chanCache[name]
+	b.cacheLock.Unlock()
+
 	var err error
 	if !cached {
-		c, err = b.FindChannelWithTeam(name)
+		if strings.HasPrefix(name, "@") {
+			c, err = b.FindDirectChannel(name[1:])
+		} else {
+			c, err = b.FindChannelWithTeam(name)
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
+
+		b.cacheLock.Lock()
 		b.chanCache[name] = c
+		b.cacheLock.Unlock()
 	}
 
-	return b.sendMsg(c.Id, msg, "")
+	post.ChannelId = c.Id
+	return b.createPost(post)
+}
+
+// SendMsgChannel sends a message to a channel by ID. With a rootID, the
+// message is a reply in that thread.
+func (b *Bot) SendMsgChannel(id, msg, rootID string) error {
+	return b.sendMsg(id, msg, rootID)
 }
 
 func (b *Bot) sendMsg(id, msg, replyID string) error {
@@ -212,18 +279,46 @@ func (b *Bot) sendMsg(id, msg, replyID string) error {
 	post.Message = msg
 	post.RootId = replyID
 
-	_, resp := b.c.CreatePost(post)
+	_, err := b.createPost(post)
+	return err
+}
+
+func (b *Bot) createPost(post *model.Post) (*model.Post, error) {
+	created, resp := b.c.CreatePost(post)
 	if resp.Error == nil {
-		return nil
+		postsSent.Inc()
+		return created, nil
 	}
 
 	if resp.Error.Id == "api.context.session_expired.app_error" {
 		if err := b.relogin(); err != nil {
-			return err
+			sendFailures.Inc()
+			return nil, err
 		}
 
-		return b.sendMsg(id, msg, replyID)
+		return b.createPost(post)
 	}
 
-	return fmt.Errorf("failed to send message: %s (%s)", resp.Error.Error(), resp.Error.Id)
+	sendFailures.Inc()
+	return nil, fmt.Errorf("failed to send message: %w (%s)", resp.Error, resp.Error.Id)
+}
+
+// FlushChannelCache forgets all looked up channels and returns how many
+// were cached.
+func (b *Bot) FlushChannelCache() int {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	n := len(b.chanCache)
+	b.chanCache = make(map[string]*model.Channel)
+	return n
+}
+
+// PatchPost updates the message and/or properties of an existing post.
+func (b *Bot) PatchPost(id string, patch *model.PostPatch) (*model.Post, error) {
+	post, resp := b.c.PatchPost(id, patch)
+	if resp.Error != nil {
+		return nil, fmt.Errorf("failed to update post: %s (%s)", resp.Error.Error(), resp.Error.Id)
+	}
+	return post, nil
 }
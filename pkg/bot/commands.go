@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// A Command is a chat command. Commands are ran when a message starts with a
+// mention of the bot followed by the command name, when the command is sent
+// in a direct message to the bot, or when it's sent in the debug channel.
+type Command struct {
+	Help    string
+	Handler CommandHandler
+}
+
+type CommandHandler func(b *Bot, event *CommandEvent) error
+
+// CommandEvent is the message that triggered a command.
+type CommandEvent struct {
+	Config  *config.Config
+	Post    *model.Post
+	Command string
+	Args    []string
+}
+
+var commands = struct {
+	sync.RWMutex
+	byName map[string]*Command
+}{byName: make(map[string]*Command)}
+
+// RegisterCommand adds a chat command. Command names are case insensitive.
+func RegisterCommand(name string, cmd *Command) {
+	commands.Lock()
+	defer commands.Unlock()
+
+	name = strings.ToLower(name)
+	if _, exists := commands.byName[name]; exists {
+		panic(fmt.Sprintf("command %s is already registered", name))
+	}
+	commands.byName[name] = cmd
+}
+
+func init() {
+	RegisterCommand("help", &Command{
+		Help:    "List available commands: help",
+		Handler: helpCmd,
+	})
+}
+
+func helpCmd(b *Bot, event *CommandEvent) error {
+	commands.RLock()
+	names := make([]string, 0, len(commands.byName))
+	for name := range commands.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var msg strings.Builder
+	msg.WriteString("Available commands:\n\n")
+	for _, name := range names {
+		fmt.Fprintf(&msg, "- **%s** - %s\n", name, commands.byName[name].Help)
+	}
+	commands.RUnlock()
+	return b.Reply(event.Post, msg.String())
+}
+
+// IsAdmin returns if the sender of post may run admin commands. Commands in
+// the debug channel and from users in Mattermost.Admins are allowed.
+func (b *Bot) IsAdmin(post *model.Post) bool {
+	if b.debugChannel != nil && post.ChannelId == b.debugChannel.Id {
+		return true
+	}
+	return utils.StringInSlice(b.Username(post.UserId), currentConfig().Mattermost.Admins)
+}
+
+// Reply sends a message in the same thread as post.
+func (b *Bot) Reply(post *model.Post, msg string) error {
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+	return b.sendMsg(post.ChannelId, msg, rootID)
+}
+
+func (b *Bot) handleCommandMessage(event *model.WebSocketEvent) {
+	// The debugging channel handler processes its own commands
+	if event.Broadcast.ChannelId == b.debugChannel.Id {
+		return
+	}
+
+	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+	if post == nil || post.UserId == b.user.Id || post.IsSystemMessage() {
+		return
+	}
+
+	channelType, _ := event.Data["channel_type"].(string)
+	msg, mentioned := b.trimMention(post.Message)
+	if !mentioned && channelType != model.CHANNEL_DIRECT {
+		return
+	}
+
+	if !b.runCommand(post, msg) && mentioned {
+		b.Reply(post, "I don't know that command. Try `help`.")
+	}
+}
+
+// trimMention removes a leading mention of the bot from msg.
+func (b *Bot) trimMention(msg string) (string, bool) {
+	mention := "@" + b.user.Username
+	if len(msg) < len(mention) || !strings.EqualFold(msg[:len(mention)], mention) {
+		return msg, false
+	}
+	msg = strings.TrimPrefix(msg[len(mention):], ":")
+	return strings.TrimSpace(msg), true
+}
+
+// runCommand executes a command message. It returns false if the message
+// wasn't a known command.
+func (b *Bot) runCommand(post *model.Post, msg string) bool {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 {
+		return false
+	}
+
+	name := strings.ToLower(fields[0])
+	commands.RLock()
+	cmd, exists := commands.byName[name]
+	commands.RUnlock()
+	if !exists {
+		return false
+	}
+
+	event := &CommandEvent{
+		Config:  currentConfig(),
+		Post:    post,
+		Command: name,
+		Args:    fields[1:],
+	}
+
+	if err := cmd.Handler(b, event); err != nil {
+		fmt.Printf("Command %s failed: %s\n", name, err)
+		b.Reply(post, fmt.Sprintf("Error: %s", err))
+	}
+	return true
+}
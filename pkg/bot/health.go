@@ -0,0 +1,56 @@
+package bot
+
+import (
+	"errors"
+
+	"github.com/lfkeitel/yobot/pkg/health"
+)
+
+var errNotStarted = errors.New("bot hasn't started")
+
+// Mattermost being down only makes the bot not ready. Restarting the bot
+// wouldn't help and would stop it from posting the queued messages once
+// Mattermost is back.
+func init() {
+	health.RegisterCheck("mattermost_api", false, checkAPI)
+	health.RegisterCheck("mattermost_login", false, checkLogin)
+	health.RegisterCheck("mattermost_websocket", false, checkWebsocket)
+}
+
+// checkAPI checks the Mattermost server responds to REST requests.
+func checkAPI() error {
+	b := GetBot()
+	if b == nil {
+		return errNotStarted
+	}
+
+	if _, resp := b.c.GetPing(); resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
+
+// checkLogin checks the bot's session is still valid.
+func checkLogin() error {
+	b := GetBot()
+	if b == nil || b.user == nil {
+		return errNotStarted
+	}
+
+	if _, resp := b.c.GetMe(""); resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
+
+func checkWebsocket() error {
+	b := GetBot()
+	if b == nil {
+		return errNotStarted
+	}
+
+	if !b.WebsocketConnected() {
+		return errors.New("websocket is disconnected")
+	}
+	return nil
+}
@@ -1,22 +1,31 @@
 package bot
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 
+	"github.com/lfkeitel/yobot/pkg/config"
 	"github.com/mattermost/mattermost-server/model"
 )
 
+var errChannelName = errors.New("must be in team:channel form")
+
 func (b *Bot) FindChannelWithTeam(name string) (*model.Channel, error) {
 	c := strings.SplitN(name, ":", 2)
+	if len(c) != 2 {
+		return nil, fmt.Errorf("channel %s %w", name, errChannelName)
+	}
 
 	team, err := b.FindTeam(c[0])
 	if err != nil {
 		return nil, err
 	}
 
-	return bot.FindChannel(c[1], team.Id)
+	return b.FindChannel(c[1], team.Id)
 }
 
 func (b *Bot) FindTeam(name string) (*model.Team, error) {
@@ -37,17 +46,111 @@ func (b *Bot) FindChannel(name, teamID string) (*model.Channel, error) {
 	return channel, nil
 }
 
+// FindDirectChannel returns the direct message channel between the bot and a user.
+func (b *Bot) FindDirectChannel(username string) (*model.Channel, error) {
+	user, resp := b.c.GetUserByUsername(username, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	channel, resp := b.c.CreateDirectChannel(b.UserID, user.Id)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return channel, nil
+}
+
+// CheckChannels logs into Mattermost and looks up channels in team:channel
+// or @user form. It returns the channels that couldn't be found. The running
+// bot isn't used so the configuration can be checked before starting.
+func CheckChannels(conf *config.Config, channels []string) (map[string]error, error) {
+	b := &Bot{c: model.NewAPIv4Client(conf.Mattermost.Server)}
+	if _, resp := b.c.Login(conf.Mattermost.Login.Username, conf.Mattermost.Login.Password); resp.Error != nil {
+		return nil, fmt.Errorf("logging into Mattermost: %s", resp.Error)
+	}
+	defer b.c.Logout()
+
+	missing := make(map[string]error)
+	for _, name := range channels {
+		var err error
+		if strings.HasPrefix(name, "@") {
+			_, resp := b.c.GetUserByUsername(name[1:], "")
+			err = resp.Error
+		} else {
+			_, err = b.FindChannelWithTeam(name)
+		}
+		if err != nil {
+			missing[name] = err
+		}
+	}
+	return missing, nil
+}
+
+// IsPermanent returns if sending a message failed for a reason trying again
+// won't fix, such as a channel name that isn't in team:channel form, a
+// channel that doesn't exist, or a post Mattermost refuses.
+func IsPermanent(err error) bool {
+	if errors.Is(err, errChannelName) {
+		return true
+	}
+
+	var appErr *model.AppError
+	if !errors.As(err, &appErr) {
+		return false
+	}
+	switch appErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return appErr.StatusCode >= 400 && appErr.StatusCode < 500
+}
+
+// GetChannel returns a channel by ID.
+func (b *Bot) GetChannel(id string) (*model.Channel, error) {
+	channel, resp := b.c.GetChannel(id, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return channel, nil
+}
+
+// GetUser returns a user by ID.
+func (b *Bot) GetUser(id string) (*model.User, error) {
+	user, resp := b.c.GetUser(id, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return user, nil
+}
+
+// Username returns the username of a user ID. If the user can't be found,
+// the ID is returned.
+func (b *Bot) Username(id string) string {
+	user, err := b.GetUser(id)
+	if err != nil {
+		return id
+	}
+	return user.Username
+}
+
 type EventHandler func(event *model.WebSocketEvent)
 type eventHandler struct {
 	h         EventHandler
 	channelId string
 }
 
-var eventHandlers = make(map[string][]eventHandler, 5)
+// Handlers are registered by modules while the bot is receiving events
+var eventHandlers = struct {
+	sync.RWMutex
+	byType map[string][]eventHandler
+}{byType: make(map[string][]eventHandler, 5)}
 
 func (b *Bot) RegisterEventHandler(h EventHandler, channelId string, eventTypes ...string) {
+	eventHandlers.Lock()
+	defer eventHandlers.Unlock()
+
 	for _, t := range eventTypes {
-		eventHandlers[t] = append(eventHandlers[t], eventHandler{
+		eventHandlers.byType[t] = append(eventHandlers.byType[t], eventHandler{
 			h:         h,
 			channelId: channelId,
 		})
@@ -55,18 +158,32 @@ func (b *Bot) RegisterEventHandler(h EventHandler, channelId string, eventTypes
 }
 
 func (b *Bot) handleEvents(event *model.WebSocketEvent) {
-	handlers := eventHandlers[event.Event]
+	eventHandlers.RLock()
+	handlers := eventHandlers.byType[event.Event]
+	eventHandlers.RUnlock()
 	if len(handlers) == 0 {
 		return
 	}
 
 	for _, h := range handlers {
 		if h.channelId == "*" || h.channelId == event.Broadcast.ChannelId {
-			h.h(event)
+			runEventHandler(h.h, event)
 		}
 	}
 }
 
+// runEventHandler calls a handler and recovers from a panic so one bad
+// handler doesn't stop the others or the bot.
+func runEventHandler(h EventHandler, event *model.WebSocketEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			eventHandlerPanics.Inc(event.Event)
+			fmt.Printf("Event handler for %s panicked: %v\n", event.Event, r)
+		}
+	}()
+	h(event)
+}
+
 func (b *Bot) testDirectMessage(event *model.WebSocketEvent) {
 	fmt.Printf("%#v\n", event)
 }
@@ -82,6 +199,11 @@ func (b *Bot) handleMsgFromDebuggingChannel(event *model.WebSocketEvent) {
 		return
 	}
 
+	msg, _ := b.trimMention(post.Message)
+	if b.runCommand(post, msg) {
+		return
+	}
+
 	// if you see any word matching 'alive' then respond
 	if matched, _ := regexp.MatchString(`(?:^|\W)alive(?:$|\W)`, post.Message); matched {
 		b.debugMsg("Yes I'm running", post.Id)
@@ -0,0 +1,16 @@
+package bot
+
+import "github.com/lfkeitel/yobot/pkg/metrics"
+
+var (
+	postsSent = metrics.NewCounter("yobot_mattermost_posts_total",
+		"Posts created in Mattermost.")
+	sendFailures = metrics.NewCounter("yobot_mattermost_send_failures_total",
+		"Posts that failed to be created in Mattermost.")
+	relogins = metrics.NewCounter("yobot_mattermost_relogins_total",
+		"Logins after the Mattermost session expired.")
+	websocketReconnects = metrics.NewCounter("yobot_websocket_reconnects_total",
+		"Reconnections to the Mattermost websocket.")
+	eventHandlerPanics = metrics.NewCounter("yobot_event_handler_panics_total",
+		"Panics recovered in websocket event handlers.", "event")
+)
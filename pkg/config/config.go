@@ -2,21 +2,32 @@ package config
 
 import (
 	"errors"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 
 	"github.com/lfkeitel/yobot/pkg/utils"
-	"github.com/naoina/toml"
 )
 
 type Config struct {
-	Main       MainConfig
-	Mattermost MattermostConfig
-	HTTP       HTTPConfig
-	Team       map[string]TeamConfig
-	Routes     map[string]*RouteConfig
-	Modules    map[string][]map[string]interface{}
+	Include       []string
+	Main          MainConfig
+	Mattermost    MattermostConfig
+	HTTP          HTTPConfig
+	Queue         QueueConfig
+	Alerts        AlertsConfig
+	Team          map[string]TeamConfig
+	Routes        map[string]*RouteConfig
+	QuietHours    map[string]*QuietHoursConfig
+	Escalation    map[string]*EscalationConfig
+	OnCall        OnCallConfig
+	Announcements map[string]*AnnouncementConfig
+	Modules       map[string][]map[string]interface{}
+	External      map[string]*ExternalConfig
+	Scripts       ScriptsConfig
+
+	filename string
+	files    []string            // Main file and included files
+	lines    map[string]position // Where settings are in the files
+	secrets  map[string]bool     // Settings read from secret files
 }
 
 type MainConfig struct {
@@ -31,6 +42,7 @@ type MattermostConfig struct {
 	Server       string
 	InsecureTLS  bool
 	DebugChannel string
+	Admins       []string // Usernames allowed to run admin commands
 
 	Login struct {
 		Username, Password string
@@ -41,8 +53,86 @@ type MattermostConfig struct {
 	}
 }
 
+// HTTPConfig configures the HTTP server. Listen has extra addresses in the
+// form "tcp://host:port", "tls://host:port", or "unix:///path/to/socket".
 type HTTPConfig struct {
-	Address string
+	Address        string
+	Listen         []string
+	SocketMode     string
+	PublicURL      string
+	Workers        int
+	Backlog        int
+	MaxBodyBytes   int64
+	TrustedProxies []string
+	AuthFailures   int
+	AuthLockout    string
+	TLS            TLSConfig
+	Admin          AdminConfig
+}
+
+// TLSConfig is the certificate used by TLS listeners. When ClientCAFile is
+// set, client certificates signed by it are verified.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+type AdminConfig struct {
+	Enabled  bool
+	Username string
+	Password string
+}
+
+// QueueConfig controls delivery retries of outbound messages.
+type QueueConfig struct {
+	MaxAttempts int
+	MaxAge      string
+}
+
+// AlertsConfig controls how alerts posted by the bot can be acted on. Emoji
+// names are without colons.
+type AlertsConfig struct {
+	AckEmoji        []string
+	ResolveEmoji    []string
+	SilenceEmoji    []string
+	SilenceDuration string
+	Buttons         bool
+}
+
+// EscalationConfig is a chain of steps taken when nobody responds to an alert.
+type EscalationConfig struct {
+	Steps []EscalationStep
+}
+
+// EscalationStep is taken After a duration since the alert was posted.
+// A step can post a copy of the alert to a Channel, Mention users in the
+// alert's thread, and/or send a direct message (DM) to a user.
+type EscalationStep struct {
+	After   string
+	Channel string
+	Mention string
+	DM      string
+}
+
+type OnCallConfig struct {
+	SlashToken string
+	ICalToken  string
+	Rotations  map[string]*RotationConfig
+}
+
+// RotationConfig is an on-call rotation. Handoff is "daily" or "weekly".
+// Weekly rotations hand off on Day. Handoffs happen at Time in Timezone
+// starting on the Start date except on Holidays. Dates are YYYY-MM-DD.
+type RotationConfig struct {
+	Members  []string
+	Handoff  string
+	Day      string
+	Time     string
+	Timezone string
+	Start    string
+	Announce string
+	Holidays []string
 }
 
 type TeamConfig struct {
@@ -56,9 +146,71 @@ type RouteConfig struct {
 	Username        string
 	Password        string
 	Alias           string
+	Async           bool
+	Escalation      string
+	OnCall          string
+	ClientCerts     []string
+	APIKeys         []APIKeyConfig
+	AllowedIPs      []string
+	DenyQueryKey    bool
+	RateLimit       string
+	RateBurst       int
+	SourceRateLimit string
+	SourceRateBurst int
+	Capture         int
 	Settings        map[string]interface{}
 }
 
+// APIKeyConfig is a named key accepted as a bearer token. Key can be
+// plaintext or a bcrypt or argon2id hash. Expires is an optional RFC 3339
+// time or YYYY-MM-DD date.
+type APIKeyConfig struct {
+	Name    string
+	Key     string
+	Expires string
+}
+
+// QuietHoursConfig holds non-critical messages for the matching routes and
+// channels during the time ranges. Held messages are sent as a digest once
+// quiet hours are over.
+type QuietHoursConfig struct {
+	Routes   []string
+	Channels []string
+	Timezone string
+	Ranges   []string
+}
+
+// AnnouncementConfig is a message posted to Channels at the times of
+// Schedule, a cron expression or a phrase like "every friday at 3pm", in
+// Timezone.
+type AnnouncementConfig struct {
+	Schedule string
+	Timezone string
+	Channels []string
+	Message  string
+}
+
+// ExternalConfig is a plugin ran as a separate process. Env has extra
+// NAME=value environment variables. Settings are sent to the plugin when it
+// starts and when the configuration is reloaded.
+type ExternalConfig struct {
+	Command  string
+	Args     []string
+	Env      []string
+	Dir      string
+	Settings map[string]interface{}
+}
+
+// ScriptsConfig maps route handler and command names to Starlark scripts.
+// Relative paths are relative to the main configuration file. Each run of a
+// script is stopped after Timeout or MaxSteps execution steps.
+type ScriptsConfig struct {
+	Timeout  string
+	MaxSteps int
+	Routes   map[string]string
+	Commands map[string]string
+}
+
 func LoadConfig(filename string) (conf *Config, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -73,29 +225,58 @@ func LoadConfig(filename string) (conf *Config, err error) {
 		}
 	}()
 
-	if filename == "" {
-		filename = "config.toml"
+	conf, diags := load(filename)
+	if len(diags) > 0 {
+		return nil, errors.New(diags[0].String())
 	}
+	return conf, nil
+}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	buf, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, err
-	}
-	var con Config
-	if err := toml.Unmarshal(buf, &con); err != nil {
-		return nil, err
-	}
-	return setSensibleDefaults(&con)
+// Filename returns the path the configuration was loaded from.
+func (c *Config) Filename() string {
+	return c.filename
+}
+
+// Files returns the main configuration file and the files it included.
+func (c *Config) Files() []string {
+	return c.files
 }
 
 func setSensibleDefaults(con *Config) (*Config, error) {
 	con.Main.ModulesDir = utils.FirstString(con.Main.ModulesDir, "modules")
 	con.Main.DataDir = utils.FirstString(con.Main.DataDir, "data")
+	con.Queue.MaxAge = utils.FirstString(con.Queue.MaxAge, "24h")
+	con.HTTP.SocketMode = utils.FirstString(con.HTTP.SocketMode, "0660")
+	con.HTTP.AuthLockout = utils.FirstString(con.HTTP.AuthLockout, "5m")
+	if con.HTTP.AuthFailures <= 0 {
+		con.HTTP.AuthFailures = 10
+	}
+	if con.HTTP.Workers <= 0 {
+		con.HTTP.Workers = 4
+	}
+	if con.HTTP.Backlog <= 0 {
+		con.HTTP.Backlog = 100
+	}
+	if con.HTTP.MaxBodyBytes <= 0 {
+		con.HTTP.MaxBodyBytes = 1 << 20
+	}
+	if len(con.Alerts.AckEmoji) == 0 {
+		con.Alerts.AckEmoji = []string{"eyes", "+1"}
+	}
+	if len(con.Alerts.ResolveEmoji) == 0 {
+		con.Alerts.ResolveEmoji = []string{"white_check_mark", "heavy_check_mark"}
+	}
+	if len(con.Alerts.SilenceEmoji) == 0 {
+		con.Alerts.SilenceEmoji = []string{"mute", "no_bell"}
+	}
+	con.Alerts.SilenceDuration = utils.FirstString(con.Alerts.SilenceDuration, "1h")
+	if con.Queue.MaxAttempts <= 0 {
+		con.Queue.MaxAttempts = 20
+	}
+	con.Scripts.Timeout = utils.FirstString(con.Scripts.Timeout, "5s")
+	if con.Scripts.MaxSteps <= 0 {
+		con.Scripts.MaxSteps = 10000000
+	}
 	return con, nil
 }
 
@@ -0,0 +1,478 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Module settings are decoded into structs with these field tags:
+//
+//	URL      string        `setting:"url,required"`
+//	Interval time.Duration `setting:"interval" default:"10s"`
+//	Severity string        `setting:"severity" default:"info" enum:"info,warning,critical"`
+//
+// Setting names are matched ignoring case and underscores and default to
+// the field name. A setting of "-" skips the field. Defaults are written
+// like values in environment variables, lists are comma separated.
+
+// FieldError is a problem with one setting.
+type FieldError struct {
+	Key     string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// DecodeError is the problems found decoding settings.
+type DecodeError []*FieldError
+
+func (e DecodeError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeSettings decodes settings into the struct v points to. key is the
+// path of the settings used in errors. A returned error is a DecodeError
+// listing every problem.
+func DecodeSettings(key string, settings map[string]interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		panic("settings must be decoded into a pointer to a struct")
+	}
+
+	var errs DecodeError
+	decodeStruct(key, settings, rv.Elem(), &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// DecodeModule decodes the [[modules.NAME]] instances into v, a pointer to a
+// slice of structs.
+func (c *Config) DecodeModule(name string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		panic("modules must be decoded into a pointer to a slice")
+	}
+
+	var errs DecodeError
+	decodeValue("modules."+name, c.moduleInstances(name), rv.Elem(), &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) moduleInstances(name string) []interface{} {
+	instances := make([]interface{}, len(c.Modules[name]))
+	for i, instance := range c.Modules[name] {
+		instances[i] = instance
+	}
+	return instances
+}
+
+var moduleTypes = struct {
+	sync.Mutex
+	byName map[string]reflect.Type
+}{byName: make(map[string]reflect.Type)}
+
+// RegisterModuleSettings registers the settings struct of a module so the
+// configuration test reports problems in each of its instances. It panics if
+// a default tag isn't a valid value of its field.
+func RegisterModuleSettings(name string, settings interface{}) {
+	typ := reflect.TypeOf(settings)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		panic("module settings must be a struct")
+	}
+	if err := checkDefaults(typ, make(map[reflect.Type]bool)); err != nil {
+		panic(fmt.Sprintf("settings of module %s: %s", name, err))
+	}
+
+	moduleTypes.Lock()
+	defer moduleTypes.Unlock()
+	if _, exists := moduleTypes.byName[name]; exists {
+		panic(fmt.Sprintf("settings of module %s are already registered", name))
+	}
+	moduleTypes.byName[name] = typ
+}
+
+func init() {
+	RegisterValidator(checkModuleSettings)
+}
+
+func checkModuleSettings(c *Config) []*Diagnostic {
+	moduleTypes.Lock()
+	defer moduleTypes.Unlock()
+
+	var diags []*Diagnostic
+	for name, typ := range moduleTypes.byName {
+		instances := reflect.New(reflect.SliceOf(typ))
+		err := c.DecodeModule(name, instances.Interface())
+		if errs, ok := err.(DecodeError); ok {
+			for _, fe := range errs {
+				diags = append(diags, c.Problem(fe.Key, "%s", fe.Message))
+			}
+		}
+	}
+	return diags
+}
+
+// checkDefaults returns an error for the first default tag in typ or the
+// structs it contains that isn't a valid value of its field.
+func checkDefaults(typ reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[typ] {
+		return nil
+	}
+	seen[typ] = true
+
+	for _, f := range settingFields(typ) {
+		field := typ.Field(f.index)
+		if f.hasDef {
+			var errs DecodeError
+			rv := reflect.New(field.Type).Elem()
+			if err := parseString(f.def, rv); err != nil {
+				return fmt.Errorf("invalid default for %s: %s", field.Name, err)
+			}
+			if checkEnum(field.Name, f, rv, &errs); len(errs) > 0 {
+				return fmt.Errorf("invalid default for %s", errs[0])
+			}
+		}
+
+		elem := field.Type
+		for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Slice || elem.Kind() == reflect.Map {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Struct {
+			if err := checkDefaults(elem, seen); err != nil {
+				return fmt.Errorf("%s: %s", field.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// settingField is a struct field and its tags.
+type settingField struct {
+	index    int
+	name     string
+	required bool
+	def      string
+	hasDef   bool
+	enum     []string
+}
+
+func settingFields(typ reflect.Type) []*settingField {
+	var fields []*settingField
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" { // Unexported
+			continue
+		}
+
+		sf := &settingField{index: i, name: f.Name}
+		if tag, ok := f.Tag.Lookup("setting"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				sf.name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				sf.required = sf.required || opt == "required"
+			}
+		}
+		sf.def, sf.hasDef = f.Tag.Lookup("default")
+		if enum, ok := f.Tag.Lookup("enum"); ok {
+			sf.enum = strings.Split(enum, ",")
+		}
+		fields = append(fields, sf)
+	}
+	return fields
+}
+
+func decodeStruct(key string, settings map[string]interface{}, rv reflect.Value, errs *DecodeError) {
+	fields := settingFields(rv.Type())
+	byKey := make(map[string]*settingField, len(fields))
+	for _, f := range fields {
+		byKey[normKey(f.name)] = f
+	}
+
+	// Sorted so errors are reported in a stable order
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	set := make(map[*settingField]bool, len(settings))
+	for _, name := range names {
+		path := joinKey(key, name)
+		f, exists := byKey[normKey(name)]
+		if !exists {
+			*errs = append(*errs, &FieldError{path, "unknown setting"})
+			continue
+		}
+		set[f] = true
+		if decodeValue(path, settings[name], rv.Field(f.index), errs) {
+			checkEnum(path, f, rv.Field(f.index), errs)
+		}
+	}
+
+	for _, f := range fields {
+		if set[f] {
+			continue
+		}
+		path := joinKey(key, f.name)
+		if f.required {
+			*errs = append(*errs, &FieldError{path, "required"})
+		} else {
+			setDefault(path, f, rv.Field(f.index), errs)
+		}
+	}
+}
+
+// setDefault sets a field that isn't in the settings to its default. A
+// struct without a default gets the defaults of its fields.
+func setDefault(key string, f *settingField, rv reflect.Value, errs *DecodeError) {
+	if f.hasDef {
+		if err := parseString(f.def, rv); err != nil {
+			*errs = append(*errs, &FieldError{key, fmt.Sprintf("invalid default %q: %s", f.def, err)})
+		}
+		return
+	}
+	if rv.Kind() == reflect.Struct {
+		for _, nested := range settingFields(rv.Type()) {
+			setDefault(joinKey(key, nested.name), nested, rv.Field(nested.index), errs)
+		}
+	}
+}
+
+func checkEnum(key string, f *settingField, rv reflect.Value, errs *DecodeError) {
+	if len(f.enum) == 0 {
+		return
+	}
+
+	values := []reflect.Value{rv}
+	if rv.Kind() == reflect.Slice {
+		values = values[:0]
+		for i := 0; i < rv.Len(); i++ {
+			values = append(values, rv.Index(i))
+		}
+	}
+
+	for _, v := range values {
+		s := fmt.Sprint(v.Interface())
+		valid := false
+		for _, allowed := range f.enum {
+			valid = valid || s == allowed
+		}
+		if !valid {
+			*errs = append(*errs, &FieldError{key, fmt.Sprintf("%q isn't one of %s", s, strings.Join(f.enum, ", "))})
+			return
+		}
+	}
+}
+
+// decodeValue sets rv to a setting. It returns false and adds to errs if the
+// setting has the wrong type.
+func decodeValue(key string, value interface{}, rv reflect.Value, errs *DecodeError) bool {
+	fail := func(format string, a ...interface{}) bool {
+		*errs = append(*errs, &FieldError{key, fmt.Sprintf(format, a...)})
+		return false
+	}
+
+	// Settings overridden by environment variables are strings
+	if s, ok := value.(string); ok && rv.Kind() != reflect.String && rv.Kind() != reflect.Interface {
+		if err := parseString(s, rv); err != nil {
+			return fail("%s", err)
+		}
+		return true
+	}
+
+	if rv.Type() == durationType {
+		return fail("must be a duration like \"10s\"")
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		rv.Set(reflect.ValueOf(value))
+
+	case reflect.Ptr:
+		elem := reflect.New(rv.Type().Elem())
+		if !decodeValue(key, value, elem.Elem(), errs) {
+			return false
+		}
+		rv.Set(elem)
+
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		rv.SetString(s)
+
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fail("must be true or false")
+		}
+		rv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(int64)
+		if !ok {
+			return fail("must be an integer")
+		}
+		if rv.OverflowInt(n) {
+			return fail("%d is out of range", n)
+		}
+		rv.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(int64)
+		if !ok || n < 0 {
+			return fail("must be a positive integer")
+		}
+		if rv.OverflowUint(uint64(n)) {
+			return fail("%d is out of range", n)
+		}
+		rv.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		switch n := value.(type) {
+		case float64:
+			rv.SetFloat(n)
+		case int64:
+			rv.SetFloat(float64(n))
+		default:
+			return fail("must be a number")
+		}
+
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return fail("must be a list")
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(list), len(list))
+		valid := true
+		for i, item := range list {
+			valid = decodeValue(fmt.Sprintf("%s[%d]", key, i), item, slice.Index(i), errs) && valid
+		}
+		rv.Set(slice)
+		return valid
+
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok || rv.Type().Key().Kind() != reflect.String {
+			return fail("must be a table")
+		}
+		result := reflect.MakeMapWithSize(rv.Type(), len(m))
+		valid := true
+		for k, item := range m {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if decodeValue(joinKey(key, k), item, elem, errs) {
+				result.SetMapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()), elem)
+			} else {
+				valid = false
+			}
+		}
+		rv.Set(result)
+		return valid
+
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fail("must be a table")
+		}
+		before := len(*errs)
+		decodeStruct(key, m, rv, errs)
+		return len(*errs) == before
+
+	default:
+		return fail("unsupported setting type %s", rv.Type())
+	}
+	return true
+}
+
+// parseString sets rv from its string form as used in defaults and
+// environment variables.
+func parseString(s string, rv reflect.Value) error {
+	if rv.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("must be a duration like \"10s\"")
+		}
+		rv.SetInt(int64(d))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Interface:
+		rv.Set(reflect.ValueOf(s))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, rv.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, rv.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive integer")
+		}
+		rv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, rv.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		rv.SetFloat(n)
+	case reflect.Ptr:
+		elem := reflect.New(rv.Type().Elem())
+		if err := parseString(s, elem.Elem()); err != nil {
+			return err
+		}
+		rv.Set(elem)
+	case reflect.Slice:
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := parseString(strings.TrimSpace(part), slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	default:
+		return fmt.Errorf("can't be set from a string")
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	Host string `setting:"host,required"`
+	Port int    `default:"443"`
+}
+
+type testSettings struct {
+	URL      string            `setting:"url,required"`
+	Interval time.Duration     `setting:"interval" default:"10s"`
+	Severity string            `setting:"severity" default:"info" enum:"info,warning,critical"`
+	Levels   []string          `setting:"levels" enum:"info,warning,critical"`
+	Enabled  bool              `setting:"enabled" default:"true"`
+	Retries  uint8             `setting:"retries"`
+	Ratio    float64           `setting:"ratio"`
+	Limit    *int              `setting:"limit"`
+	Tags     []string          `setting:"tags"`
+	Labels   map[string]string `setting:"labels"`
+	Server   testServer        `setting:"server"`
+	Backups  []*testServer     `setting:"backups"`
+	Ignored  string            `setting:"-"`
+}
+
+func TestDecodeSettings(t *testing.T) {
+	limit := 5
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		want     testSettings
+		errs     []string
+	}{
+		{
+			name:     "defaults",
+			settings: map[string]interface{}{"url": "http://example.com"},
+			want: testSettings{
+				URL:      "http://example.com",
+				Interval: 10 * time.Second,
+				Severity: "info",
+				Enabled:  true,
+				Server:   testServer{Port: 443},
+			},
+		},
+		{
+			name: "values",
+			settings: map[string]interface{}{
+				"URL":      "http://example.com",
+				"interval": "1m",
+				"Severity": "critical",
+				"levels":   []interface{}{"info", "warning"},
+				"enabled":  false,
+				"retries":  int64(3),
+				"ratio":    int64(2),
+				"limit":    int64(5),
+				"tags":     []interface{}{"a", "b"},
+				"labels":   map[string]interface{}{"site": "hq"},
+				"server":   map[string]interface{}{"host": "mm.example.com", "port": int64(8065)},
+				"backups":  []interface{}{map[string]interface{}{"host": "backup"}},
+			},
+			want: testSettings{
+				URL:      "http://example.com",
+				Interval: time.Minute,
+				Severity: "critical",
+				Levels:   []string{"info", "warning"},
+				Retries:  3,
+				Ratio:    2,
+				Limit:    &limit,
+				Tags:     []string{"a", "b"},
+				Labels:   map[string]string{"site": "hq"},
+				Server:   testServer{Host: "mm.example.com", Port: 8065},
+				Backups:  []*testServer{{Host: "backup", Port: 443}},
+			},
+		},
+		{
+			name: "unknown settings",
+			settings: map[string]interface{}{
+				"url":     "http://example.com",
+				"ignored": "x",
+				"server":  map[string]interface{}{"host": "mm.example.com", "tls": true},
+			},
+			errs: []string{
+				"test.ignored: unknown setting",
+				"test.server.tls: unknown setting",
+			},
+		},
+		{
+			name: "environment variable strings",
+			settings: map[string]interface{}{
+				"url":     "http://example.com",
+				"enabled": "false",
+				"retries": "7",
+				"ratio":   "0.5",
+				"limit":   "5",
+				"tags":    "a, b",
+				"levels":  "warning",
+			},
+			want: testSettings{
+				URL:      "http://example.com",
+				Interval: 10 * time.Second,
+				Severity: "info",
+				Levels:   []string{"warning"},
+				Retries:  7,
+				Ratio:    0.5,
+				Limit:    &limit,
+				Tags:     []string{"a", "b"},
+				Server:   testServer{Port: 443},
+			},
+		},
+		{
+			name: "problems",
+			settings: map[string]interface{}{
+				"interval": int64(10),
+				"severity": "debug",
+				"levels":   []interface{}{"info", "loud"},
+				"enabled":  "maybe",
+				"retries":  int64(300),
+				"tags":     []interface{}{"a", int64(1)},
+				"server":   map[string]interface{}{"port": "https"},
+				"backups":  []interface{}{"backup"},
+			},
+			errs: []string{
+				`test.backups[0]: can't be set from a string`,
+				`test.enabled: must be true or false`,
+				`test.interval: must be a duration like "10s"`,
+				`test.levels: "loud" isn't one of info, warning, critical`,
+				`test.retries: 300 is out of range`,
+				`test.server.port: must be an integer`,
+				`test.server.host: required`,
+				`test.severity: "debug" isn't one of info, warning, critical`,
+				`test.tags[1]: must be a string`,
+				`test.url: required`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var got testSettings
+		err := DecodeSettings("test", test.settings, &got)
+
+		var errs []string
+		if decodeErr, ok := err.(DecodeError); ok {
+			for _, fe := range decodeErr {
+				errs = append(errs, fe.Error())
+			}
+		} else if err != nil {
+			t.Errorf("%s: got %T %s, expected a DecodeError", test.name, err, err)
+			continue
+		}
+		if strings.Join(errs, "\n") != strings.Join(test.errs, "\n") {
+			t.Errorf("%s: got errors\n%s\nexpected\n%s", test.name, strings.Join(errs, "\n"), strings.Join(test.errs, "\n"))
+		}
+		if len(test.errs) == 0 && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeModule(t *testing.T) {
+	c := &Config{Modules: map[string][]map[string]interface{}{
+		"test": {
+			{"host": "one"},
+			{"port": int64(80)},
+		},
+	}}
+
+	var got []testServer
+	err := c.DecodeModule("test", &got)
+	want := []testServer{{Host: "one", Port: 443}, {Port: 80}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, expected %+v", got, want)
+	}
+	if err == nil || err.Error() != "modules.test[1].host: required" {
+		t.Errorf("got error %v, expected modules.test[1].host: required", err)
+	}
+}
+
+type testBadDefault struct {
+	Interval time.Duration `default:"ten seconds"`
+}
+
+type testBadEnumDefault struct {
+	Severity string `default:"debug" enum:"info,warning"`
+}
+
+type testNestedBadDefault struct {
+	Servers []struct {
+		Port int `default:"https"`
+	}
+}
+
+type testRecursive struct {
+	Name     string `default:"root"`
+	Children []*testRecursive
+}
+
+func TestCheckDefaults(t *testing.T) {
+	tests := []struct {
+		settings interface{}
+		err      string
+	}{
+		{settings: testSettings{}},
+		{settings: testRecursive{}},
+		{settings: testBadDefault{}, err: `invalid default for Interval: must be a duration like "10s"`},
+		{settings: testBadEnumDefault{}, err: `invalid default for Severity: "debug" isn't one of info, warning`},
+		{settings: testNestedBadDefault{}, err: `Servers: invalid default for Port: must be an integer`},
+	}
+
+	for _, test := range tests {
+		typ := reflect.TypeOf(test.settings)
+		err := checkDefaults(typ, make(map[reflect.Type]bool))
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %s", typ, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got error %v, expected %s", typ, err, test.err)
+		}
+	}
+}
+
+func TestRegisterModuleSettingsBadDefault(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterModuleSettings didn't panic")
+		}
+	}()
+	RegisterModuleSettings("test-bad-default", testBadDefault{})
+}
+
+func TestDecodeBadDefault(t *testing.T) {
+	var got testBadDefault
+	err := DecodeSettings("test", nil, &got)
+	want := `test.Interval: invalid default "ten seconds": must be a duration like "10s"`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, expected %s", err, want)
+	}
+}
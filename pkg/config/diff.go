@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a setting that differs between two configurations. Old and New
+// are empty when the setting is unset or zero.
+type Change struct {
+	Key    string
+	Old    string
+	New    string
+	Secret bool
+}
+
+func (c *Change) String() string {
+	if c.Secret {
+		return c.Key + " changed"
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Key, valueOrUnset(c.Old), valueOrUnset(c.New))
+}
+
+func valueOrUnset(s string) string {
+	if s == "" {
+		return "(unset)"
+	}
+	return s
+}
+
+// Diff returns the settings that differ between two configurations sorted
+// by key. Keys are dotted paths like "Routes.git.Channels". Values of
+// secret settings are not included.
+func Diff(old, new *Config) []*Change {
+	before := make(map[string]string)
+	after := make(map[string]string)
+	flatten("", reflect.ValueOf(old).Elem(), before)
+	flatten("", reflect.ValueOf(new).Elem(), after)
+
+	var changes []*Change
+	for key, value := range before {
+		if after[key] != value {
+			changes = append(changes, &Change{Key: key, Old: value, New: after[key]})
+		}
+	}
+	for key, value := range after {
+		if _, exists := before[key]; !exists {
+			changes = append(changes, &Change{Key: key, New: value})
+		}
+	}
+
+	for _, c := range changes {
+		c.Secret = old.IsSecret(c.Key) || new.IsSecret(c.Key)
+		if c.Secret {
+			c.Old, c.New = "", ""
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// flatten adds the values under v to out keyed by their path. Empty values
+// are skipped so unset and zero settings compare equal.
+func flatten(key string, v reflect.Value, out map[string]string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			flatten(key, v.Elem(), out)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" { // Unexported
+				continue
+			}
+			flatten(joinKey(key, t.Field(i).Name), v.Field(i), out)
+		}
+
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			flatten(joinKey(key, fmt.Sprint(k.Interface())), v.MapIndex(k), out)
+		}
+
+	case reflect.Slice, reflect.Array:
+		if v.Len() == 0 {
+			return
+		}
+		if !isComposite(v.Index(0)) {
+			out[key] = fmt.Sprint(v.Interface())
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			flatten(fmt.Sprintf("%s[%d]", key, i), v.Index(i), out)
+		}
+
+	default:
+		if !v.IsZero() {
+			out[key] = fmt.Sprint(v.Interface())
+		}
+	}
+}
+
+// isComposite returns if v holds a struct or map.
+func isComposite(v reflect.Value) bool {
+	for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Struct || v.Kind() == reflect.Map
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func isSecret(key string) bool {
+	if i := strings.LastIndexAny(key, ".]"); i >= 0 {
+		key = key[i+1:]
+	}
+	key = strings.ToLower(key)
+	if key == "key" || key == "authkey" {
+		return true
+	}
+	for _, s := range []string{"password", "secret", "token"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
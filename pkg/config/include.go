@@ -0,0 +1,229 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+)
+
+// position is where a setting is in the configuration files.
+type position struct {
+	file string
+	line int
+}
+
+// fileError is an error at a line of a configuration file.
+type fileError struct {
+	position
+	err error
+}
+
+func (e *fileError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.err)
+	}
+	return fmt.Sprintf("%s: %s", e.file, e.err)
+}
+
+// source is a configuration merged from the main file and its includes.
+type source struct {
+	table   *ast.Table
+	names   []string               // Files in the order they were merged
+	files   map[interface{}]string // File of each setting and table
+	secrets map[string]bool        // Settings read from secret files
+}
+
+// parseFile reads a configuration file and the files it includes, then
+// applies the environment overlay and interpolation.
+func parseFile(filename string) (*source, error) {
+	src := &source{
+		files:   make(map[interface{}]string),
+		secrets: make(map[string]bool),
+	}
+
+	table, err := src.read(filename)
+	if err != nil {
+		return nil, err
+	}
+	src.table = table
+
+	includes, err := includeFiles(filename, table)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range includes {
+		t, err := src.read(file)
+		if err != nil {
+			return nil, err
+		}
+		if kv, exists := t.Fields["include"].(*ast.KeyValue); exists {
+			return nil, &fileError{position{file, kv.Line}, errors.New("included files can't include other files")}
+		}
+		if err := src.merge("", table, t); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnvOverlay(table, os.Environ()); err != nil {
+		return nil, &fileError{position{filename, 0}, err}
+	}
+	if err := interpolateTable(src, "", table); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// read parses a file and checks the types of its settings. Unknown settings
+// are checked once all files are merged.
+func (s *source) read(filename string) (*ast.Table, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := toml.Parse(buf)
+	if err != nil {
+		return nil, wrapLineError(filename, err)
+	}
+
+	decoder := toml.DefaultConfig
+	decoder.MissingField = func(reflect.Type, string) error { return nil }
+	if err := decoder.UnmarshalTable(table, &Config{}); err != nil {
+		return nil, wrapLineError(filename, err)
+	}
+
+	s.names = append(s.names, filename)
+	s.mark(filename, table)
+	return table, nil
+}
+
+// mark records the file of every setting and table in t.
+func (s *source) mark(filename string, t *ast.Table) {
+	s.files[t] = filename
+	for _, value := range t.Fields {
+		switch v := value.(type) {
+		case *ast.KeyValue:
+			s.files[v] = filename
+		case *ast.Table:
+			s.mark(filename, v)
+		case []*ast.Table:
+			for _, sub := range v {
+				s.mark(filename, sub)
+			}
+		}
+	}
+}
+
+// position returns the file and line of a setting or table.
+func (s *source) position(node interface{}) position {
+	switch v := node.(type) {
+	case *ast.KeyValue:
+		return position{s.files[v], v.Line}
+	case *ast.Table:
+		return position{s.files[v], v.Line}
+	case []*ast.Table:
+		return position{s.files[v[0]], v[0].Line}
+	}
+	return position{s.names[0], 0}
+}
+
+// merge adds the settings of an included file to a table. Tables are merged
+// and array tables like [[modules.NAME]] are appended. A setting can only be
+// set in one file.
+func (s *source) merge(prefix string, dst, src *ast.Table) error {
+	for key, value := range src.Fields {
+		path := joinKey(prefix, key)
+
+		existingKey := tableKey(dst, normKey(key), normKey)
+		existing, found := dst.Fields[existingKey]
+		if !found {
+			dst.Fields[key] = value
+			continue
+		}
+
+		switch e := existing.(type) {
+		case *ast.Table:
+			if v, ok := value.(*ast.Table); ok {
+				if err := s.merge(path, e, v); err != nil {
+					return err
+				}
+				continue
+			}
+		case []*ast.Table:
+			if v, ok := value.([]*ast.Table); ok {
+				dst.Fields[existingKey] = append(e, v...)
+				continue
+			}
+		}
+
+		first := s.position(existing)
+		return &fileError{s.position(value), fmt.Errorf("%s is already set in %s:%d", path, first.file, first.line)}
+	}
+	return nil
+}
+
+// includeFiles returns the files matching the include patterns of the main
+// file, sorted by name within each pattern. Relative patterns are relative
+// to the main file's directory.
+func includeFiles(filename string, table *ast.Table) ([]string, error) {
+	kv, exists := table.Fields["include"].(*ast.KeyValue)
+	if !exists {
+		return nil, nil
+	}
+	patterns, ok := kv.Value.(*ast.Array)
+	if !ok {
+		return nil, &fileError{position{filename, kv.Line}, errors.New("include must be an array of file patterns")}
+	}
+
+	seen := map[string]bool{filepath.Clean(filename): true}
+	var files []string
+	for _, value := range patterns.Value {
+		s, ok := value.(*ast.String)
+		if !ok {
+			return nil, &fileError{position{filename, kv.Line}, errors.New("include must be an array of file patterns")}
+		}
+
+		pattern, _, err := interpolate(s.Value)
+		if err != nil {
+			return nil, &fileError{position{filename, kv.Line}, err}
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, &fileError{position{filename, kv.Line}, fmt.Errorf("include %s: %s", s.Value, err)}
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, &fileError{position{filename, kv.Line}, fmt.Errorf("include %s: file not found", s.Value)}
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			if !seen[filepath.Clean(match)] {
+				seen[filepath.Clean(match)] = true
+				files = append(files, match)
+			}
+		}
+	}
+	return files, nil
+}
+
+func wrapLineError(filename string, err error) error {
+	if lerr, ok := err.(*toml.LineError); ok {
+		if lerr.StructField != "" {
+			return &fileError{position{filename, lerr.Line}, fmt.Errorf("%s: %s", lerr.StructField, lerr.Err)}
+		}
+		return &fileError{position{filename, lerr.Line}, lerr.Err}
+	}
+	return &fileError{position{filename, 0}, err}
+}
@@ -0,0 +1,319 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+)
+
+// EnvPrefix starts the names of environment variables that override settings
+// in the configuration file.
+const EnvPrefix = "YOBOT_"
+
+// interpolateTable expands environment variables and secret file references
+// in all string values of a table.
+func interpolateTable(src *source, prefix string, t *ast.Table) error {
+	for key, value := range t.Fields {
+		path := joinKey(prefix, key)
+
+		switch v := value.(type) {
+		case *ast.KeyValue:
+			secret, err := interpolateValue(v.Value)
+			if err != nil {
+				return &fileError{src.position(v), fmt.Errorf("%s: %s", path, err)}
+			}
+			if secret {
+				src.secrets[normKey(path)] = true
+			}
+		case *ast.Table:
+			if err := interpolateTable(src, path, v); err != nil {
+				return err
+			}
+		case []*ast.Table:
+			for i, sub := range v {
+				if err := interpolateTable(src, fmt.Sprintf("%s[%d]", path, i), sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func interpolateValue(value ast.Value) (secret bool, err error) {
+	switch v := value.(type) {
+	case *ast.String:
+		v.Value, secret, err = interpolate(v.Value)
+	case *ast.Array:
+		for _, elem := range v.Value {
+			s, err := interpolateValue(elem)
+			if err != nil {
+				return false, err
+			}
+			secret = secret || s
+		}
+	}
+	return
+}
+
+// envName matches the names of environment variables.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolate expands ${NAME} and ${NAME:-default} with environment
+// variables and ${file:PATH} with the contents of a secret file. A value
+// reading a file is secret. $${ is a literal ${, as is a ${ not followed by
+// one of these forms.
+func interpolate(s string) (value string, secret bool, err error) {
+	if !strings.Contains(s, "${") {
+		return s, false, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), secret, nil
+		}
+
+		if i > 0 && s[i-1] == '$' { // Escaped
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+
+		end := closingBrace(s[i+2:])
+		if end < 0 {
+			b.WriteString(s)
+			return b.String(), secret, nil
+		}
+
+		b.WriteString(s[:i])
+		ref := s[i+2 : i+2+end]
+		value, isFile, ok, err := expandRef(ref)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString("${" + ref + "}")
+		}
+		secret = secret || isFile
+		s = s[i+2+end+1:]
+	}
+}
+
+// closingBrace returns the index of the } closing a reference in s, skipping
+// references nested in it, or -1.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '{' && i > 0 && s[i-1] == '$':
+			depth++
+		case s[i] == '}' && depth == 0:
+			return i
+		case s[i] == '}':
+			depth--
+		}
+	}
+	return -1
+}
+
+// expandRef returns the value of the reference inside ${}. ok is false if
+// it isn't a reference. An unset variable without a default is an error.
+func expandRef(ref string) (value string, isFile, ok bool, err error) {
+	if strings.HasPrefix(ref, "file:") {
+		path, _, err := interpolate(ref[5:])
+		if err != nil {
+			return "", false, false, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, false, err
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, true, nil
+	}
+
+	name, def, hasDefault := ref, "", false
+	if j := strings.Index(ref, ":-"); j >= 0 {
+		name, def, hasDefault = ref[:j], ref[j+2:], true
+	}
+	if !envName.MatchString(name) {
+		return "", false, false, nil
+	}
+
+	value, set := os.LookupEnv(name)
+	switch {
+	case set && (value != "" || !hasDefault):
+		return value, false, true, nil
+	case hasDefault:
+		return def, false, true, nil
+	default:
+		return "", false, false, fmt.Errorf("environment variable %s isn't set", name)
+	}
+}
+
+// applyEnvOverlay sets settings from environment variables like
+// YOBOT_MATTERMOST_LOGIN_PASSWORD. Underscores separate the keys of the
+// path, and underscores and dashes within keys.
+func applyEnvOverlay(table *ast.Table, environ []string) error {
+	for _, env := range environ {
+		if !strings.HasPrefix(env, EnvPrefix) {
+			continue
+		}
+		split := strings.SplitN(env, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(split[0], EnvPrefix)), "_")
+		if !overlay(table, reflect.TypeOf(Config{}), path, split[1]) {
+			return fmt.Errorf("environment variable %s doesn't match a setting", split[0])
+		}
+	}
+	return nil
+}
+
+// overlay sets the setting at path in a table of type typ. It returns false
+// if path doesn't match a setting.
+func overlay(t *ast.Table, typ reflect.Type, path []string, value string) bool {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		for n := 1; n <= len(path); n++ {
+			name := strings.Join(path[:n], "")
+			for i := 0; i < typ.NumField(); i++ {
+				f := typ.Field(i)
+				if f.PkgPath != "" || normKey(f.Name) != name {
+					continue
+				}
+				key := tableKey(t, name, normKey)
+				if overlayField(t, key, f.Type, path[n:], value) {
+					return true
+				}
+			}
+		}
+
+	case reflect.Map, reflect.Interface:
+		elem := typ
+		if typ.Kind() == reflect.Map {
+			elem = typ.Elem()
+		}
+
+		// Keys in the file are tried first. New keys can only be added to
+		// tables of any type like route settings, not to routes or teams.
+		for n := len(path); n > 0; n-- {
+			key := tableKey(t, strings.Join(path[:n], "_"), envKey)
+			if _, exists := t.Fields[key]; exists && overlayField(t, key, elem, path[n:], value) {
+				return true
+			}
+		}
+		if elem.Kind() == reflect.Interface {
+			return overlayField(t, strings.Join(path, "_"), elem, nil, value)
+		}
+	}
+	return false
+}
+
+// overlayField sets the setting at path in the field key of a table.
+func overlayField(t *ast.Table, key string, typ reflect.Type, path []string, value string) bool {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if len(path) == 0 {
+		if typ.Kind() == reflect.Struct || typ.Kind() == reflect.Map {
+			return false
+		}
+		existing, isValue := t.Fields[key].(*ast.KeyValue)
+		if t.Fields[key] == nil {
+			existing = &ast.KeyValue{Key: key}
+		} else if !isValue {
+			return false
+		}
+
+		v, err := overlayValue(typ, existing.Value, value)
+		if err != nil {
+			return false
+		}
+		existing.Value = v
+		t.Fields[key] = existing
+		return true
+	}
+
+	switch field := t.Fields[key].(type) {
+	case nil:
+		sub := &ast.Table{Name: key, Fields: make(map[string]interface{})}
+		if !overlay(sub, typ, path, value) {
+			return false
+		}
+		t.Fields[key] = sub
+		return true
+	case *ast.Table:
+		return overlay(field, typ, path, value)
+	case []*ast.Table: // Modules and escalation steps are picked by index
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(field) {
+			return false
+		}
+		if typ.Kind() == reflect.Slice {
+			typ = typ.Elem()
+		}
+		return overlay(field[i], typ, path[1:], value)
+	}
+	return false
+}
+
+// overlayValue converts an environment variable to a value for a setting
+// of type typ. String settings take the value as is. Other settings take a
+// TOML value like true, 10, or ["a", "b"]. Settings of any type are strings
+// unless the file has a value of another type.
+func overlayValue(typ reflect.Type, existing ast.Value, value string) (ast.Value, error) {
+	if typ.Kind() == reflect.String {
+		return &ast.String{Value: value}, nil
+	}
+	if typ.Kind() == reflect.Interface {
+		if _, isString := existing.(*ast.String); isString || existing == nil {
+			return &ast.String{Value: value}, nil
+		}
+	}
+
+	t, err := toml.Parse([]byte("v = " + value))
+	if err != nil {
+		return nil, err
+	}
+	kv, ok := t.Fields["v"].(*ast.KeyValue)
+	if !ok {
+		return nil, errors.New("not a value")
+	}
+	return kv.Value, nil
+}
+
+// tableKey returns the key in a table matching name after normalizing with
+// norm. name is returned if there isn't one.
+func tableKey(t *ast.Table, name string, norm func(string) string) string {
+	for key := range t.Fields {
+		if norm(key) == name {
+			return key
+		}
+	}
+	return name
+}
+
+// envKey normalizes a key as it's written in an environment variable name.
+func envKey(key string) string {
+	return strings.Replace(strings.ToLower(key), "-", "_", -1)
+}
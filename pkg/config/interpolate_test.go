@@ -0,0 +1,59 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yobot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("YOBOT_TEST_DIR", dir)
+	os.Setenv("YOBOT_TEST_USER", "yobot")
+	os.Setenv("YOBOT_TEST_EMPTY", "")
+	defer os.Unsetenv("YOBOT_TEST_DIR")
+	defer os.Unsetenv("YOBOT_TEST_USER")
+	defer os.Unsetenv("YOBOT_TEST_EMPTY")
+
+	tests := []struct {
+		s      string
+		want   string
+		secret bool
+		err    bool
+	}{
+		{s: "plain", want: "plain"},
+		{s: "${YOBOT_TEST_USER}@example.com", want: "yobot@example.com"},
+		{s: "${YOBOT_TEST_EMPTY:-default}", want: "default"},
+		{s: "${YOBOT_TEST_UNSET:-}", want: ""},
+		{s: "${YOBOT_TEST_UNSET}", err: true},
+		{s: "$${YOBOT_TEST_USER}", want: "${YOBOT_TEST_USER}"},
+		{s: "Hello ${user.name}, ${ not closed", want: "Hello ${user.name}, ${ not closed"},
+		{s: "file:/run/secrets/password", want: "file:/run/secrets/password"},
+		{s: "${file:" + dir + "/password}", want: "hunter2", secret: true},
+		{s: "Bearer ${file:${YOBOT_TEST_DIR}/password}", want: "Bearer hunter2", secret: true},
+		{s: "${file:" + dir + "/missing}", err: true},
+	}
+
+	for _, test := range tests {
+		got, secret, err := interpolate(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("interpolate(%q) = %q, expected an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("interpolate(%q): %s", test.s, err)
+		} else if got != test.want || secret != test.secret {
+			t.Errorf("interpolate(%q) = %q, %t, expected %q, %t", test.s, got, secret, test.want, test.secret)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Redacted replaces the values of secret settings when printed.
+const Redacted = "********"
+
+// IsSecret returns if a setting holds a secret. Passwords, keys, secrets,
+// tokens, and settings read from secret files are secret. Key is a dotted
+// path like "Mattermost.Login.Password".
+func (c *Config) IsSecret(key string) bool {
+	return isSecret(key) || c.secrets[normKey(key)]
+}
+
+// String returns the settings of the configuration, one per line, with the
+// values of secrets redacted. It's safe to print or log.
+func (c *Config) String() string {
+	settings := make(map[string]string)
+	flatten("", reflect.ValueOf(c).Elem(), settings)
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		value := settings[key]
+		if c.IsSecret(key) {
+			value = Redacted
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, value)
+	}
+	return b.String()
+}
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/lfkeitel/yobot/pkg/utils"
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+)
+
+// Diagnostic is a problem found in a configuration file. Line is 0 when the
+// problem isn't about a single setting.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Key     string
+	Message string
+	Warning bool
+}
+
+func (d *Diagnostic) String() string {
+	var b strings.Builder
+	b.WriteString(d.File)
+	if d.Line > 0 {
+		fmt.Fprintf(&b, ":%d", d.Line)
+	}
+	b.WriteString(": ")
+	if d.Warning {
+		b.WriteString("warning: ")
+	}
+	if d.Key != "" {
+		b.WriteString(d.Key + ": ")
+	}
+	b.WriteString(d.Message)
+	return b.String()
+}
+
+// A Validator checks part of a configuration. Problems should be made with
+// Config.Problem so they point to the line of the setting.
+type Validator func(conf *Config) []*Diagnostic
+
+var validators []Validator
+
+// RegisterValidator adds a check run when the configuration is validated.
+func RegisterValidator(v Validator) {
+	validators = append(validators, v)
+}
+
+// Validate loads a configuration file and checks it for problems. Unlike
+// LoadConfig, all unknown settings are reported instead of only the first.
+// The returned configuration is nil if the files couldn't be parsed.
+func Validate(filename string) (*Config, []*Diagnostic) {
+	conf, diags := load(filename)
+	if conf == nil {
+		return nil, diags
+	}
+
+	diags = append(diags, checkChannels(conf)...)
+	diags = append(diags, checkModules(conf)...)
+	for _, v := range validators {
+		diags = append(diags, v(conf)...)
+	}
+
+	sortDiagnostics(conf.files, diags)
+	return conf, diags
+}
+
+// load reads and decodes a configuration. The diagnostics are errors reading
+// the files and unknown settings.
+func load(filename string) (*Config, []*Diagnostic) {
+	if filename == "" {
+		filename = "config.toml"
+	}
+
+	src, err := parseFile(filename)
+	if err != nil {
+		return nil, []*Diagnostic{errorDiagnostic(filename, err)}
+	}
+
+	var diags []*Diagnostic
+	lines := make(map[string]position)
+	checkKeys(src, "", src.table, reflect.TypeOf(Config{}), lines, &diags)
+
+	// Unknown settings were reported above, decode the rest
+	decoder := toml.DefaultConfig
+	decoder.MissingField = func(reflect.Type, string) error { return nil }
+
+	var con Config
+	if err := decoder.UnmarshalTable(src.table, &con); err != nil {
+		return nil, append(diags, errorDiagnostic(filename, err))
+	}
+	con.filename = filename
+	con.files = src.names
+	con.lines = lines
+	con.secrets = src.secrets
+	conf, _ := setSensibleDefaults(&con)
+
+	sortDiagnostics(conf.files, diags)
+	return conf, diags
+}
+
+// sortDiagnostics sorts diagnostics by the order files were read in, then
+// by line.
+func sortDiagnostics(files []string, diags []*Diagnostic) {
+	order := make(map[string]int, len(files))
+	for i, file := range files {
+		order[file] = i
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return order[diags[i].File] < order[diags[j].File]
+		}
+		return diags[i].Line < diags[j].Line
+	})
+}
+
+// Problem returns a diagnostic about a setting. Key is the dotted path of
+// the setting like "routes.git.settings.secret". The line of the closest
+// setting in the path that's in the file is used.
+func (c *Config) Problem(key, format string, a ...interface{}) *Diagnostic {
+	pos := c.position(key)
+	return &Diagnostic{
+		File:    utils.FirstString(pos.file, c.filename),
+		Line:    pos.line,
+		Key:     key,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// Warning is like Problem but the diagnostic doesn't fail validation.
+func (c *Config) Warning(key, format string, a ...interface{}) *Diagnostic {
+	d := c.Problem(key, format, a...)
+	d.Warning = true
+	return d
+}
+
+func (c *Config) position(key string) position {
+	key = normKey(key)
+	for key != "" {
+		if pos, ok := c.lines[key]; ok {
+			return pos
+		}
+		if i := strings.LastIndexAny(key, ".["); i >= 0 {
+			key = key[:i]
+		} else {
+			key = ""
+		}
+	}
+	return position{}
+}
+
+func errorDiagnostic(filename string, err error) *Diagnostic {
+	switch e := err.(type) {
+	case *fileError:
+		return &Diagnostic{File: e.file, Line: e.line, Message: e.err.Error()}
+	case *toml.LineError:
+		return &Diagnostic{File: filename, Line: e.Line, Message: e.Err.Error()}
+	}
+	return &Diagnostic{File: filename, Message: err.Error()}
+}
+
+// normKey normalizes a key the same way the TOML decoder matches keys to
+// struct fields.
+func normKey(key string) string {
+	return strings.Replace(strings.ToLower(key), "_", "", -1)
+}
+
+// checkKeys records the position of every setting in a table and reports
+// settings that don't match a field of typ.
+func checkKeys(src *source, prefix string, t *ast.Table, typ reflect.Type, lines map[string]position, diags *[]*Diagnostic) {
+	for key, value := range t.Fields {
+		path := joinKey(prefix, key)
+		pos := src.position(value)
+		lines[normKey(path)] = pos
+
+		ft, ok := fieldType(typ, key)
+		if !ok {
+			*diags = append(*diags, &Diagnostic{File: pos.file, Line: pos.line, Key: path, Message: "unknown setting"})
+			continue
+		}
+
+		switch v := value.(type) {
+		case *ast.Table:
+			checkKeys(src, path, v, ft, lines, diags)
+		case []*ast.Table:
+			elem := ft
+			if elem.Kind() == reflect.Slice {
+				elem = elem.Elem()
+			}
+			for i, sub := range v {
+				subPath := fmt.Sprintf("%s[%d]", path, i)
+				lines[normKey(subPath)] = src.position(sub)
+				checkKeys(src, subPath, sub, elem, lines, diags)
+			}
+		}
+	}
+}
+
+// fieldType returns the type of the value stored under key in typ.
+func fieldType(typ reflect.Type, key string) (reflect.Type, bool) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.PkgPath == "" && normKey(f.Name) == normKey(key) {
+				return f.Type, true
+			}
+		}
+		return nil, false
+	case reflect.Map:
+		return typ.Elem(), true
+	}
+	return typ, true // Anything goes in an interface
+}
+
+// validChannel returns if a channel is in team:channel or @user form.
+func validChannel(name string, allowUser bool) bool {
+	if strings.HasPrefix(name, "@") {
+		return allowUser && len(name) > 1
+	}
+	parts := strings.SplitN(name, ":", 2)
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// Channels returns the channels used in the configuration mapped to the key
+// of a setting that uses them.
+func (c *Config) Channels() map[string]string {
+	channels := make(map[string]string)
+	add := func(key, channel string) {
+		if _, exists := channels[channel]; !exists && channel != "" {
+			channels[channel] = key
+		}
+	}
+
+	add("mattermost.debugchannel", c.Mattermost.DebugChannel)
+	for id, route := range c.Routes {
+		for i, ch := range route.Channels {
+			add(fmt.Sprintf("routes.%s.channels[%d]", id, i), ch)
+		}
+	}
+	for name, ec := range c.Escalation {
+		for i, step := range ec.Steps {
+			add(fmt.Sprintf("escalation.%s.steps[%d].channel", name, i), step.Channel)
+		}
+	}
+	for name, rc := range c.OnCall.Rotations {
+		add(fmt.Sprintf("oncall.rotations.%s.announce", name), rc.Announce)
+	}
+	for name, ac := range c.Announcements {
+		for i, ch := range ac.Channels {
+			add(fmt.Sprintf("announcements.%s.channels[%d]", name, i), ch)
+		}
+	}
+	return channels
+}
+
+func checkChannels(c *Config) []*Diagnostic {
+	var diags []*Diagnostic
+	if c.Mattermost.DebugChannel == "" {
+		diags = append(diags, c.Problem("mattermost.debugchannel", "debug channel is required"))
+	} else if !validChannel(c.Mattermost.DebugChannel, false) {
+		diags = append(diags, c.Problem("mattermost.debugchannel", "channel must be in team:channel form"))
+	}
+
+	for channel, key := range c.Channels() {
+		if key != "mattermost.debugchannel" && !validChannel(channel, true) {
+			diags = append(diags, c.Problem(key, "channel %q must be in team:channel or @user form", channel))
+		}
+	}
+
+	for name, qc := range c.QuietHours {
+		for i, ch := range qc.Channels {
+			if !validChannel(ch, true) {
+				diags = append(diags, c.Problem(fmt.Sprintf("quiethours.%s.channels[%d]", name, i),
+					"channel %q must be in team:channel or @user form", ch))
+			}
+		}
+	}
+	return diags
+}
+
+// checkModules warns about module settings for modules that aren't loaded.
+func checkModules(c *Config) []*Diagnostic {
+	var diags []*Diagnostic
+	for name := range c.Modules {
+		if !utils.StringInSlice(name, c.Main.Modules) {
+			diags = append(diags, c.Warning("modules."+name, "module %s isn't in main.modules", name))
+		}
+	}
+	return diags
+}
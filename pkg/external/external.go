@@ -0,0 +1,280 @@
+// Package external runs plugins as separate processes. Yobot talks to them
+// with JSON-RPC 2.0 over their standard input and output, so plugins can be
+// built independently of Yobot and in any language.
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/health"
+	"github.com/lfkeitel/yobot/pkg/metrics"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/plugins"
+)
+
+// ProtocolVersion is sent to plugins when they're initialized.
+const ProtocolVersion = 1
+
+var (
+	lock     sync.Mutex
+	running  = map[string]*plugin{}
+	routes   = map[string]*plugin{} // Route handler ID to plugin
+	commands = map[string]*plugin{} // Command name to plugin
+
+	// Routes and commands can only be registered while Yobot starts
+	registrationClosed bool
+
+	pluginRestarts = metrics.NewCounter("yobot_external_plugin_restarts_total",
+		"Restarts of external plugins after they exited.", "plugin")
+)
+
+func init() {
+	plugins.Register(lifecycle{})
+	msgbus.RegisterAdminHandler("external", handleAdminAPI)
+	config.RegisterValidator(validate)
+}
+
+// lifecycle forwards chat events to the external plugins once the bot is
+// started and stops them with the bot. They're started earlier by Load so
+// their routes exist before the message bus starts.
+type lifecycle struct{}
+
+func (lifecycle) Name() string { return "external" }
+
+func (lifecycle) Init(ctx context.Context, conf *plugins.Config) error { return nil }
+
+func (lifecycle) Start(ctx context.Context, b *bot.Bot) error {
+	lock.Lock()
+	loaded := len(running) > 0
+	lock.Unlock()
+
+	if b != nil && loaded {
+		b.RegisterEventHandler(dispatchEvent, "*", supportedEvents...)
+	}
+	return nil
+}
+
+func (lifecycle) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (lifecycle) Reload(ctx context.Context, conf *plugins.Config) error {
+	return reload(conf.Config)
+}
+
+// Load starts the external plugins in the configuration. It returns once
+// they're initialized and have registered their routes and commands.
+func Load(conf *config.Config) error {
+	names := make([]string, 0, len(conf.External))
+	for name := range conf.External {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		p, err := newPlugin(name, conf.External[name], conf.ModuleDataDir("external/"+name))
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		lock.Lock()
+		running[name] = p
+		lock.Unlock()
+
+		ready := make(chan error, 1)
+		go p.run(ready)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = <-ready
+		}(i)
+	}
+	wg.Wait()
+
+	lock.Lock()
+	registrationClosed = true
+	lock.Unlock()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("external plugin %s: %s", names[i], err)
+		}
+	}
+
+	for _, name := range names {
+		p := running[name]
+		health.RegisterCheck("external "+name, false, p.health)
+		fmt.Printf("Loaded external plugin %s\n", name)
+	}
+	return nil
+}
+
+// Shutdown stops the external plugins.
+func Shutdown() {
+	lock.Lock()
+	stopping := make([]*plugin, 0, len(running))
+	for _, p := range running {
+		stopping = append(stopping, p)
+	}
+	lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range stopping {
+		wg.Add(1)
+		go func(p *plugin) {
+			defer wg.Done()
+			p.shutdown()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Statuses returns the state of the external plugins sorted by name.
+func Statuses() []*Status {
+	lock.Lock()
+	defer lock.Unlock()
+
+	statuses := make([]*Status, 0, len(running))
+	for _, p := range running {
+		s := p.status()
+		s.Routes = ownedBy(routes, p)
+		s.Commands = ownedBy(commands, p)
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// ownedBy must be called with the lock held.
+func ownedBy(registry map[string]*plugin, p *plugin) []string {
+	names := []string{}
+	for name, owner := range registry {
+		if owner == p {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reload sends new settings to the plugins. Plugins whose command changed
+// are restarted. Adding or removing plugins needs a restart of Yobot.
+func reload(conf *config.Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var problems []string
+	for name, p := range running {
+		nc := conf.External[name]
+		if nc == nil {
+			problems = append(problems, fmt.Sprintf("external plugin %s was removed, restart Yobot to stop it", name))
+			continue
+		}
+
+		p.lock.Lock()
+		old := p.conf
+		p.conf = nc
+		p.lock.Unlock()
+
+		if old.Command != nc.Command || old.Dir != nc.Dir ||
+			!reflect.DeepEqual(old.Args, nc.Args) || !reflect.DeepEqual(old.Env, nc.Env) {
+			p.logf("Command changed, restarting")
+			p.restart()
+			continue
+		}
+		if !reflect.DeepEqual(old.Settings, nc.Settings) {
+			p.notify("reload", &reloadParams{Settings: nc.Settings})
+		}
+	}
+	for name := range conf.External {
+		if running[name] == nil {
+			problems = append(problems, fmt.Sprintf("external plugin %s was added, restart Yobot to start it", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validate(conf *config.Config) []*config.Diagnostic {
+	var diags []*config.Diagnostic
+	for name, ec := range conf.External {
+		key := "external." + name
+		if ec.Command == "" {
+			diags = append(diags, conf.Problem(key+".command", "required"))
+		} else if _, err := exec.LookPath(commandPath(ec)); err != nil {
+			diags = append(diags, conf.Problem(key+".command", "%s", err))
+		}
+		if ec.Dir != "" {
+			if info, err := os.Stat(ec.Dir); err != nil {
+				diags = append(diags, conf.Problem(key+".dir", "%s", err))
+			} else if !info.IsDir() {
+				diags = append(diags, conf.Problem(key+".dir", "%s isn't a directory", ec.Dir))
+			}
+		}
+		for i, env := range ec.Env {
+			if !strings.Contains(env, "=") {
+				diags = append(diags, conf.Problem(fmt.Sprintf("%s.env[%d]", key, i), "must be NAME=value"))
+			}
+		}
+		// Settings are sent to the plugin as JSON
+		if _, err := json.Marshal(ec.Settings); err != nil {
+			diags = append(diags, conf.Problem(key+".settings", "%s", err))
+		}
+	}
+	return diags
+}
+
+// commandPath returns the command of a plugin as it's found when started.
+// Relative paths are relative to the plugin's directory.
+func commandPath(ec *config.ExternalConfig) string {
+	if ec.Dir != "" && strings.Contains(ec.Command, "/") && !filepath.IsAbs(ec.Command) {
+		return filepath.Join(ec.Dir, ec.Command)
+	}
+	return ec.Command
+}
+
+func handleAdminAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if path != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Statuses())
+}
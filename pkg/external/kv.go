@@ -0,0 +1,68 @@
+package external
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+// kvStore is a plugin's key/value store in the storage namespace
+// external/NAME. Values are any JSON.
+type kvStore struct {
+	store *storage.Store
+}
+
+// openKVStore returns the store of a plugin. Values saved in the plugin's
+// kv.json by older versions are imported.
+func openKVStore(name, dataDir string) (*kvStore, error) {
+	store := storage.Namespace("external/" + name)
+	if err := store.ImportJSONFile(filepath.Join(dataDir, "kv.json")); err != nil {
+		return nil, err
+	}
+	return &kvStore{store: store}, nil
+}
+
+// handle answers the kv_* methods.
+func (kv *kvStore) handle(method string, params *kvParams) (interface{}, error) {
+	if method != "kv_list" && params.Key == "" {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "key is required"}
+	}
+
+	switch method {
+	case "kv_get":
+		var value json.RawMessage
+		found, err := kv.store.Get(params.Key, &value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"value": value, "found": found}, nil
+	case "kv_set":
+		if len(params.Value) == 0 {
+			return nil, &rpcError{Code: codeInvalidParams, Message: "value is required"}
+		}
+		if params.TTL < 0 {
+			return nil, &rpcError{Code: codeInvalidParams, Message: "ttl can't be negative"}
+		}
+		return struct{}{}, kv.store.SetTTL(params.Key, params.Value, time.Duration(params.TTL)*time.Second)
+	case "kv_incr":
+		by := int64(1)
+		if params.By != nil {
+			by = *params.By
+		}
+		value, err := kv.store.Incr(params.Key, by)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int64{"value": value}, nil
+	case "kv_delete":
+		return struct{}{}, kv.store.Delete(params.Key)
+	default:
+		keys, err := kv.store.Keys(params.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"keys": keys}, nil
+	}
+}
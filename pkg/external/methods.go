@@ -0,0 +1,376 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const callTimeout = 30 * time.Second
+
+// supportedEvents are the chat events plugins can subscribe to.
+var supportedEvents = []string{
+	model.WEBSOCKET_EVENT_POSTED,
+	model.WEBSOCKET_EVENT_POST_EDITED,
+	model.WEBSOCKET_EVENT_POST_DELETED,
+	model.WEBSOCKET_EVENT_REACTION_ADDED,
+	model.WEBSOCKET_EVENT_REACTION_REMOVED,
+	model.WEBSOCKET_EVENT_USER_ADDED,
+	model.WEBSOCKET_EVENT_USER_REMOVED,
+}
+
+// Requests sent to plugins
+
+type initializeParams struct {
+	Protocol int                    `json:"protocol"`
+	Name     string                 `json:"name"`
+	DataDir  string                 `json:"data_dir"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+type reloadParams struct {
+	Settings map[string]interface{} `json:"settings"`
+}
+
+type handleRequestParams struct {
+	Route      string      `json:"route"`
+	RequestID  string      `json:"request_id"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+	DryRun     bool        `json:"dry_run,omitempty"`
+}
+
+type handleRequestResult struct {
+	Status      int              `json:"status"`
+	ContentType string           `json:"content_type"`
+	Body        string           `json:"body"`
+	Messages    []*routedMessage `json:"messages"`
+}
+
+// routedMessage is dispatched like messages from built in handlers. Without
+// channels, the route's channels are used.
+type routedMessage struct {
+	Message  string   `json:"message"`
+	Channels []string `json:"channels"`
+}
+
+type runCommandParams struct {
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	UserID    string   `json:"user_id"`
+	Username  string   `json:"username"`
+	ChannelID string   `json:"channel_id"`
+	PostID    string   `json:"post_id"`
+	RootID    string   `json:"root_id"`
+}
+
+type runCommandResult struct {
+	Reply string `json:"reply"`
+}
+
+type eventParams struct {
+	Event     string                    `json:"event"`
+	Data      map[string]interface{}    `json:"data"`
+	Broadcast *model.WebsocketBroadcast `json:"broadcast"`
+}
+
+// Requests from plugins
+
+type sendMessageParams struct {
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+	RootID  string `json:"root_id"`
+}
+
+type registerRouteParams struct {
+	ID string `json:"id"`
+}
+
+type registerCommandParams struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+}
+
+type subscribeParams struct {
+	Events []string `json:"events"`
+}
+
+type kvParams struct {
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+	Prefix string          `json:"prefix"`
+	TTL    int64           `json:"ttl"`
+	By     *int64          `json:"by"`
+}
+
+// handle answers a request from the plugin.
+func (p *plugin) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "send_message":
+		var sp sendMessageParams
+		if err := decodeParams(params, &sp); err != nil {
+			return nil, err
+		}
+		return p.sendMessage(&sp)
+
+	case "register_route":
+		var rp registerRouteParams
+		if err := decodeParams(params, &rp); err != nil {
+			return nil, err
+		}
+		return struct{}{}, registerRoute(p, rp.ID)
+
+	case "register_command":
+		var cp registerCommandParams
+		if err := decodeParams(params, &cp); err != nil {
+			return nil, err
+		}
+		return struct{}{}, registerCommand(p, cp.Name, cp.Help)
+
+	case "subscribe":
+		var sp subscribeParams
+		if err := decodeParams(params, &sp); err != nil {
+			return nil, err
+		}
+		return struct{}{}, p.subscribe(sp.Events)
+
+	case "kv_get", "kv_set", "kv_incr", "kv_delete", "kv_list":
+		var kp kvParams
+		if err := decodeParams(params, &kp); err != nil {
+			return nil, err
+		}
+		return p.kv.handle(method, &kp)
+	}
+	return nil, &rpcError{Code: codeMethodNotFound, Message: "method not found: " + method}
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return &rpcError{Code: codeInvalidParams, Message: "missing params"}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (p *plugin) sendMessage(sp *sendMessageParams) (interface{}, error) {
+	if sp.Channel == "" || sp.Message == "" {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "channel and message are required"}
+	}
+
+	if !strings.Contains(sp.Channel, ":") && !strings.HasPrefix(sp.Channel, "@") {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "channel must be in team:channel or @user form"}
+	}
+
+	// Queued like route messages so they're retried if Mattermost is down
+	id := msgbus.SendMessage(sp.Channel, sp.Message, sp.RootID)
+	return map[string]string{"queue_id": id}, nil
+}
+
+func registerRoute(p *plugin, id string) error {
+	if id == "" {
+		return &rpcError{Code: codeInvalidParams, Message: "route id is required"}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if owner, exists := routes[id]; exists {
+		if owner == p { // Registered again after a restart
+			return nil
+		}
+		return fmt.Errorf("route %s is registered by plugin %s", id, owner.name)
+	}
+	if registrationClosed {
+		return errors.New("routes can only be registered when Yobot starts")
+	}
+
+	if err := registerMsgBus(id, routeHandler(p)); err != nil {
+		return err
+	}
+	routes[id] = p
+	p.logf("Registered route %s", id)
+	return nil
+}
+
+// registerMsgBus registers a route handler, returning an error instead of
+// panicking if the ID is taken.
+func registerMsgBus(id string, handler msgbus.BusHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	msgbus.RegisterMsgBus(id, handler)
+	return nil
+}
+
+func registerCommand(p *plugin, name, help string) error {
+	name = strings.ToLower(name)
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return &rpcError{Code: codeInvalidParams, Message: "command name must be one word"}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if owner, exists := commands[name]; exists {
+		if owner == p {
+			return nil
+		}
+		return fmt.Errorf("command %s is registered by plugin %s", name, owner.name)
+	}
+	if registrationClosed {
+		return errors.New("commands can only be registered when Yobot starts")
+	}
+
+	if err := registerBotCommand(name, &bot.Command{Help: help, Handler: commandHandler(p)}); err != nil {
+		return err
+	}
+	commands[name] = p
+	p.logf("Registered command %s", name)
+	return nil
+}
+
+func registerBotCommand(name string, cmd *bot.Command) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	bot.RegisterCommand(name, cmd)
+	return nil
+}
+
+func (p *plugin) subscribe(events []string) error {
+	for _, event := range events {
+		supported := false
+		for _, s := range supportedEvents {
+			supported = supported || s == event
+		}
+		if !supported {
+			return &rpcError{Code: codeInvalidParams, Message: "unsupported event " + event}
+		}
+	}
+
+	p.lock.Lock()
+	for _, event := range events {
+		p.events[event] = true
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *plugin) subscribed(event string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.events[event]
+}
+
+// routeHandler passes requests to a route to the plugin and dispatches the
+// messages it returns.
+func routeHandler(p *plugin) msgbus.BusHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		params := &handleRequestParams{
+			Route:      msgbus.GetCtxRouteID(ctx),
+			RequestID:  msgbus.GetCtxRequestID(ctx),
+			Method:     r.Method,
+			URL:        r.URL.RequestURI(),
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header,
+			Body:       string(body),
+			DryRun:     msgbus.IsDryRun(ctx),
+		}
+
+		callCtx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		defer cancel()
+
+		var result handleRequestResult
+		if err := p.call(callCtx, "handle_request", params, &result); err != nil {
+			p.logf("Request %s failed: %s", params.RequestID, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if result.ContentType != "" {
+			w.Header().Set("Content-Type", result.ContentType)
+		}
+		if result.Status == 0 {
+			result.Status = http.StatusOK
+		}
+		w.WriteHeader(result.Status)
+		w.Write([]byte(result.Body))
+
+		for _, m := range result.Messages {
+			if len(m.Channels) == 0 {
+				msgbus.DispatchMessage(ctx, "%s", m.Message)
+			} else {
+				msgbus.DispatchMessageToChannels(ctx, m.Channels, m.Message)
+			}
+		}
+	}
+}
+
+// commandHandler passes a chat command to the plugin and replies with its
+// result.
+func commandHandler(p *plugin) bot.CommandHandler {
+	return func(b *bot.Bot, event *bot.CommandEvent) error {
+		params := &runCommandParams{
+			Command:   event.Command,
+			Args:      event.Args,
+			UserID:    event.Post.UserId,
+			Username:  b.Username(event.Post.UserId),
+			ChannelID: event.Post.ChannelId,
+			PostID:    event.Post.Id,
+			RootID:    event.Post.RootId,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		defer cancel()
+
+		var result runCommandResult
+		if err := p.call(ctx, "run_command", params, &result); err != nil {
+			return err
+		}
+		if result.Reply != "" {
+			return b.Reply(event.Post, result.Reply)
+		}
+		return nil
+	}
+}
+
+// dispatchEvent sends a chat event to the subscribed plugins.
+func dispatchEvent(event *model.WebSocketEvent) {
+	lock.Lock()
+	subscribers := make([]*plugin, 0, len(running))
+	for _, p := range running {
+		if p.subscribed(event.Event) {
+			subscribers = append(subscribers, p)
+		}
+	}
+	lock.Unlock()
+
+	params := &eventParams{Event: event.Event, Data: event.Data, Broadcast: event.Broadcast}
+	for _, p := range subscribers {
+		p.notify("event", params)
+	}
+}
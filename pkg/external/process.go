@@ -0,0 +1,337 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+)
+
+const (
+	initTimeout     = 10 * time.Second
+	stopTimeout     = 3 * time.Second
+	maxRestartDelay = time.Minute
+)
+
+// plugin is an external plugin process. It's restarted when it exits
+// until Yobot shuts down.
+type plugin struct {
+	name    string
+	dataDir string
+	log     *log.Logger
+	logFile *os.File
+	kv      *kvStore
+
+	lock      sync.Mutex
+	conf      *config.ExternalConfig
+	conn      *conn
+	stdin     io.Closer
+	cmd       *exec.Cmd
+	pid       int
+	started   time.Time
+	restarts  int
+	lastError string
+	events    map[string]bool
+	stopping  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newPlugin(name string, conf *config.ExternalConfig, dataDir string) (*plugin, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dataDir, "plugin.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := openKVStore(name, dataDir)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	return &plugin{
+		name:    name,
+		dataDir: dataDir,
+		log:     log.New(logFile, "", log.LstdFlags),
+		logFile: logFile,
+		kv:      kv,
+		conf:    conf,
+		events:  make(map[string]bool),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// logf writes a message to Yobot's output and the plugin's log.
+func (p *plugin) logf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	fmt.Printf("External plugin %s: %s\n", p.name, msg)
+	p.log.Print(msg)
+}
+
+// run starts the plugin and restarts it when it exits. The result of the
+// first start is sent on ready.
+func (p *plugin) run(ready chan<- error) {
+	defer close(p.done)
+
+	delay := time.Second
+	first := true
+	for {
+		started := time.Now()
+		err := p.runOnce(func(err error) {
+			if first {
+				ready <- err
+			}
+		})
+		if first && err != nil && p.startFailed() {
+			return
+		}
+		first = false
+
+		p.lock.Lock()
+		stopping := p.stopping
+		if err != nil {
+			p.lastError = err.Error()
+		}
+		p.lock.Unlock()
+		if stopping {
+			return
+		}
+
+		if time.Since(started) > maxRestartDelay {
+			delay = time.Second
+		}
+		p.logf("Exited (%v), restarting in %s", err, delay)
+		pluginRestarts.Inc(p.name)
+
+		select {
+		case <-time.After(delay):
+		case <-p.stop:
+			return
+		}
+
+		p.lock.Lock()
+		p.restarts++
+		p.lock.Unlock()
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// startFailed returns if the plugin never finished starting.
+func (p *plugin) startFailed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.started.IsZero()
+}
+
+// runOnce starts the plugin process, initializes it, and waits for it to
+// exit. initialized is called with the result of initializing.
+func (p *plugin) runOnce(initialized func(error)) error {
+	p.lock.Lock()
+	conf := p.conf
+	p.lock.Unlock()
+
+	cmd := exec.Command(conf.Command, conf.Args...)
+	cmd.Dir = conf.Dir
+	cmd.Env = append([]string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + os.Getenv("HOME"),
+		"YOBOT_PLUGIN_NAME=" + p.name,
+		"YOBOT_PLUGIN_DATA_DIR=" + p.dataDir,
+	}, conf.Env...)
+	cmd.Stderr = p.logFile
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		initialized(err)
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		initialized(err)
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		initialized(err)
+		return err
+	}
+
+	c := newConn(stdout, stdin, p.handle, p.logf)
+	go c.readLoop()
+
+	p.lock.Lock()
+	p.conn = c
+	p.stdin = stdin
+	p.cmd = cmd
+	p.pid = cmd.Process.Pid
+	p.lock.Unlock()
+	p.logf("Started with PID %d", cmd.Process.Pid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	err = c.call(ctx, "initialize", &initializeParams{
+		Protocol: ProtocolVersion,
+		Name:     p.name,
+		DataDir:  p.dataDir,
+		Settings: conf.Settings,
+	}, nil)
+	cancel()
+
+	if err != nil {
+		err = fmt.Errorf("initialize: %s", err)
+		cmd.Process.Kill()
+	} else {
+		p.lock.Lock()
+		p.started = time.Now()
+		p.lock.Unlock()
+	}
+	initialized(err)
+
+	// The output must be read completely before waiting
+	<-c.done
+	waitErr := cmd.Wait()
+
+	p.lock.Lock()
+	p.conn = nil
+	p.stdin = nil
+	p.cmd = nil
+	p.pid = 0
+	p.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	return errors.New("exited")
+}
+
+// client returns the connection to the running plugin.
+func (p *plugin) client() (*conn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn == nil {
+		return nil, fmt.Errorf("plugin %s isn't running", p.name)
+	}
+	return p.conn, nil
+}
+
+func (p *plugin) call(ctx context.Context, method string, params, result interface{}) error {
+	c, err := p.client()
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, method, params, result)
+}
+
+func (p *plugin) notify(method string, params interface{}) error {
+	c, err := p.client()
+	if err != nil {
+		return err
+	}
+	return c.notify(method, params)
+}
+
+// restart stops the running process so it's started again with the current
+// configuration.
+func (p *plugin) restart() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// shutdown asks the plugin to exit and kills it if it doesn't within
+// stopTimeout.
+func (p *plugin) shutdown() {
+	p.lock.Lock()
+	if p.stopping {
+		p.lock.Unlock()
+		return
+	}
+	p.stopping = true
+	close(p.stop)
+	cmd, c, stdin := p.cmd, p.conn, p.stdin
+	p.lock.Unlock()
+
+	// Plugins exit when their input is closed
+	if c != nil {
+		c.notify("shutdown", struct{}{})
+		stdin.Close()
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		p.logf("Didn't stop in %s, killing", stopTimeout)
+		if cmd != nil {
+			cmd.Process.Kill()
+		}
+		<-p.done
+	}
+
+	p.logFile.Close()
+}
+
+// Status is the state of an external plugin.
+type Status struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	PID       int       `json:"pid,omitempty"`
+	Started   time.Time `json:"started"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+	Routes    []string  `json:"routes"`
+	Commands  []string  `json:"commands"`
+	Events    []string  `json:"events"`
+}
+
+func (p *plugin) status() *Status {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s := &Status{
+		Name:      p.name,
+		Running:   p.conn != nil,
+		PID:       p.pid,
+		Started:   p.started,
+		Restarts:  p.restarts,
+		LastError: p.lastError,
+		Events:    make([]string, 0, len(p.events)),
+	}
+	for event := range p.events {
+		s.Events = append(s.Events, event)
+	}
+	return s
+}
+
+func (p *plugin) health() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn == nil {
+		if p.lastError != "" {
+			return fmt.Errorf("not running: %s", p.lastError)
+		}
+		return errors.New("not running")
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeServerError    = -32000
+)
+
+var errClosed = errors.New("plugin connection closed")
+
+// message is a JSON-RPC 2.0 request, notification, or response.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+type response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type errorResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   *rpcError        `json:"error"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// handlerFunc answers a request from the plugin.
+type handlerFunc func(method string, params json.RawMessage) (interface{}, error)
+
+// conn is a JSON-RPC connection with one message per line. Both sides can
+// send requests.
+type conn struct {
+	r       *bufio.Reader
+	w       io.Writer
+	wlock   sync.Mutex
+	handler handlerFunc
+	logf    func(format string, a ...interface{})
+
+	lock    sync.Mutex
+	nextID  int64
+	pending map[int64]chan *message
+	done    chan struct{}
+}
+
+func newConn(r io.Reader, w io.Writer, handler handlerFunc, logf func(string, ...interface{})) *conn {
+	return &conn{
+		r:       bufio.NewReader(r),
+		w:       w,
+		handler: handler,
+		logf:    logf,
+		pending: make(map[int64]chan *message),
+		done:    make(chan struct{}),
+	}
+}
+
+// readLoop reads messages until the plugin closes its output. Requests are
+// handled concurrently so the plugin can call Yobot while Yobot waits on it.
+func (c *conn) readLoop() {
+	defer close(c.done)
+
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if len(line) > 1 {
+			c.receive(line)
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.logf("Error reading from plugin: %s", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) receive(line []byte) {
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		c.logf("Invalid message from plugin: %s", err)
+		c.writeError(nil, &rpcError{Code: codeParseError, Message: err.Error()})
+		return
+	}
+
+	if msg.Method == "" { // Response
+		var id int64
+		if msg.ID == nil || json.Unmarshal(*msg.ID, &id) != nil {
+			c.logf("Response from plugin has an invalid ID")
+			return
+		}
+		c.lock.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if ch != nil {
+			ch <- &msg
+		}
+		return
+	}
+
+	go func() {
+		result, err := c.handler(msg.Method, msg.Params)
+		if msg.ID == nil { // Notification
+			return
+		}
+		if err != nil {
+			rerr, ok := err.(*rpcError)
+			if !ok {
+				rerr = &rpcError{Code: codeServerError, Message: err.Error()}
+			}
+			c.writeError(msg.ID, rerr)
+			return
+		}
+		c.write(&response{JSONRPC: "2.0", ID: msg.ID, Result: result})
+	}()
+}
+
+// call sends a request and decodes the result into result if it isn't nil.
+func (c *conn) call(ctx context.Context, method string, params, result interface{}) error {
+	c.lock.Lock()
+	c.nextID++
+	id := c.nextID
+	ch := make(chan *message, 1)
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	rawID := json.RawMessage(strconv.FormatInt(id, 10))
+	if err := c.send(&rawID, method, params); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return errClosed
+	}
+}
+
+// notify sends a notification, a request without a response.
+func (c *conn) notify(method string, params interface{}) error {
+	return c.send(nil, method, params)
+}
+
+func (c *conn) send(id *json.RawMessage, method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.write(&message{JSONRPC: "2.0", ID: id, Method: method, Params: data})
+}
+
+func (c *conn) writeError(id *json.RawMessage, err *rpcError) {
+	c.write(&errorResponse{JSONRPC: "2.0", ID: id, Error: err})
+}
+
+func (c *conn) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err = c.w.Write(append(data, '\n'))
+	return err
+}
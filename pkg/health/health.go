@@ -0,0 +1,178 @@
+// Package health runs checks of the bot's components. Components and plugins
+// register a check that reports if they are working.
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Component statuses
+const (
+	StatusOK   = "ok"
+	StatusDown = "down"
+)
+
+const (
+	checkTimeout = 5 * time.Second
+	cacheTTL     = 5 * time.Second
+)
+
+// A Check returns nil if the component is working.
+type Check func() error
+
+type check struct {
+	required bool
+	check    Check
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of all checks. Healthy is false when a required
+// check fails. Ready is false until the bot has started and when any check
+// fails.
+type Report struct {
+	Healthy bool      `json:"healthy"`
+	Ready   bool      `json:"ready"`
+	Started bool      `json:"started"`
+	Time    time.Time `json:"time"`
+	Checks  []*Result `json:"checks"`
+}
+
+var (
+	checks = struct {
+		sync.Mutex
+		byName map[string]*check
+	}{byName: make(map[string]*check)}
+
+	state = struct {
+		sync.Mutex
+		started bool
+		last    *Report
+	}{}
+)
+
+// RegisterCheck adds a component check. If a required check fails, the bot
+// is unhealthy. Other checks only make the bot not ready. Registering a name
+// again replaces the check.
+func RegisterCheck(name string, required bool, c Check) {
+	checks.Lock()
+	checks.byName[name] = &check{required: required, check: c}
+	checks.Unlock()
+
+	state.Lock()
+	state.last = nil
+	state.Unlock()
+}
+
+// RemoveCheck removes a component check.
+func RemoveCheck(name string) {
+	checks.Lock()
+	delete(checks.byName, name)
+	checks.Unlock()
+
+	state.Lock()
+	state.last = nil
+	state.Unlock()
+}
+
+// SetStarted marks the bot as started. The bot isn't ready until it's started.
+func SetStarted() {
+	state.Lock()
+	state.started = true
+	state.last = nil
+	state.Unlock()
+}
+
+// Run runs all checks concurrently. Results are cached for a few seconds so
+// frequent probes don't overload the components.
+func Run() *Report {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.last != nil && time.Since(state.last.Time) < cacheTTL {
+		return state.last
+	}
+
+	checks.Lock()
+	names := make([]string, 0, len(checks.byName))
+	for name := range checks.byName {
+		names = append(names, name)
+	}
+	registered := make(map[string]*check, len(checks.byName))
+	for name, c := range checks.byName {
+		registered[name] = c
+	}
+	checks.Unlock()
+	sort.Strings(names)
+
+	report := &Report{
+		Healthy: true,
+		Ready:   state.started,
+		Started: state.started,
+		Time:    time.Now(),
+		Checks:  make([]*Result, len(names)),
+	}
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string, c *check) {
+			defer wg.Done()
+			report.Checks[i] = runCheck(name, c)
+		}(i, name, registered[name])
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		if r.Status == StatusOK {
+			continue
+		}
+		report.Ready = false
+		if r.Required {
+			report.Healthy = false
+		}
+	}
+
+	state.last = report
+	return report
+}
+
+// runCheck runs a check with a timeout and recovers from a panic.
+func runCheck(name string, c *check) *Result {
+	result := &Result{Name: name, Status: StatusOK, Required: c.required}
+	start := time.Now()
+
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errc <- fmt.Errorf("check panicked: %v", r)
+			}
+		}()
+		errc <- c.check()
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-time.After(checkTimeout):
+		err = fmt.Errorf("check timed out after %s", checkTimeout)
+	}
+
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
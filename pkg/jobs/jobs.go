@@ -0,0 +1,359 @@
+// Package jobs runs functions on an interval or a cron schedule. A job never
+// runs concurrently with itself and its last run time is stored so interval
+// jobs keep their schedule across restarts.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/metrics"
+	"github.com/lfkeitel/yobot/pkg/schedule"
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+const stopTimeout = 5 * time.Second
+
+// ErrRemove is returned by Run to remove the job after the run, such as for a
+// job that only needs to run once.
+var ErrRemove = errors.New("remove job")
+
+// Job is a function run on a schedule. Either Every or Cron is set.
+type Job struct {
+	// Name is unique, plugins prefix it with their own name like
+	// "dandelion/https://dandelion.example.com".
+	Name string
+
+	// Every runs the job on an interval. The first run is Every after the
+	// last run before Yobot started, or right away.
+	Every time.Duration
+
+	// Cron runs the job at the times matching a cron expression in Location,
+	// the local time zone by default. Times missed while Yobot was stopped
+	// aren't run.
+	Cron     string
+	Location *time.Location
+
+	// Jitter delays each run by a random duration up to Jitter.
+	Jitter time.Duration
+
+	// Run is called with a context cancelled when the job is removed or
+	// Yobot stops. It returns ErrRemove to remove its own job, calling
+	// Remove from Run would wait for Run to return forever.
+	Run func(ctx context.Context) error
+}
+
+type job struct {
+	*Job
+	cron   *schedule.Cron
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Guarded by the scheduler lock
+	running      bool
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      error
+	nextRun      time.Time
+	runs         int
+	failures     int
+}
+
+var (
+	scheduler = struct {
+		sync.Mutex
+		jobs   map[string]*job
+		ctx    context.Context
+		cancel context.CancelFunc
+	}{jobs: make(map[string]*job)}
+
+	store = storage.Namespace("jobs")
+
+	jobFailures = metrics.NewCounter("yobot_job_failures_total",
+		"Scheduled job runs that returned an error or panicked.", "job")
+)
+
+// Add schedules a job. Jobs added before Start wait for it.
+func Add(j *Job) error {
+	if j.Name == "" {
+		return errors.New("job name is required")
+	}
+	if j.Run == nil {
+		return fmt.Errorf("job %s: run function is required", j.Name)
+	}
+	if j.Jitter < 0 {
+		return fmt.Errorf("job %s: jitter can't be negative", j.Name)
+	}
+
+	sj := &job{Job: j, done: make(chan struct{})}
+	switch {
+	case j.Every > 0 && j.Cron != "":
+		return fmt.Errorf("job %s: only one of an interval and a cron expression can be set", j.Name)
+	case j.Every > 0:
+		if j.Every < time.Second {
+			return fmt.Errorf("job %s: interval must be at least 1s", j.Name)
+		}
+	case j.Cron != "":
+		c, err := schedule.ParseCron(j.Cron)
+		if err != nil {
+			return fmt.Errorf("job %s: %s", j.Name, err)
+		}
+		sj.cron = c
+	default:
+		return fmt.Errorf("job %s: an interval or a cron expression is required", j.Name)
+	}
+
+	// Without storage, such as when testing the configuration, interval
+	// jobs run right away
+	store.Get(j.Name, &sj.lastRun)
+
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if _, exists := scheduler.jobs[j.Name]; exists {
+		return fmt.Errorf("job %s already exists", j.Name)
+	}
+	scheduler.jobs[j.Name] = sj
+	if scheduler.ctx != nil {
+		sj.start(scheduler.ctx)
+	}
+	return nil
+}
+
+// Remove removes a job and its stored last run. It cancels a running job and
+// waits for it to return, so it must not be called from the job's own Run.
+// Return ErrRemove instead. Jobs removed after Stop keep their last run so
+// they keep their schedule when Yobot starts again.
+func Remove(name string) {
+	scheduler.Lock()
+	j := scheduler.jobs[name]
+	delete(scheduler.jobs, name)
+	stopped := scheduler.ctx != nil && scheduler.ctx.Err() != nil
+	scheduler.Unlock()
+
+	if j == nil {
+		return
+	}
+	if j.cancel != nil {
+		j.cancel()
+		<-j.done
+	}
+	if !stopped {
+		deleteLastRun(name)
+	}
+}
+
+// Start starts running the jobs.
+func Start() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	scheduler.ctx, scheduler.cancel = context.WithCancel(context.Background())
+	for _, j := range scheduler.jobs {
+		j.start(scheduler.ctx)
+	}
+}
+
+// Stop cancels the jobs and waits up to 5 seconds for running jobs to
+// return.
+func Stop() {
+	scheduler.Lock()
+	if scheduler.cancel == nil {
+		scheduler.Unlock()
+		return
+	}
+	scheduler.cancel()
+	jobs := make([]*job, 0, len(scheduler.jobs))
+	for _, j := range scheduler.jobs {
+		jobs = append(jobs, j)
+	}
+	scheduler.Unlock()
+
+	timeout := time.After(stopTimeout)
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+		case <-timeout:
+			fmt.Printf("Job %s didn't stop in %s\n", j.Name, stopTimeout)
+			return
+		}
+	}
+}
+
+// start must be called with the scheduler locked.
+func (j *job) start(ctx context.Context) {
+	var jctx context.Context
+	jctx, j.cancel = context.WithCancel(ctx)
+	go j.loop(jctx)
+}
+
+// loop runs the job until ctx is cancelled. Runs are sequential, a run that
+// takes longer than the interval delays the next one.
+func (j *job) loop(ctx context.Context) {
+	defer close(j.done)
+
+	for {
+		next := j.next(time.Now())
+		if next.IsZero() {
+			return
+		}
+
+		scheduler.Lock()
+		j.nextRun = next
+		scheduler.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := j.run(ctx); errors.Is(err, ErrRemove) {
+			j.remove()
+			return
+		}
+	}
+}
+
+// remove removes a job that returned ErrRemove.
+func (j *job) remove() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if scheduler.jobs[j.Name] == j {
+		delete(scheduler.jobs, j.Name)
+		deleteLastRun(j.Name)
+	}
+}
+
+func deleteLastRun(name string) {
+	if err := store.Delete(name); err != nil {
+		fmt.Printf("Error deleting the last run of job %s: %s\n", name, err)
+	}
+}
+
+// next returns the time of the next run after now.
+func (j *job) next(now time.Time) time.Time {
+	var next time.Time
+	if j.cron != nil {
+		loc := j.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		next = j.cron.Next(now.In(loc))
+		if next.IsZero() {
+			return next
+		}
+	} else {
+		scheduler.Lock()
+		next = j.lastRun.Add(j.Every)
+		scheduler.Unlock()
+		if next.Before(now) {
+			next = now
+		}
+	}
+
+	if j.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(j.Jitter))))
+	}
+	return next
+}
+
+// run runs the job once and returns the error from Run.
+func (j *job) run(ctx context.Context) error {
+	start := time.Now()
+	scheduler.Lock()
+	j.running = true
+	scheduler.Unlock()
+
+	err := safeRun(ctx, j.Run)
+	failed := err != nil && !errors.Is(err, ErrRemove)
+
+	scheduler.Lock()
+	j.running = false
+	j.lastRun = start
+	j.lastDuration = time.Since(start)
+	j.runs++
+	if failed {
+		j.lastErr = err
+		j.failures++
+	} else {
+		j.lastErr = nil
+	}
+	scheduler.Unlock()
+
+	if failed && ctx.Err() == nil {
+		jobFailures.Inc(j.Name)
+		fmt.Printf("Job %s failed: %s\n", j.Name, err)
+	}
+	if err := store.Set(j.Name, start); err != nil {
+		fmt.Printf("Error saving the last run of job %s: %s\n", j.Name, err)
+	}
+	return err
+}
+
+// safeRun calls f and turns a panic into an error.
+func safeRun(ctx context.Context, f func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f(ctx)
+}
+
+// Status is the state of a job.
+type Status struct {
+	Name         string     `json:"name"`
+	Every        string     `json:"every,omitempty"`
+	Cron         string     `json:"cron,omitempty"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+}
+
+// Statuses returns the state of the jobs sorted by name. Runs and failures
+// are counted since Yobot started.
+func Statuses() []*Status {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	statuses := make([]*Status, 0, len(scheduler.jobs))
+	for _, j := range scheduler.jobs {
+		s := &Status{
+			Name:     j.Name,
+			Cron:     j.Cron,
+			Running:  j.running,
+			Runs:     j.runs,
+			Failures: j.failures,
+		}
+		if j.Every > 0 {
+			s.Every = j.Every.String()
+		}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			s.LastRun = &lastRun
+		}
+		if j.lastDuration > 0 {
+			s.LastDuration = j.lastDuration.String()
+		}
+		if j.lastErr != nil {
+			s.LastError = j.lastErr.Error()
+		}
+		if !j.nextRun.IsZero() && !j.running {
+			nextRun := j.nextRun
+			s.NextRun = &nextRun
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,304 @@
+// Package metrics collects counters, gauges, and histograms about the bot and
+// writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are histogram buckets in seconds suited to HTTP handlers.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: make(map[string]metric)}
+
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, exists := registry.metrics[name]; exists {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	registry.metrics[name] = m
+}
+
+// Write writes all metrics in the Prometheus text format.
+func Write(w io.Writer) {
+	registry.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = registry.metrics[name]
+	}
+	registry.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// desc is the name, help text, and label names of a metric.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, kind)
+}
+
+// key joins label values into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats label pairs like {a="1",b="2"}. Extra pairs are
+// appended after the metric's labels.
+func (d *desc) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// values is a set of float values keyed by label values.
+type values struct {
+	desc
+	sync.Mutex
+	values map[string]float64
+}
+
+func (v *values) add(delta float64, labels []string) {
+	key := v.key(labels)
+	v.Lock()
+	v.values[key] += delta
+	v.Unlock()
+}
+
+func (v *values) set(value float64, labels []string) {
+	key := v.key(labels)
+	v.Lock()
+	v.values[key] = value
+	v.Unlock()
+}
+
+func (v *values) writeValues(w io.Writer, kind string) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.header(w, kind)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(key), formatFloat(v.values[key]))
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	values
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{values{desc: desc{name, help, labels}, values: make(map[string]float64)}}
+	if len(labels) == 0 {
+		c.values.values[""] = 0
+	}
+	register(name, c)
+	return c
+}
+
+// Inc adds one to the counter with the label values.
+func (c *Counter) Inc(labels ...string) { c.add(1, labels) }
+
+// Add adds delta to the counter with the label values.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("counter can't decrease")
+	}
+	c.add(delta, labels)
+}
+
+func (c *Counter) write(w io.Writer) { c.writeValues(w, "counter") }
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	values
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{values{desc: desc{name, help, labels}, values: make(map[string]float64)}}
+	register(name, g)
+	return g
+}
+
+// Set sets the gauge with the label values.
+func (g *Gauge) Set(value float64, labels ...string) { g.set(value, labels) }
+
+// Add adds delta to the gauge with the label values.
+func (g *Gauge) Add(delta float64, labels ...string) { g.add(delta, labels) }
+
+func (g *Gauge) write(w io.Writer) { g.writeValues(w, "gauge") }
+
+// GaugeFunc is a gauge whose values are collected when metrics are written.
+// The function returns values keyed by the value of the single label, or
+// by an empty string if the gauge has no label.
+type GaugeFunc struct {
+	desc
+	collect func() map[string]float64
+}
+
+// NewGaugeFunc registers a collected gauge. label can be empty.
+func NewGaugeFunc(name, help, label string, collect func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help}, collect: collect}
+	if label != "" {
+		g.labels = []string{label}
+	}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	vals := g.collect()
+	g.header(w, "gauge")
+	for _, key := range sortedKeys(vals) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(key), formatFloat(vals[key]))
+	}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	desc
+	sync.Mutex
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram. Buckets are upper bounds in
+// increasing order, DefaultBuckets are used if nil.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe adds a value to the histogram with the label values.
+func (h *Histogram) Observe(value float64, labels ...string) {
+	key := h.key(labels)
+
+	h.Lock()
+	defer h.Unlock()
+
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Since observes the seconds elapsed since start.
+func (h *Histogram) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,352 @@
+package msgbus
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	alertActionPath  = "/alerts/action"
+	trackedAlertTTL  = 7 * 24 * time.Hour
+	alertTokenLength = 16
+	maxActionBody    = 64 * 1024
+)
+
+// Alert actions
+const (
+	ActionAcknowledge = "acknowledge"
+	ActionResolve     = "resolve"
+	ActionSilence     = "silence"
+)
+
+// Tracked alert states
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+	AlertSilenced     = "silenced"
+)
+
+var actionEmoji = map[string]string{
+	ActionAcknowledge: ":eyes:",
+	ActionResolve:     ":white_check_mark:",
+	ActionSilence:     ":mute:",
+}
+
+var actionStates = map[string]string{
+	ActionAcknowledge: AlertAcknowledged,
+	ActionResolve:     AlertResolved,
+	ActionSilence:     AlertSilenced,
+}
+
+func init() {
+	RegisterMuxHandler(alertActionPath, alertActionHandler)
+}
+
+// AlertActionHandler is called when someone acts on an alert posted for
+// a route. It's used to pass the action on to the source application.
+type AlertActionHandler func(conf *config.Config, route string, alert *Alert, action, user string) error
+
+var alertActionHandlers = map[string]AlertActionHandler{}
+
+// RegisterAlertActionHandler sets the action handler for alerts from a
+// message bus handler. Aliased routes use the handler of the original.
+func RegisterAlertActionHandler(id string, handler AlertActionHandler) {
+	if _, exists := alertActionHandlers[id]; exists {
+		panic(fmt.Sprintf("alert action handler %s is already registered", id))
+	}
+	alertActionHandlers[id] = handler
+}
+
+type alertHistory struct {
+	Action string    `json:"action"`
+	User   string    `json:"user"`
+	Time   time.Time `json:"time"`
+}
+
+// trackedAlert is an alert post that can be acted on.
+type trackedAlert struct {
+	PostID  string          `json:"post_id"`
+	Channel string          `json:"channel"`
+	Route   string          `json:"route"`
+	Message string          `json:"message"`
+	Alert   *Alert          `json:"alert"`
+	Token   string          `json:"token"`
+	State   string          `json:"state"`
+	Posted  time.Time       `json:"posted"`
+	History []*alertHistory `json:"history"`
+}
+
+var trackedAlerts = struct {
+	sync.Mutex
+	file  string
+	posts map[string]*trackedAlert
+}{posts: make(map[string]*trackedAlert)}
+
+func startAlertTracking(conf *config.Config) error {
+	trackedAlerts.Lock()
+	defer trackedAlerts.Unlock()
+
+	trackedAlerts.file = filepath.Join(conf.Main.DataDir, "alerts.json")
+	if err := utils.LoadJSONFile(trackedAlerts.file, &trackedAlerts.posts); err != nil {
+		return err
+	}
+
+	if b := bot.GetBot(); b != nil {
+		b.RegisterEventHandler(handleAlertReaction, "*", model.WEBSOCKET_EVENT_REACTION_ADDED)
+	}
+	return nil
+}
+
+// saveTrackedAlerts must be called with the lock held.
+func saveTrackedAlerts() {
+	for id, a := range trackedAlerts.posts {
+		if time.Since(a.Posted) > trackedAlertTTL {
+			delete(trackedAlerts.posts, id)
+		}
+	}
+
+	if trackedAlerts.file == "" {
+		return
+	}
+	if err := utils.SaveJSONFile(trackedAlerts.file, trackedAlerts.posts); err != nil {
+		fmt.Printf("Failed saving tracked alerts: %s\n", err)
+	}
+}
+
+// newTrackedAlert prepares tracking for a queued alert message. If interactive
+// buttons are enabled, they're added to post.
+func newTrackedAlert(m *queuedMessage, post *model.Post) *trackedAlert {
+	tracked := &trackedAlert{
+		Channel: m.Channel,
+		Route:   m.Route,
+		Message: m.Text,
+		Alert:   m.Alert,
+		Token:   newRequestID()[:alertTokenLength],
+		State:   AlertOpen,
+	}
+
+	conf := currentConfig()
+	if conf != nil && conf.Alerts.Buttons && conf.HTTP.PublicURL != "" {
+		post.AddProp("attachments", []*model.SlackAttachment{{Actions: tracked.postActions()}})
+	}
+	return tracked
+}
+
+func (t *trackedAlert) postActions() []*model.PostAction {
+	conf := currentConfig()
+	url := strings.TrimSuffix(conf.HTTP.PublicURL, "/") + alertActionPath
+	actions := []*model.PostAction{
+		{Name: "Acknowledge", Type: model.POST_ACTION_TYPE_BUTTON},
+		{Name: "Resolve", Type: model.POST_ACTION_TYPE_BUTTON},
+		{Name: "Silence", Type: model.POST_ACTION_TYPE_BUTTON},
+	}
+	for i, action := range []string{ActionAcknowledge, ActionResolve, ActionSilence} {
+		actions[i].Integration = &model.PostActionIntegration{
+			URL: url,
+			Context: model.StringInterface{
+				"action": action,
+				"token":  t.Token,
+			},
+		}
+	}
+	return actions
+}
+
+// trackAlertPost starts tracking a delivered alert post.
+func trackAlertPost(t *trackedAlert, post *model.Post) {
+	t.PostID = post.Id
+	t.Posted = time.Now()
+
+	trackedAlerts.Lock()
+	trackedAlerts.posts[post.Id] = t
+	saveTrackedAlerts()
+	trackedAlerts.Unlock()
+
+	startEscalation(t)
+}
+
+func handleAlertReaction(event *model.WebSocketEvent) {
+	data, ok := event.Data["reaction"].(string)
+	if !ok {
+		return
+	}
+	reaction := model.ReactionFromJson(strings.NewReader(data))
+	if reaction == nil {
+		return
+	}
+
+	b := bot.GetBot()
+	if reaction.UserId == b.UserID {
+		return
+	}
+
+	conf := currentConfig()
+	var action string
+	switch {
+	case utils.StringInSlice(reaction.EmojiName, conf.Alerts.AckEmoji):
+		action = ActionAcknowledge
+	case utils.StringInSlice(reaction.EmojiName, conf.Alerts.ResolveEmoji):
+		action = ActionResolve
+	case utils.StringInSlice(reaction.EmojiName, conf.Alerts.SilenceEmoji):
+		action = ActionSilence
+	default:
+		return
+	}
+
+	if err := applyAlertAction(reaction.PostId, action, b.Username(reaction.UserId)); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// applyAlertAction records an action on an alert post, updates the post,
+// and passes the action to the source application.
+func applyAlertAction(postID, action, user string) error {
+	trackedAlerts.Lock()
+	t, exists := trackedAlerts.posts[postID]
+	if !exists {
+		trackedAlerts.Unlock()
+		return nil
+	}
+	if t.State == AlertResolved {
+		trackedAlerts.Unlock()
+		return errors.New("alert is already resolved")
+	}
+	// Without a host the whole route is silenced, which is a maintenance
+	// window only admins may create
+	if action == ActionSilence && t.Alert.Host == "" &&
+		!utils.StringInSlice(user, currentConfig().Mattermost.Admins) {
+		trackedAlerts.Unlock()
+		return errors.New("only admins can silence alerts without a host")
+	}
+
+	t.State = actionStates[action]
+	t.History = append(t.History, &alertHistory{
+		Action: action,
+		User:   user,
+		Time:   time.Now(),
+	})
+	saveTrackedAlerts()
+	trackedAlerts.Unlock()
+
+	stopEscalation(postID)
+
+	if action == ActionSilence {
+		silenceAlert(t, user)
+	}
+
+	if err := updateAlertPost(t); err != nil {
+		fmt.Println(err)
+	}
+
+	conf := currentConfig()
+	handlerID := t.Route
+	if route := conf.Routes[t.Route]; route != nil && route.Alias != "" {
+		handlerID = route.Alias
+	}
+	if handler := alertActionHandlers[handlerID]; handler != nil {
+		if err := handler(conf, t.Route, t.Alert, action, user); err != nil {
+			return fmt.Errorf("failed passing %s action to %s: %s", action, t.Route, err)
+		}
+	}
+	return nil
+}
+
+// silenceAlert creates a maintenance window for the alert's host, or route
+// if the host isn't known.
+func silenceAlert(t *trackedAlert, user string) {
+	conf := currentConfig()
+	d, _ := time.ParseDuration(conf.Alerts.SilenceDuration)
+	now := time.Now()
+	window := &MaintenanceWindow{
+		Start:     now,
+		End:       now.Add(d),
+		Reason:    "Alert silenced",
+		CreatedBy: user,
+	}
+
+	if t.Alert.Host != "" {
+		window.Hosts = []string{t.Alert.Host}
+	} else {
+		window.Routes = []string{t.Route}
+	}
+
+	if _, err := AddMaintenanceWindow(window); err != nil {
+		fmt.Printf("Failed silencing alert: %s\n", err)
+	}
+}
+
+func updateAlertPost(t *trackedAlert) error {
+	trackedAlerts.Lock()
+	var msg strings.Builder
+	msg.WriteString(t.Message)
+	msg.WriteString("\n\n---\n")
+	for _, h := range t.History {
+		fmt.Fprintf(&msg, "\n%s **%s** by @%s at %s", actionEmoji[h.Action], strings.Title(actionStates[h.Action]),
+			h.User, h.Time.Format(time.RFC1123))
+	}
+
+	conf := currentConfig()
+	props := model.StringInterface{}
+	if conf.Alerts.Buttons && conf.HTTP.PublicURL != "" && t.State != AlertResolved {
+		props["attachments"] = []*model.SlackAttachment{{Actions: t.postActions()}}
+	}
+	trackedAlerts.Unlock()
+
+	message := msg.String()
+	_, err := bot.GetBot().PatchPost(t.PostID, &model.PostPatch{
+		Message: &message,
+		Props:   &props,
+	})
+	return err
+}
+
+func alertActionHandler(conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req model.PostActionIntegrationRequest
+		r.Body = http.MaxBytesReader(w, r.Body, maxActionBody)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		action, _ := req.Context["action"].(string)
+		token, _ := req.Context["token"].(string)
+
+		trackedAlerts.Lock()
+		t, exists := trackedAlerts.posts[req.PostId]
+		valid := exists && token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1
+		trackedAlerts.Unlock()
+
+		if !valid || actionStates[action] == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		resp := &model.PostActionIntegrationResponse{
+			EphemeralText: fmt.Sprintf("Alert %s.", actionStates[action]),
+		}
+		if err := applyAlertAction(req.PostId, action, bot.GetBot().Username(req.UserId)); err != nil {
+			resp.EphemeralText = err.Error()
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
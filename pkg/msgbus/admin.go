@@ -0,0 +1,72 @@
+package msgbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+)
+
+// AdminHandler handles requests to the administrative API. Path is the
+// request path with the "/admin/" prefix and the handler's name removed.
+type AdminHandler func(conf *config.Config, w http.ResponseWriter, r *http.Request, path string)
+
+var adminHandlers = map[string]AdminHandler{}
+
+func init() {
+	RegisterMuxHandler("/admin/", adminHandler)
+}
+
+// RegisterAdminHandler mounts a handler at /admin/name.
+func RegisterAdminHandler(name string, handler AdminHandler) {
+	if _, exists := adminHandlers[name]; exists {
+		panic(fmt.Sprintf("admin handler %s is already registered", name))
+	}
+	adminHandlers[name] = handler
+}
+
+func adminHandler(conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !conf.HTTP.Admin.Enabled {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// The admin API must always have authentication
+		if conf.HTTP.Admin.Password == "" {
+			fmt.Println("Admin API is enabled but has no password configured")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := authenticateAdmin(conf, r); err != nil {
+			writeAuthError(conf, w, err)
+			return
+		}
+
+		split := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/admin/"), "/", 2)
+		handler := adminHandlers[split[0]]
+		if handler == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		path := ""
+		if len(split) == 2 {
+			path = split[1]
+		}
+		handler(conf, w, r, path)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
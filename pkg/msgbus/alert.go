@@ -0,0 +1,46 @@
+package msgbus
+
+import "context"
+
+// Alert severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+	SeverityRecovery = "recovery"
+)
+
+// Alert describes the event behind a message. Handlers attach it to the
+// request context with SetCtxAlert so DispatchMessage can make delivery
+// decisions such as holding messages during quiet hours.
+type Alert struct {
+	Host     string `json:"host,omitempty"`
+	Severity string `json:"severity"`
+
+	// Fingerprint identifies the same alert across events, e.g. an alert
+	// and its recovery. ID is the alert ID in the source application.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	ID          string `json:"id,omitempty"`
+}
+
+// Critical returns if the alert must always be delivered immediately.
+func (a *Alert) Critical() bool {
+	return a.Severity == SeverityCritical
+}
+
+// Actionable returns if the alert is a problem that can be acknowledged.
+func (a *Alert) Actionable() bool {
+	return a != nil && (a.Severity == SeverityCritical || a.Severity == SeverityWarning)
+}
+
+// GetCtxAlert returns the alert attached to the context. If there's no alert,
+// an empty informational alert is returned.
+func GetCtxAlert(ctx context.Context) *Alert {
+	if alert, ok := ctx.Value(alertKey).(*Alert); ok {
+		return alert
+	}
+	return &Alert{Severity: SeverityInfo}
+}
+func SetCtxAlert(ctx context.Context, alert *Alert) context.Context {
+	return context.WithValue(ctx, alertKey, alert)
+}
@@ -0,0 +1,366 @@
+package msgbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+const authLogInterval = time.Minute
+
+var (
+	errAuthFailed   = errors.New("authentication failed")
+	errAuthBlocked  = errors.New("too many authentication failures")
+	errIPNotAllowed = errors.New("address not allowed")
+)
+
+// authFailure counts the failed attempts from an address within the lockout period.
+type authFailure struct {
+	count      int
+	first      time.Time
+	logged     time.Time
+	suppressed int
+}
+
+var authFailures = struct {
+	sync.Mutex
+	byIP map[string]*authFailure
+}{byIP: make(map[string]*authFailure)}
+
+// validateAuthConfig checks API key expiry dates and address allowlists.
+func validateAuthConfig(conf *config.Config) error {
+	if _, err := time.ParseDuration(conf.HTTP.AuthLockout); err != nil {
+		return fmt.Errorf("invalid auth lockout: %s", err)
+	}
+	if _, err := parseCIDRs(conf.HTTP.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted proxies: %s", err)
+	}
+
+	for id, route := range conf.Routes {
+		if _, err := parseCIDRs(route.AllowedIPs); err != nil {
+			return fmt.Errorf("route %s: %s", id, err)
+		}
+		for _, key := range route.APIKeys {
+			if key.Key == "" {
+				return fmt.Errorf("route %s: API key %s has no key", id, key.Name)
+			}
+			if _, err := parseExpiry(key.Expires); err != nil {
+				return fmt.Errorf("route %s: API key %s: %s", id, key.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCIDRs parses networks in CIDR notation. Single addresses are
+// treated as a network of one address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNetworks(ip net.IP, cidrs []string) bool {
+	nets, _ := parseCIDRs(cidrs)
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpiry parses an API key expiration. An empty string never expires.
+func parseExpiry(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration %s", s)
+	}
+	return t, nil
+}
+
+// clientIP returns the address of the client. When the connection comes from
+// a trusted proxy or a Unix socket, the address is taken from the
+// X-Forwarded-For header.
+func clientIP(conf *config.Config, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && !ipInNetworks(ip, conf.HTTP.TrustedProxies) {
+		return host
+	}
+
+	// Use the last address not added by a trusted proxy
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		fip := net.ParseIP(addr)
+		if fip == nil {
+			break
+		}
+		host = addr
+		if !ipInNetworks(fip, conf.HTTP.TrustedProxies) {
+			break
+		}
+	}
+
+	if host == "" || host == "@" {
+		return "unix"
+	}
+	return host
+}
+
+// authenticateRoute checks a request against the address allowlist, allowed
+// client certificates, and credentials of a route. Settings not set on the
+// route are taken from the default route.
+func authenticateRoute(conf *config.Config, routeID string, r *http.Request) error {
+	route := conf.Routes[routeID]
+	if route == nil {
+		return errAuthFailed
+	}
+	def := conf.Routes["default"]
+	if def == nil {
+		def = &config.RouteConfig{}
+	}
+
+	ip := clientIP(conf, r)
+	if authBlocked(conf, ip) {
+		return errAuthBlocked
+	}
+
+	allowed := route.AllowedIPs
+	if len(allowed) == 0 {
+		allowed = def.AllowedIPs
+	}
+	if len(allowed) > 0 && !ipInNetworks(net.ParseIP(ip), allowed) {
+		fmt.Printf("Request to route %s from %s rejected, address not allowed\n", routeID, ip)
+		return errIPNotAllowed
+	}
+
+	keys := route.APIKeys
+	if len(keys) == 0 {
+		keys = def.APIKeys
+	}
+
+	creds := &credentials{
+		username:     utils.FirstString(route.Username, def.Username),
+		password:     utils.FirstString(route.Password, def.Password),
+		apiKeys:      keys,
+		denyQueryKey: route.DenyQueryKey || def.DenyQueryKey,
+	}
+
+	if !creds.check(r) || !authenticateClientCert(conf, routeID, r) {
+		authFailuresTotal.Inc(routeID)
+		authFailed(conf, "route "+routeID, ip)
+		return errAuthFailed
+	}
+	return nil
+}
+
+// authenticateAdmin checks a request against the admin API credentials.
+func authenticateAdmin(conf *config.Config, r *http.Request) error {
+	ip := clientIP(conf, r)
+	if authBlocked(conf, ip) {
+		return errAuthBlocked
+	}
+
+	creds := &credentials{
+		username:     conf.HTTP.Admin.Username,
+		password:     conf.HTTP.Admin.Password,
+		denyQueryKey: true,
+	}
+	if !creds.check(r) {
+		authFailuresTotal.Inc("admin")
+		authFailed(conf, "admin API", ip)
+		return errAuthFailed
+	}
+	return nil
+}
+
+func writeAuthError(conf *config.Config, w http.ResponseWriter, err error) {
+	if err == errAuthBlocked {
+		lockout, _ := time.ParseDuration(conf.HTTP.AuthLockout)
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockout.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+}
+
+type credentials struct {
+	username     string
+	password     string
+	apiKeys      []config.APIKeyConfig
+	denyQueryKey bool
+}
+
+// check authenticates a request. API keys are sent as a bearer token. The
+// password is sent with basic auth when a username is set, otherwise as an
+// auth key in the Authorization header, as a bearer token, or in the authkey
+// parameter of the URL or a form encoded body.
+func (c *credentials) check(r *http.Request) bool {
+	if c.password == "" && len(c.apiKeys) == 0 { // No authentication configured
+		return true
+	}
+
+	authKeyOnly := c.username == "" || c.username == "-"
+	authHeader := r.Header.Get("Authorization")
+
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if c.checkAPIKey(token) {
+			return true
+		}
+		return authKeyOnly && c.password != "" && utils.CheckPassword(c.password, token)
+	}
+
+	if c.password == "" { // Only API keys configured
+		return false
+	}
+
+	if authKeyOnly {
+		if authHeader == "" { // No header, check authkey parameter
+			keyParam := authKeyParam(r)
+			if keyParam == "" || c.denyQueryKey {
+				return false
+			}
+			return utils.CheckPassword(c.password, keyParam)
+		}
+
+		header := strings.SplitN(authHeader, " ", 2)
+		if len(header) != 2 {
+			return false
+		}
+
+		if header[0] != "Authkey" {
+			return false
+		}
+		return utils.CheckPassword(c.password, header[1])
+	}
+
+	rusername, rpassword, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	return c.username == rusername && utils.CheckPassword(c.password, rpassword)
+}
+
+// authKeyParam returns the authkey parameter of the URL or a form encoded
+// body. The body is buffered so the handler can still read it, it must
+// already be limited in size.
+func authKeyParam(r *http.Request) string {
+	if key := r.URL.Query().Get("authkey"); key != "" {
+		return key
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodPost || !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return ""
+	}
+	if _, err := bufferBody(r); err != nil {
+		return ""
+	}
+	return r.PostForm.Get("authkey")
+}
+
+func (c *credentials) checkAPIKey(token string) bool {
+	now := time.Now()
+	for _, key := range c.apiKeys {
+		expires, err := parseExpiry(key.Expires)
+		if err != nil || (!expires.IsZero() && now.After(expires)) {
+			continue
+		}
+		if utils.CheckPassword(key.Key, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// authBlocked returns if an address has failed too many times.
+func authBlocked(conf *config.Config, ip string) bool {
+	lockout, _ := time.ParseDuration(conf.HTTP.AuthLockout)
+
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	f, exists := authFailures.byIP[ip]
+	return exists && time.Since(f.first) < lockout && f.count >= conf.HTTP.AuthFailures
+}
+
+// authFailed records a failed attempt. Failures from the same address are
+// logged at most once a minute.
+func authFailed(conf *config.Config, target, ip string) {
+	lockout, _ := time.ParseDuration(conf.HTTP.AuthLockout)
+	now := time.Now()
+
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	for addr, f := range authFailures.byIP {
+		if now.Sub(f.first) >= lockout {
+			delete(authFailures.byIP, addr)
+		}
+	}
+
+	f, exists := authFailures.byIP[ip]
+	if !exists {
+		f = &authFailure{first: now}
+		authFailures.byIP[ip] = f
+	}
+	f.count++
+
+	if now.Sub(f.logged) < authLogInterval && f.count != conf.HTTP.AuthFailures {
+		f.suppressed++
+		return
+	}
+
+	msg := fmt.Sprintf("Authentication failed for %s from %s", target, ip)
+	if f.suppressed > 0 {
+		msg += fmt.Sprintf(" (%d more failures since last message)", f.suppressed)
+	}
+	if f.count >= conf.HTTP.AuthFailures {
+		msg += fmt.Sprintf(", blocked for %s", lockout)
+	}
+	fmt.Println(msg)
+
+	f.logged = now
+	f.suppressed = 0
+}
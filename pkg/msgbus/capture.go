@@ -0,0 +1,500 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/storage"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+func init() {
+	RegisterAdminHandler("captures", handleCapturesAPI)
+}
+
+// Capture is a raw request received by a route. Credentials are removed
+// before the request is saved. The route's own credentials are replaced with
+// placeholders like REDACTED(settings.secret) so replays can put the current
+// values back.
+type Capture struct {
+	ID         string      `json:"id"`
+	Route      string      `json:"route"`
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// Replay is the result of running a captured request through its route's
+// handler. A saved Replay is a test fixture for the handler.
+type Replay struct {
+	Request  *Capture         `json:"request"`
+	Status   int              `json:"status"`
+	Error    string           `json:"error,omitempty"`
+	Messages []*ReplayMessage `json:"messages"`
+}
+
+// ReplayMessage is a message the handler dispatched during a dry run.
+type ReplayMessage struct {
+	Channels []string `json:"channels"`
+	Message  string   `json:"message"`
+}
+
+// replayRecorder collects dispatched messages instead of sending them.
+type replayRecorder struct {
+	sync.Mutex
+	messages []*ReplayMessage
+}
+
+func (r *replayRecorder) add(channels []string, msg string) {
+	r.Lock()
+	r.messages = append(r.messages, &ReplayMessage{Channels: channels, Message: msg})
+	r.Unlock()
+}
+
+var captureLock sync.Mutex
+
+func captureDir(conf *config.Config, routeID string) string {
+	return filepath.Join(conf.ModuleDataDir("captures"), routeID)
+}
+
+// captureRequest saves a request when the route has capturing enabled.
+// Only the most recent requests are kept. The body must already be buffered.
+func captureRequest(conf *config.Config, routeID, requestID string, r *http.Request, body []byte) {
+	keep := conf.Routes[routeID].Capture
+	if keep <= 0 {
+		return
+	}
+
+	secrets := routeSecrets(conf, routeID)
+	c := &Capture{
+		ID:         requestID,
+		Route:      routeID,
+		Time:       time.Now(),
+		Method:     r.Method,
+		URL:        redactSecrets(redactURL(r.URL), secrets),
+		RemoteAddr: r.RemoteAddr,
+		Header:     redactHeader(r.Header, secrets),
+		Body:       redactSecrets(redactBody(r.Header.Get("Content-Type"), body), secrets),
+	}
+
+	dir := captureDir(conf, routeID)
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fmt.Printf("Error capturing request %s: %s\n", requestID, err)
+		return
+	}
+
+	name := fmt.Sprintf("%d-%s.json", c.Time.UnixNano(), c.ID)
+	if err := utils.SavePrivateJSONFile(filepath.Join(dir, name), c); err != nil {
+		fmt.Printf("Error capturing request %s: %s\n", requestID, err)
+		return
+	}
+
+	files := captureFiles(dir)
+	for len(files) > keep {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// Headers that carry credentials. Other headers with names like these are
+// replaced with redacted unless they hold a credential of the route.
+var (
+	credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+	credentialNames   = []string{"auth", "token", "secret", "password", "key"}
+)
+
+const redacted = "REDACTED"
+
+// secretEncodings are the forms a credential is looked for in a request.
+var secretEncodings = map[string]func(string) string{
+	"":     func(s string) string { return s },
+	"json": jsonEscape,
+	"url":  url.QueryEscape,
+}
+
+func jsonEscape(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+// routeSecrets returns the credentials of a route that can be sent in its
+// requests by name: the password, API keys, and settings named like
+// credentials, such as the secret of git routes. Hashes are skipped, they're
+// never sent.
+func routeSecrets(conf *config.Config, routeID string) map[string]string {
+	secrets := make(map[string]string)
+	route := conf.Routes[routeID]
+	if route == nil {
+		return secrets
+	}
+	def := conf.Routes["default"]
+	if def == nil {
+		def = &config.RouteConfig{}
+	}
+
+	add := func(name, value string) {
+		if value != "" && !utils.IsPasswordHash(value) {
+			secrets[name] = value
+		}
+	}
+	add("password", utils.FirstString(route.Password, def.Password))
+	keys := route.APIKeys
+	if len(keys) == 0 {
+		keys = def.APIKeys
+	}
+	for _, key := range keys {
+		add("apikey."+key.Name, key.Key)
+	}
+	for name, value := range route.Settings {
+		if s, ok := value.(string); ok && credentialName(name) {
+			add("settings."+name, s)
+		}
+	}
+	return secrets
+}
+
+func credentialName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range credentialNames {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func secretPlaceholder(name, encoding string) string {
+	if encoding == "" {
+		return fmt.Sprintf("%s(%s)", redacted, name)
+	}
+	return fmt.Sprintf("%s(%s,%s)", redacted, name, encoding)
+}
+
+// redactSecrets replaces the credentials in s with placeholders.
+func redactSecrets(s string, secrets map[string]string) string {
+	type replacement struct{ old, new string }
+	var replacements []replacement
+	for name, value := range secrets {
+		for encoding, encode := range secretEncodings {
+			encoded := encode(value)
+			if encoding == "" || encoded != value {
+				replacements = append(replacements, replacement{encoded, secretPlaceholder(name, encoding)})
+			}
+		}
+	}
+	if len(replacements) == 0 {
+		return s
+	}
+
+	// Longest first so a credential containing another one is replaced whole
+	sort.Slice(replacements, func(i, j int) bool {
+		if len(replacements[i].old) != len(replacements[j].old) {
+			return len(replacements[i].old) > len(replacements[j].old)
+		}
+		return replacements[i].old < replacements[j].old
+	})
+	oldnew := make([]string, 0, 2*len(replacements))
+	for _, r := range replacements {
+		oldnew = append(oldnew, r.old, r.new)
+	}
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
+
+// restoreSecrets puts the current credentials of a route back into a
+// redacted capture.
+func restoreSecrets(s string, secrets map[string]string) string {
+	if !strings.Contains(s, redacted+"(") {
+		return s
+	}
+
+	var oldnew []string
+	for name, value := range secrets {
+		for encoding, encode := range secretEncodings {
+			oldnew = append(oldnew, secretPlaceholder(name, encoding), encode(value))
+		}
+	}
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
+
+func redactHeader(header http.Header, secrets map[string]string) http.Header {
+	redactedHeader := make(http.Header, len(header))
+	for key, values := range header {
+		if utils.StringInSlice(key, credentialHeaders) {
+			continue
+		}
+
+		redactedValues := make([]string, len(values))
+		for i, value := range values {
+			redactedValues[i] = redactSecrets(value, secrets)
+			if credentialName(key) && redactedValues[i] == value {
+				redactedValues[i] = redacted
+			}
+		}
+		redactedHeader[key] = redactedValues
+	}
+	return redactedHeader
+}
+
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if _, exists := q["authkey"]; !exists {
+		return u.RequestURI()
+	}
+	q.Del("authkey")
+
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.RequestURI()
+}
+
+func redactBody(contentType string, body []byte) string {
+	if !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return string(body)
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return string(body)
+	}
+	if _, exists := form["authkey"]; !exists {
+		return string(body)
+	}
+	form.Del("authkey")
+	return form.Encode()
+}
+
+// captureFiles returns the capture files in a directory, oldest first.
+func captureFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(files)
+	return files
+}
+
+// Captures returns the saved requests of a route, newest first.
+func Captures(conf *config.Config, routeID string) ([]*Capture, error) {
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	files := captureFiles(captureDir(conf, routeID))
+	captures := make([]*Capture, 0, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		var c Capture
+		if err := utils.LoadJSONFile(files[i], &c); err != nil {
+			return nil, err
+		}
+		captures = append(captures, &c)
+	}
+	return captures, nil
+}
+
+// GetCapture returns a saved request of a route.
+func GetCapture(conf *config.Config, routeID, id string) (*Capture, error) {
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	if id == "" || strings.ContainsAny(id, `/\*?[`) {
+		return nil, os.ErrNotExist
+	}
+	files, _ := filepath.Glob(filepath.Join(captureDir(conf, routeID), "*-"+id+".json"))
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	var c Capture
+	if err := utils.LoadJSONFile(files[0], &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ReplayCapture runs a captured request through the current handler and
+// settings of its route. Authentication and rate limits are skipped. Unless
+// send is true, dispatched messages are returned instead of sent.
+func ReplayCapture(conf *config.Config, c *Capture, send bool) (*Replay, error) {
+	route := conf.Routes[c.Route]
+	if route == nil {
+		return nil, fmt.Errorf("route %s not found", c.Route)
+	}
+	handler := busHandlers[utils.FirstString(route.Alias, c.Route)]
+	if handler == nil {
+		return nil, fmt.Errorf("route %s has no handler", c.Route)
+	}
+
+	secrets := routeSecrets(conf, c.Route)
+	r := httptest.NewRequest(c.Method, restoreSecrets(c.URL, secrets), strings.NewReader(restoreSecrets(c.Body, secrets)))
+	r.RemoteAddr = c.RemoteAddr
+	for key, values := range c.Header {
+		for _, value := range values {
+			r.Header.Add(key, restoreSecrets(value, secrets))
+		}
+	}
+	if _, err := bufferBody(r); err != nil {
+		return nil, err
+	}
+
+	requestID := newRequestID()
+	ctx := SetCtxRouteID(context.Background(), c.Route)
+	ctx = SetCtxConfig(ctx, conf)
+	ctx = SetCtxRequestID(ctx, requestID)
+
+	recorder := &replayRecorder{}
+	if !send {
+		ctx = setCtxReplay(ctx, recorder)
+		ctx = storage.WithMemory(ctx)
+	}
+
+	fmt.Printf("Replaying request %s to route %s as %s\n", c.ID, c.Route, requestID)
+	w := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	err := runBusHandler(ctx, handler, w, r)
+
+	recorder.Lock()
+	defer recorder.Unlock()
+	return &Replay{
+		Request:  c,
+		Status:   w.status(),
+		Error:    err,
+		Messages: recorder.messages,
+	}, nil
+}
+
+// VerifyFixture replays the request of a saved Replay and checks the handler
+// dispatches the same messages. It's meant for handler tests.
+func VerifyFixture(conf *config.Config, file string) error {
+	var expected Replay
+	if err := utils.LoadJSONFile(file, &expected); err != nil {
+		return err
+	}
+	if expected.Request == nil {
+		return errors.New("fixture has no request")
+	}
+
+	actual, err := ReplayCapture(conf, expected.Request, false)
+	if err != nil {
+		return err
+	}
+
+	if actual.Status != expected.Status {
+		return fmt.Errorf("expected status %d, got %d", expected.Status, actual.Status)
+	}
+	if len(actual.Messages) != len(expected.Messages) {
+		return fmt.Errorf("expected %d messages, got %d", len(expected.Messages), len(actual.Messages))
+	}
+	for i, m := range expected.Messages {
+		if !reflect.DeepEqual(m, actual.Messages[i]) {
+			return fmt.Errorf("message %d: expected %q to %v, got %q to %v",
+				i, m.Message, m.Channels, actual.Messages[i].Message, actual.Messages[i].Channels)
+		}
+	}
+	return nil
+}
+
+func handleCapturesAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	split := strings.Split(path, "/")
+	routeID := split[0]
+	if conf.Routes[routeID] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(split) == 1 || split[1] == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		captures, err := Captures(conf, routeID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, captures)
+		return
+	}
+
+	c, err := GetCapture(conf, routeID, split[1])
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	action := ""
+	if len(split) > 2 {
+		action = split[2]
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+
+	case "replay":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		replay, err := ReplayCapture(conf, c, r.FormValue("send") == "true")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, replay)
+
+	case "fixture": // A dry run saved as a file
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		replay, err := ReplayCapture(conf, c, false)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.json"`, routeID, c.ID))
+		writeJSON(w, http.StatusOK, replay)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// bufferBody reads the request body so it can be parsed as a form and still
+// be read by the handler, possibly after the request has finished.
+func bufferBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ParseForm()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
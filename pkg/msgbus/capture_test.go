@@ -0,0 +1,147 @@
+package msgbus
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+func init() {
+	RegisterMsgBus("test-counter", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		n, err := storage.Namespace("test-counter").In(ctx).Incr("count", 1)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		DispatchMessage(ctx, "Count: %d", n)
+	})
+}
+
+// testCaptureConfig returns a configuration with captures saved in a
+// temporary directory removed by the returned function.
+func testCaptureConfig(t *testing.T) (*config.Config, func()) {
+	dir, err := ioutil.TempDir("", "yobot-captures")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{Routes: map[string]*config.RouteConfig{
+		"gitea": {
+			Enabled:  true,
+			Alias:    "git",
+			Channels: []string{"Dev:commits"},
+			Password: "route-password",
+			Capture:  5,
+			Settings: map[string]interface{}{"secret": "hunter2", "token": "glt-a&b"},
+		},
+		"counter": {
+			Enabled:  true,
+			Alias:    "test-counter",
+			Channels: []string{"Dev:counts"},
+			Capture:  5,
+		},
+	}}
+	conf.Main.DataDir = dir
+	return conf, func() { os.RemoveAll(dir) }
+}
+
+func TestCaptureRedactsCredentials(t *testing.T) {
+	conf, cleanup := testCaptureConfig(t)
+	defer cleanup()
+
+	body := `{"secret":"hunter2","ref":"refs/heads/main","commits":[{"message":"Fix","committer":{"name":"Sam"}}],"repository":{"full_name":"noc/yobot"}}`
+	r := httptest.NewRequest(http.MethodPost, "/msgbus/gitea?authkey=route-password&token=glt-a%26b", strings.NewReader(body))
+	r.Header.Set("Authorization", "Authkey route-password")
+	r.Header.Set("X-Gitlab-Token", "glt-a&b")
+	r.Header.Set("X-Custom-Auth", "unknown-credential")
+	r.Header.Set("X-Gitea-Event", "push")
+	captureRequest(conf, "gitea", "0123456789abcdef", r, []byte(body))
+
+	files := captureFiles(captureDir(conf, "gitea"))
+	if len(files) != 1 {
+		t.Fatalf("got %d capture files, expected 1", len(files))
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("capture file has permissions %o, expected 600", perm)
+	}
+
+	saved, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "glt-a", "route-password", "unknown-credential", "Authorization"} {
+		if strings.Contains(string(saved), secret) {
+			t.Errorf("capture contains %q:\n%s", secret, saved)
+		}
+	}
+
+	c, err := GetCapture(conf, "gitea", "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Header.Get("X-Gitea-Event") != "push" {
+		t.Errorf("capture lost the X-Gitea-Event header: %v", c.Header)
+	}
+
+	// The replay gets the configured secret back
+	replay, err := ReplayCapture(conf, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.Status != http.StatusOK || len(replay.Messages) != 1 {
+		t.Errorf("replay got status %d and %d messages, expected 200 and 1", replay.Status, len(replay.Messages))
+	}
+}
+
+func TestReplayDryRunStorage(t *testing.T) {
+	conf, cleanup := testCaptureConfig(t)
+	defer cleanup()
+	storage.OpenMemory()
+	defer storage.Close()
+
+	c := &Capture{ID: "counter", Route: "counter", Method: http.MethodPost, URL: "/msgbus/counter"}
+	for i := 0; i < 2; i++ {
+		replay, err := ReplayCapture(conf, c, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(replay.Messages) != 1 || replay.Messages[0].Message != "Count: 1" {
+			t.Errorf("dry run %d dispatched %+v, expected Count: 1", i, replay.Messages)
+		}
+	}
+
+	var count int64
+	if found, err := storage.Namespace("test-counter").Get("count", &count); err != nil || found {
+		t.Errorf("dry runs changed the stored count to %d (%v)", count, err)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	conf, cleanup := testCaptureConfig(t)
+	defer cleanup()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+	for _, file := range files {
+		if err := VerifyFixture(conf, file); err != nil {
+			t.Errorf("%s: %s", file, err)
+		}
+	}
+}
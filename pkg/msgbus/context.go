@@ -13,6 +13,9 @@ const (
 	configKey contextKey = "config"
 	routeKey  contextKey = "route"
 	ircKey    contextKey = "irc"
+	alertKey  contextKey = "alert"
+	reqIDKey  contextKey = "requestID"
+	replayKey contextKey = "replay"
 )
 
 func GetCtxRouteID(ctx context.Context) string {
@@ -28,3 +31,26 @@ func GetCtxConfig(ctx context.Context) *config.Config {
 func SetCtxConfig(ctx context.Context, conf *config.Config) context.Context {
 	return context.WithValue(ctx, configKey, conf)
 }
+
+func GetCtxRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(reqIDKey).(string)
+	return id
+}
+func SetCtxRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, reqIDKey, id)
+}
+
+// IsDryRun returns if the request is a replayed capture whose messages are
+// recorded instead of sent. Stores used through In(ctx) keep their values in
+// memory during a dry run.
+func IsDryRun(ctx context.Context) bool {
+	return getCtxReplay(ctx) != nil
+}
+
+func getCtxReplay(ctx context.Context) *replayRecorder {
+	r, _ := ctx.Value(replayKey).(*replayRecorder)
+	return r
+}
+func setCtxReplay(ctx context.Context, r *replayRecorder) context.Context {
+	return context.WithValue(ctx, replayKey, r)
+}
@@ -0,0 +1,256 @@
+package msgbus
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const escalationCheckInterval = 15 * time.Second
+
+type escalationStep struct {
+	after   time.Duration
+	channel string
+	mention string
+	dm      string
+}
+
+// escalation tracks an unanswered alert. All posts of the same alert share
+// an escalation, a response to any of them stops it.
+type escalation struct {
+	Key      string    `json:"key"`
+	Policy   string    `json:"policy"`
+	Route    string    `json:"route"`
+	Channel  string    `json:"channel"`
+	PostIDs  []string  `json:"post_ids"`
+	Message  string    `json:"message"`
+	Started  time.Time `json:"started"`
+	NextStep int       `json:"next_step"`
+}
+
+var escalations = struct {
+	sync.Mutex
+	file   string
+	active map[string]*escalation
+}{active: make(map[string]*escalation)}
+
+// ParseEscalationPolicies compiles the escalation policies and checks that
+// routes only use defined policies.
+func ParseEscalationPolicies(conf *config.Config) (map[string][]*escalationStep, error) {
+	policies := make(map[string][]*escalationStep, len(conf.Escalation))
+	for name, ec := range conf.Escalation {
+		steps := make([]*escalationStep, len(ec.Steps))
+		for i, sc := range ec.Steps {
+			after, err := time.ParseDuration(sc.After)
+			if err != nil {
+				return nil, fmt.Errorf("escalation %s step %d: %s", name, i+1, err)
+			}
+			if sc.Channel == "" && sc.Mention == "" && sc.DM == "" {
+				return nil, fmt.Errorf("escalation %s step %d: step has no channel, mention, or dm", name, i+1)
+			}
+			if i > 0 && after < steps[i-1].after {
+				return nil, fmt.Errorf("escalation %s step %d: steps must be in order", name, i+1)
+			}
+
+			steps[i] = &escalationStep{
+				after:   after,
+				channel: sc.Channel,
+				mention: sc.Mention,
+				dm:      strings.TrimPrefix(sc.DM, "@"),
+			}
+		}
+		policies[name] = steps
+	}
+
+	for id, route := range conf.Routes {
+		if route.Escalation != "" && policies[route.Escalation] == nil {
+			return nil, fmt.Errorf("route %s uses undefined escalation %s", id, route.Escalation)
+		}
+	}
+	return policies, nil
+}
+
+func startEscalations(conf *config.Config, quit chan bool) error {
+	escalations.Lock()
+	escalations.file = filepath.Join(conf.Main.DataDir, "escalations.json")
+	err := utils.LoadJSONFile(escalations.file, &escalations.active)
+	escalations.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if b := bot.GetBot(); b != nil {
+		b.RegisterEventHandler(handleEscalationResponse, "*",
+			model.WEBSOCKET_EVENT_POSTED, model.WEBSOCKET_EVENT_REACTION_ADDED)
+	}
+
+	go func() {
+		ticker := time.NewTicker(escalationCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				runEscalations(time.Now())
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// saveEscalations must be called with the lock held.
+func saveEscalations() {
+	if escalations.file == "" {
+		return
+	}
+	if err := utils.SaveJSONFile(escalations.file, escalations.active); err != nil {
+		fmt.Printf("Failed saving escalations: %s\n", err)
+	}
+}
+
+// routeEscalation returns the escalation policy name of a route.
+func routeEscalation(conf *config.Config, route string) string {
+	policy := ""
+	if rc := conf.Routes[route]; rc != nil {
+		policy = rc.Escalation
+	}
+	if def := conf.Routes["default"]; def != nil {
+		policy = utils.FirstString(policy, def.Escalation)
+	}
+	return policy
+}
+
+// startEscalation begins escalating a newly posted alert if its route
+// has an escalation policy.
+func startEscalation(t *trackedAlert) {
+	conf := currentConfig()
+	if conf == nil {
+		return
+	}
+
+	policy := routeEscalation(conf, t.Route)
+	if len(escalationPolicy(policy)) == 0 {
+		return
+	}
+
+	key := t.PostID
+	if t.Alert.Fingerprint != "" {
+		key = t.Alert.Fingerprint
+	}
+
+	escalations.Lock()
+	defer escalations.Unlock()
+
+	if e, exists := escalations.active[key]; exists {
+		e.PostIDs = append(e.PostIDs, t.PostID)
+	} else {
+		escalations.active[key] = &escalation{
+			Key:     key,
+			Policy:  policy,
+			Route:   t.Route,
+			Channel: t.Channel,
+			PostIDs: []string{t.PostID},
+			Message: t.Message,
+			Started: time.Now(),
+		}
+	}
+	saveEscalations()
+}
+
+// stopEscalation stops the escalation that includes postID.
+func stopEscalation(postID string) {
+	escalations.Lock()
+	defer escalations.Unlock()
+
+	for key, e := range escalations.active {
+		if utils.StringInSlice(postID, e.PostIDs) {
+			delete(escalations.active, key)
+			saveEscalations()
+			return
+		}
+	}
+}
+
+// stopEscalationFingerprint stops the escalation of an alert when it recovers.
+func stopEscalationFingerprint(fingerprint string) {
+	escalations.Lock()
+	defer escalations.Unlock()
+
+	if _, exists := escalations.active[fingerprint]; exists {
+		delete(escalations.active, fingerprint)
+		saveEscalations()
+	}
+}
+
+func handleEscalationResponse(event *model.WebSocketEvent) {
+	b := bot.GetBot()
+
+	switch event.Event {
+	case model.WEBSOCKET_EVENT_POSTED:
+		post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+		if post == nil || post.RootId == "" || post.UserId == b.UserID {
+			return
+		}
+		stopEscalation(post.RootId)
+
+	case model.WEBSOCKET_EVENT_REACTION_ADDED:
+		data, _ := event.Data["reaction"].(string)
+		reaction := model.ReactionFromJson(strings.NewReader(data))
+		if reaction == nil || reaction.UserId == b.UserID {
+			return
+		}
+		stopEscalation(reaction.PostId)
+	}
+}
+
+// runEscalations takes all escalation steps that are due.
+func runEscalations(now time.Time) {
+	escalations.Lock()
+	defer escalations.Unlock()
+
+	changed := false
+	for key, e := range escalations.active {
+		steps := escalationPolicy(e.Policy)
+
+		for e.NextStep < len(steps) && now.Sub(e.Started) >= steps[e.NextStep].after {
+			steps[e.NextStep].run(e)
+			e.NextStep++
+			changed = true
+		}
+
+		if e.NextStep >= len(steps) {
+			delete(escalations.active, key)
+			changed = true
+		}
+	}
+
+	if changed {
+		saveEscalations()
+	}
+}
+
+func (s *escalationStep) run(e *escalation) {
+	summary := fmt.Sprintf("Nobody has responded to this alert from **%s** for %s.", e.Route, s.after)
+
+	if s.channel != "" {
+		enqueueMessage(s.channel, fmt.Sprintf("### Escalation\n\n%s\n\n%s", summary, e.Message), "", nil)
+	}
+
+	if s.mention != "" && len(e.PostIDs) > 0 {
+		msg := filterMessage(e.Route, fmt.Sprintf("%s %s", s.mention, summary))
+		SendMessage(e.Channel, msg, e.PostIDs[0])
+	}
+
+	if s.dm != "" {
+		enqueueMessage("@"+s.dm, fmt.Sprintf("### Escalation\n\n%s\n\n%s", summary, e.Message), "", nil)
+	}
+}
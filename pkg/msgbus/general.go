@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/lfkeitel/yobot/pkg/utils"
 )
 
 func init() {
@@ -12,8 +15,11 @@ func init() {
 }
 
 type genericAlert struct {
-	Title   string `json:"title"`
-	Message string `json:"message"`
+	Title       string `json:"title"`
+	Message     string `json:"message"`
+	Host        string `json:"host"`
+	Severity    string `json:"severity"`
+	Fingerprint string `json:"fingerprint"`
 }
 
 func handleGeneral(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -25,6 +31,12 @@ func handleGeneral(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	ctx = SetCtxAlert(ctx, &Alert{
+		Host:        alert.Host,
+		Severity:    strings.ToLower(utils.StringOrDefault(alert.Severity, SeverityInfo)),
+		Fingerprint: alert.Fingerprint,
+	})
+
 	DispatchMessage(ctx, "%s - %s", alert.Title, alert.Message)
 	w.Write([]byte(`{"accepted": true}`))
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -42,14 +43,23 @@ func handleGrafana(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	severity := SeverityInfo
 	switch alert.State {
 	case "ok":
 		alert.Title = strings.Replace(alert.Title, "[OK]", grafanaEmojiOK, 1)
+		severity = SeverityRecovery
 	case "alerting":
 		alert.Title = strings.Replace(alert.Title, "[Alerting]", grafanaEmojiAlerting, 1)
+		severity = SeverityCritical
 	case "no_data":
 		alert.Title = strings.Replace(alert.Title, "[No Data]", grafanaEmojiNoData, 1)
+		severity = SeverityWarning
 	}
+	ctx = SetCtxAlert(ctx, &Alert{
+		Severity:    severity,
+		ID:          strconv.Itoa(alert.RuleID),
+		Fingerprint: fmt.Sprintf("%s:%d", GetCtxRouteID(ctx), alert.RuleID),
+	})
 
 	DispatchMessage(ctx, "### Grafana\n\n**%s** - %s", alert.Title, alert.Message)
 	w.Write([]byte(`{"accepted": true}`))
@@ -0,0 +1,96 @@
+package msgbus
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/health"
+)
+
+func init() {
+	RegisterMuxHandler("/healthz", healthHandler(false))
+	RegisterMuxHandler("/readyz", healthHandler(true))
+
+	bot.RegisterCommand("health", &bot.Command{
+		Help:    "Show the health of Yobot's components: health",
+		Handler: healthCmd,
+	})
+}
+
+// registerLibreNMSCheck checks the LibreNMS API when a LibreNMS route has
+// an API address configured. It's called again when the configuration is
+// reloaded.
+func registerLibreNMSCheck(conf *config.Config) {
+	for id, route := range conf.Routes {
+		if !routeEnabled(conf, id) || (id != "librenms" && route.Alias != "librenms") {
+			continue
+		}
+		if _, ok := route.Settings["address"].(string); !ok {
+			continue
+		}
+
+		route := route
+		health.RegisterCheck("librenms", false, func() error {
+			client, err := getLibreNMSClient(route)
+			if err != nil {
+				return err
+			}
+			_, err = client.System()
+			return err
+		})
+		return
+	}
+	health.RemoveCheck("librenms")
+}
+
+// healthHandler returns the health report. Liveness fails only when a
+// required component is down, readiness fails when any component is down.
+func healthHandler(readiness bool) MuxHandler {
+	return func(conf *config.Config) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			report := health.Run()
+			ok := report.Healthy
+			if readiness {
+				ok = report.Ready
+			}
+
+			code := http.StatusOK
+			if !ok {
+				code = http.StatusServiceUnavailable
+			}
+			writeJSON(w, code, report)
+		}
+	}
+}
+
+func healthCmd(b *bot.Bot, event *bot.CommandEvent) error {
+	report := health.Run()
+
+	var msg strings.Builder
+	switch {
+	case !report.Healthy:
+		msg.WriteString("Yobot is **unhealthy**\n\n")
+	case !report.Ready:
+		msg.WriteString("Yobot is **not ready**\n\n")
+	default:
+		msg.WriteString("Yobot is **healthy**\n\n")
+	}
+
+	msg.WriteString("| Component | Status | Time | Error |\n|:---|:---|:---|:---|\n")
+	for _, r := range report.Checks {
+		status := r.Status
+		if r.Status != health.StatusOK && r.Required {
+			status += " (required)"
+		}
+		fmt.Fprintf(&msg, "| %s | %s | %s | %s |\n", r.Name, status, r.Duration, strings.Replace(r.Error, "|", "\\|", -1))
+	}
+	return b.Reply(event.Post, msg.String())
+}
@@ -2,25 +2,32 @@ package msgbus
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/lfkeitel/yobot/pkg/bot"
 	"github.com/lfkeitel/yobot/pkg/config"
-	"github.com/lfkeitel/yobot/pkg/utils"
 )
 
 type BusHandler func(context.Context, http.ResponseWriter, *http.Request)
 type MuxHandler func(*config.Config) http.HandlerFunc
 
+// MessageFilter can rewrite a message from a route before it's posted.
+type MessageFilter func(route, msg string) string
+
 var (
 	busHandlers = map[string]BusHandler{}
 	muxHandlers = map[string]MuxHandler{
 		"/msgbus/": msgbusHandler,
 	}
+	messageFilters []MessageFilter
 )
 
 func RegisterMsgBus(id string, handler BusHandler) {
@@ -37,20 +44,67 @@ func RegisterMuxHandler(path string, handler MuxHandler) {
 	muxHandlers[path] = handler
 }
 
+// RegisterMessageFilter adds a filter applied to all dispatched messages.
+func RegisterMessageFilter(filter MessageFilter) {
+	messageFilters = append(messageFilters, filter)
+}
+
+func filterMessage(route, msg string) string {
+	for _, filter := range messageFilters {
+		msg = filter(route, msg)
+	}
+	return msg
+}
+
 func Start(conf *config.Config, quit, done chan bool) error {
-	ready := make(chan bool)
-	go start(conf, quit, done, ready)
-	<-ready
+	if err := applyConfig(conf); err != nil {
+		return err
+	}
+
+	if err := loadMaintenanceWindows(conf); err != nil {
+		return err
+	}
+
+	if err := startQueue(conf, quit); err != nil {
+		return err
+	}
+
+	if err := startAlertTracking(conf); err != nil {
+		return err
+	}
+
+	if err := startEscalations(conf, quit); err != nil {
+		return err
+	}
+
+	if err := startQuietHours(conf, quit); err != nil {
+		return err
+	}
+
+	listeners, err := openListeners(conf)
+	if err != nil {
+		return err
+	}
+
+	reloadOnHangup(quit)
+	registerLibreNMSCheck(conf)
+	startWorkers(conf, quit)
+	start(conf, listeners, quit, done)
 	return nil
 }
 
-func start(conf *config.Config, quit, done, ready chan bool) {
+func start(conf *config.Config, listeners []net.Listener, quit, done chan bool) {
+	// Handlers get the current configuration on every request so they
+	// pick up reloads.
 	mux := http.NewServeMux()
 	for path, handler := range muxHandlers {
-		mux.HandleFunc(path, handler(conf))
+		handler := handler
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			handler(currentConfig())(w, r)
+		})
 	}
 
-	server := &http.Server{Addr: conf.HTTP.Address, Handler: mux}
+	server := &http.Server{Handler: mux}
 
 	go func() {
 		<-quit
@@ -60,21 +114,54 @@ func start(conf *config.Config, quit, done, ready chan bool) {
 	}()
 
 	fmt.Println("Starting HTTP server")
-	close(ready)
-	if err := server.ListenAndServe(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	for _, l := range listeners {
+		fmt.Printf("Listening on %s\n", l.Addr())
+		go func(l net.Listener) {
+			if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}(l)
 	}
 }
 
+// errBodyTooLarge is returned reading a request body over the size limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxBytesBody is a request body limited by http.MaxBytesReader, which also
+// closes the connection, that returns errBodyTooLarge over the limit.
+type maxBytesBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// limitBody limits reading the request body to n bytes.
+func limitBody(w http.ResponseWriter, r *http.Request, n int64) {
+	r.Body = &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, n), remaining: n}
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if err != nil && err != io.EOF && b.remaining <= 0 {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
 func msgbusHandler(conf *config.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w := &statusWriter{ResponseWriter: rw}
+		metricsRoute := "unknown" // Unknown routes aren't labeled by name
+		defer func() {
+			requestsTotal.Inc(metricsRoute, strconv.Itoa(w.status()))
+		}()
+
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
-		r.ParseForm()
 		if strings.Count(r.URL.Path, "/") < 2 {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -84,68 +171,90 @@ func msgbusHandler(conf *config.Config) http.HandlerFunc {
 
 		handlerID := split[2] // Used to look up route handler
 		routeID := handlerID  // Used to look up route attributes from config
-		fmt.Printf("Handler: %s, Alias: %s\n", handlerID, conf.Routes[handlerID].Alias)
+		route := conf.Routes[routeID]
+		if route == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		metricsRoute = routeID
+		fmt.Printf("Handler: %s, Alias: %s\n", handlerID, route.Alias)
 
-		if conf.Routes[handlerID].Alias != "" {
-			handlerID = conf.Routes[handlerID].Alias
+		if route.Alias != "" {
+			handlerID = route.Alias
 		}
 
 		handler := busHandlers[handlerID]
-		if handler == nil || !conf.Routes[routeID].Enabled {
-			if !conf.Routes[routeID].Enabled {
+		enabled := routeEnabled(conf, routeID)
+		if handler == nil || !enabled {
+			if !enabled {
 				fmt.Printf("Handler %s is disabled\n", routeID)
 			}
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		ctx := SetCtxRouteID(context.Background(), routeID)
-		ctx = SetCtxConfig(ctx, conf)
+		// The body is only read once the request is allowed, except for
+		// an authkey in a form
+		limitBody(w, r, conf.HTTP.MaxBodyBytes)
+		if err := authenticateRoute(conf, routeID, r); err != nil {
+			writeAuthError(conf, w, err)
+			return
+		}
 
-		username := utils.FirstString(conf.Routes[routeID].Username, conf.Routes["default"].Username)
-		password := utils.FirstString(conf.Routes[routeID].Password, conf.Routes["default"].Password)
+		if ok, wait := checkRateLimit(conf, routeID, r); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
 
-		if !authenticateHandler(username, password, r) {
-			w.WriteHeader(http.StatusForbidden)
+		body, err := bufferBody(r)
+		if err != nil {
+			if err == errBodyTooLarge {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
 			return
 		}
 
-		handler(ctx, w, r)
-	}
-}
+		requestID := newRequestID()
+		w.Header().Set("X-Request-ID", requestID)
+		captureRequest(conf, routeID, requestID, r, body)
 
-func authenticateHandler(username, password string, r *http.Request) bool {
-	if password == "" { // No authentication configured
-		return true
-	}
+		ctx := SetCtxRouteID(context.Background(), routeID)
+		ctx = SetCtxConfig(ctx, conf)
+		ctx = SetCtxRequestID(ctx, requestID)
 
-	if username == "" || username == "-" { // authkey authentication
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" { // No header, check authkey parameter
-			keyParam := r.FormValue("authkey")
-			if keyParam == "" {
-				return false
-			}
-			return keyParam == password
+		async := route.Async
+		if def := conf.Routes["default"]; def != nil {
+			async = async || def.Async
 		}
 
-		header := strings.SplitN(authHeader, " ", 2)
-		if len(header) != 2 {
-			return false
+		if !async {
+			status := trackRequest(requestID, routeID, RequestProcessing)
+			err := runBusHandler(ctx, handler, w, r)
+			status.finish(w.status(), err)
+			return
 		}
 
-		if header[0] != "Authkey" {
-			return false
+		job := &busJob{
+			ctx:     ctx,
+			handler: handler,
+			r:       r.WithContext(context.Background()),
+			status:  trackRequest(requestID, routeID, RequestQueued),
 		}
-		return header[1] == password
-	}
 
-	rusername, rpassword, ok := r.BasicAuth()
-	if !ok {
-		return false
+		if !queueJob(job) {
+			job.status.finish(http.StatusServiceUnavailable, "request backlog is full")
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"accepted":   true,
+			"request_id": requestID,
+		})
 	}
-	// This isn't meant to be sophisticated, just something simple
-	return (username == rusername) && (password == rpassword)
 }
 
 // TestMsgBusHandler will print the body of a request and the URL parameters
@@ -158,25 +267,76 @@ func TestMsgBusHandler(ctx context.Context, w http.ResponseWriter, r *http.Reque
 
 // DispatchMessage will send a post to the appropriate channels
 // based on the message's source bus. The Context must have route and
-// conf key.
+// conf key. Messages are muted by matching maintenance windows and
+// non-critical messages are held during quiet hours. Messages are
+// delivered asynchronously from a persistent queue.
 func DispatchMessage(ctx context.Context, f string, a ...interface{}) {
-	conf := GetCtxConfig(ctx)
-	source := GetCtxRouteID(ctx)
+	channels := routeChannels(GetCtxConfig(ctx), GetCtxRouteID(ctx))
+	DispatchMessageToChannels(ctx, channels, fmt.Sprintf(f, a...))
+}
+
+// routeChannels returns the channels messages from a route are sent to.
+func routeChannels(conf *config.Config, routeID string) []string {
+	var def, route []string
+	if r := conf.Routes["default"]; r != nil {
+		def = r.Channels
+	}
+	override := false
+	if r := conf.Routes[routeID]; r != nil {
+		route = r.Channels
+		override = r.ChannelOverride
+	}
 
-	channels := conf.Routes["default"].Channels
+	channels := make([]string, 0, len(def)+len(route))
 	// Channel override means use the route's channel setting exclusively
-	if conf.Routes[source].ChannelOverride {
-		channels = conf.Routes[source].Channels
-	} else {
-		channels = append(channels, conf.Routes[source].Channels...)
+	if !override {
+		channels = append(channels, def...)
 	}
+	return append(channels, route...)
+}
+
+// DispatchMessageToChannels sends a message to specific channels instead of
+// the route's configured channels. Maintenance windows and quiet hours still
+// apply. The Context must have route and conf key.
+func DispatchMessageToChannels(ctx context.Context, channels []string, msg string) {
+	source := GetCtxRouteID(ctx)
+	alert := GetCtxAlert(ctx)
+
+	if replay := getCtxReplay(ctx); replay != nil { // Dry run
+		replay.add(channels, filterMessage(source, msg))
+		return
+	}
+
+	if alert.Severity == SeverityRecovery && alert.Fingerprint != "" {
+		stopEscalationFingerprint(alert.Fingerprint)
+	}
+
+	dispatch := &Dispatch{
+		Time:      time.Now(),
+		Route:     source,
+		RequestID: GetCtxRequestID(ctx),
+		Message:   msg,
+	}
+	defer recordDispatch(dispatch)
+
+	if w := activeMaintenance(source, alert.Host); w != nil {
+		dispatch.MutedBy = w.ID
+		messagesMuted.Inc(source)
+		fmt.Printf("Message from %s muted by maintenance window %d\n", source, w.ID)
+		return
+	}
+
+	msg = filterMessage(source, msg)
 
-	msg := fmt.Sprintf(f, a...)
-	b := bot.GetBot()
 	for _, channel := range channels {
-		if err := b.SendMsgTeamChannel(channel, msg); err != nil {
-			fmt.Println(err)
+		if holdMessage(source, channel, msg, alert) {
+			dispatch.Held = append(dispatch.Held, channel)
+			messagesHeld.Inc(channel)
+			continue
 		}
+		dispatch.Channels = append(dispatch.Channels, channel)
+		messagesDispatched.Inc(channel)
+		enqueueMessage(channel, msg, source, alert)
 	}
 }
 
@@ -6,19 +6,22 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/lfkeitel/yobot/librenms"
-	"github.com/lfkeitel/yobot/pkg/bot"
 	"github.com/lfkeitel/yobot/pkg/config"
 	"github.com/lfkeitel/yobot/pkg/utils"
 )
 
 func init() {
 	RegisterMsgBus("librenms", handleLibreNMS)
+	RegisterAlertActionHandler("librenms", libreNMSAlertAction)
 }
 
 var (
+	libreNMSLock   sync.Mutex
 	libreNMSClient *librenms.Client
 
 	routeRegexs = make(map[string][]contact, 1)
@@ -45,6 +48,21 @@ func handleLibreNMS(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	// Let the client go on its merry way. We have everything we need now.
 	w.Write([]byte(`{"accepted": true}`))
 
+	routeID := GetCtxRouteID(ctx)
+	alert := &Alert{
+		Severity: strings.ToLower(alertSeverity),
+		ID:       r.Form.Get("id"),
+	}
+	if alertHost != "%HOST%" {
+		alert.Host = alertHost
+	}
+	if alert.ID != "" {
+		alert.Fingerprint = routeID + ":" + alert.ID
+	} else if alert.Host != "" {
+		alert.Fingerprint = routeID + ":" + alert.Host
+	}
+	ctx = SetCtxAlert(ctx, alert)
+
 	// Add emojis to the alerts for added emphasis
 	switch alertSeverity {
 	case "CRITICAL":
@@ -70,19 +88,15 @@ func handleLibreNMS(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	conf := GetCtxConfig(ctx)
-	routeID := GetCtxRouteID(ctx)
 	routeConfig := conf.Routes[routeID]
 
+	libreNMSLock.Lock()
 	contactRoutes, exists := routeRegexs[routeID]
 	if !exists {
 		makeRouteMatches(routeID, routeConfig)
-
-		contactRoutes, exists = routeRegexs[routeID]
-		if !exists {
-			DispatchMessage(ctx, msg)
-			return
-		}
+		contactRoutes = routeRegexs[routeID]
 	}
+	libreNMSLock.Unlock()
 
 	if contactRoutes == nil {
 		DispatchMessage(ctx, msg)
@@ -90,12 +104,13 @@ func handleLibreNMS(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	// Custom message routing
-	if err := setupLibreNMSClient(routeConfig); err != nil {
+	client, err := getLibreNMSClient(routeConfig)
+	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
 
-	dev, err := libreNMSClient.GetDevice(alertHost)
+	dev, err := client.GetDevice(alertHost)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -113,69 +128,118 @@ func handleLibreNMS(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	b := bot.GetBot()
+	var channels []string
 	for _, c := range contactRoutes {
 		if c.match.MatchString(dev.SysContact) {
-			if err := b.SendMsgTeamChannel(c.channel, msg); err != nil {
-				fmt.Println(err)
-			}
+			channels = append(channels, c.channel)
 		}
 	}
+	DispatchMessageToChannels(ctx, channels, msg)
 }
 
+// libreNMSAlertAction acknowledges alerts in LibreNMS when they're acknowledged
+// or silenced in chat. The route must have the ack_upstream setting and alerts
+// must include their alert ID.
+func libreNMSAlertAction(conf *config.Config, route string, alert *Alert, action, user string) error {
+	routeConfig := conf.Routes[route]
+	if ackUpstream, ok := routeConfig.Settings["ack_upstream"].(bool); !ok || !ackUpstream {
+		return nil
+	}
+
+	if action != ActionAcknowledge && action != ActionSilence {
+		return nil
+	}
+
+	id, err := strconv.Atoi(alert.ID)
+	if err != nil {
+		return nil // No alert ID sent by LibreNMS
+	}
+
+	client, err := getLibreNMSClient(routeConfig)
+	if err != nil {
+		return err
+	}
+	return client.AckAlert(id)
+}
+
+// makeRouteMatches must be called with libreNMSLock held.
 func makeRouteMatches(id string, rc *config.RouteConfig) {
-	contactRoutes, exists := rc.Settings["routes"].(map[string]interface{})
-	if !exists {
-		routeRegexs[id] = nil
-		return
+	contacts, errs := parseContactRoutes(rc.Settings["routes"])
+	for _, err := range errs {
+		fmt.Printf("Route %s: %s\n", id, err)
 	}
+	routeRegexs[id] = contacts
+}
 
+// parseContactRoutes compiles the routes setting of a LibreNMS route. Invalid
+// entries are skipped and returned as errors.
+func parseContactRoutes(setting interface{}) ([]contact, []error) {
+	if setting == nil {
+		return nil, nil
+	}
+	contactRoutes, ok := setting.(map[string]interface{})
+	if !ok {
+		return nil, []error{errors.New("routes must be a table of sysContact patterns to channels")}
+	}
+
+	var errs []error
 	contacts := make([]contact, 0, len(contactRoutes))
 	for email, channel := range contactRoutes {
 		if len(email) == 0 {
 			continue
 		}
+		pattern := email
 
-		if email == "*" { // Match everything
-			email = ".*"
-		} else if email[0] != '/' { // No forward slash prefix means literal string
-			email = regexp.QuoteMeta(email)
+		if pattern == "*" { // Match everything
+			pattern = ".*"
+		} else if pattern[0] != '/' { // No forward slash prefix means literal string
+			pattern = regexp.QuoteMeta(pattern)
 		} else {
 			// Must be enclosed in forward slash
-			if email[len(email)-1] != '/' {
-				fmt.Printf("Invalid regex: %s\n", email)
+			if len(pattern) < 2 || pattern[len(pattern)-1] != '/' {
+				errs = append(errs, fmt.Errorf("invalid regex %s: missing closing slash", email))
 				continue
 			}
 
-			email = email[1 : len(email)-1] // Chop off /.../
+			pattern = pattern[1 : len(pattern)-1] // Chop off /.../
 		}
 
-		r, err := regexp.Compile(email)
+		r, err := regexp.Compile(pattern)
 		if err != nil {
-			fmt.Printf("Invalid regex: %s\n", email)
+			errs = append(errs, fmt.Errorf("invalid regex %s: %s", email, err))
 			continue
 		}
 
-		c := contact{channel: channel.(string), match: r}
-		contacts = append(contacts, c)
+		ch, ok := channel.(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("channel for %s must be a string", email))
+			continue
+		}
+
+		contacts = append(contacts, contact{channel: ch, match: r})
 	}
 
-	routeRegexs[id] = contacts
+	return contacts, errs
 }
 
-func setupLibreNMSClient(conf *config.RouteConfig) error {
+// getLibreNMSClient returns the LibreNMS API client, logging in the first
+// time it's used.
+func getLibreNMSClient(conf *config.RouteConfig) (*librenms.Client, error) {
+	libreNMSLock.Lock()
+	defer libreNMSLock.Unlock()
+
 	if libreNMSClient != nil {
-		return nil
+		return libreNMSClient, nil
 	}
 
 	address, ok := conf.Settings["address"].(string)
 	if !ok {
-		return errors.New("bad LibreNMS address")
+		return nil, errors.New("bad LibreNMS address")
 	}
 
 	c, err := librenms.NewClient(address)
 	if err != nil {
-		return errors.New("bad LibreNMS address")
+		return nil, errors.New("bad LibreNMS address")
 	}
 
 	skipVerify, ok := conf.Settings["skip_verify"].(bool)
@@ -185,13 +249,24 @@ func setupLibreNMSClient(conf *config.RouteConfig) error {
 
 	token, ok := conf.Settings["apitoken"].(string)
 	if !ok {
-		return errors.New("bad LibreNMS apitoken")
+		return nil, errors.New("bad LibreNMS apitoken")
 	}
 
 	if err := c.Login(token); err != nil {
-		return err
+		return nil, err
 	}
 
 	libreNMSClient = c
-	return nil
+	return c, nil
+}
+
+// flushLibreNMSCache forgets the compiled contact routes and API client.
+func flushLibreNMSCache() int {
+	libreNMSLock.Lock()
+	defer libreNMSLock.Unlock()
+
+	n := len(routeRegexs)
+	routeRegexs = make(map[string][]contact, 1)
+	libreNMSClient = nil
+	return n
 }
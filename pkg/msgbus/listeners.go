@@ -0,0 +1,193 @@
+package msgbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+// certificates holds the TLS certificate and client CA pool so they can be
+// reloaded without restarting the listeners.
+type certificates struct {
+	sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// tlsCerts is set when a TLS listener is open.
+var tlsCerts *certificates
+
+func (c *certificates) load(conf *config.TLSConfig) error {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return errors.New("TLS listener requires a certificate and key file")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed loading TLS certificate: %s", err)
+	}
+
+	var pool *x509.CertPool
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed loading client CA: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", conf.ClientCAFile)
+		}
+	}
+
+	c.Lock()
+	c.cert = &cert
+	c.clientCA = pool
+	c.Unlock()
+	return nil
+}
+
+func (c *certificates) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// getConfigForClient returns a config with the current client CA pool.
+// Client certificates are optional at the TLS layer, routes decide if
+// they're required.
+func (c *certificates) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.RLock()
+	pool := c.clientCA
+	c.RUnlock()
+
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if pool != nil {
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// openListeners opens the HTTP address and all extra listen addresses.
+func openListeners(conf *config.Config) ([]net.Listener, error) {
+	addresses := make([]string, 0, len(conf.HTTP.Listen)+1)
+	if conf.HTTP.Address != "" {
+		addresses = append(addresses, conf.HTTP.Address)
+	}
+	addresses = append(addresses, conf.HTTP.Listen...)
+	if len(addresses) == 0 {
+		return nil, errors.New("no HTTP listen addresses configured")
+	}
+
+	var certs *certificates
+	listeners := make([]net.Listener, 0, len(addresses))
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, address := range addresses {
+		var l net.Listener
+		var err error
+
+		switch {
+		case strings.HasPrefix(address, "unix://"):
+			l, err = listenUnix(strings.TrimPrefix(address, "unix://"), conf.HTTP.SocketMode)
+
+		case strings.HasPrefix(address, "tls://"):
+			if certs == nil {
+				certs = &certificates{}
+				if err = certs.load(&conf.HTTP.TLS); err != nil {
+					break
+				}
+			}
+
+			l, err = net.Listen("tcp", strings.TrimPrefix(address, "tls://"))
+			if err == nil {
+				l = tls.NewListener(l, &tls.Config{GetConfigForClient: certs.getConfigForClient})
+			}
+
+		default:
+			l, err = net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+		}
+
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed listening on %s: %s", address, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	tlsCerts = certs
+	return listeners, nil
+}
+
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %s", mode)
+	}
+
+	// Remove a socket left behind by an unclean shutdown
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// authenticateClientCert checks a request has a verified client certificate
+// allowed by the route. Routes without ClientCerts, or the default route's
+// ClientCerts, don't require a certificate. An allowed name of "*" accepts
+// any verified certificate.
+func authenticateClientCert(conf *config.Config, routeID string, r *http.Request) bool {
+	var allowed []string
+	if route := conf.Routes[routeID]; route != nil {
+		allowed = route.ClientCerts
+	}
+	if def := conf.Routes["default"]; len(allowed) == 0 && def != nil {
+		allowed = def.ClientCerts
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if utils.StringInSlice("*", allowed) || utils.StringInSlice(cert.Subject.CommonName, allowed) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if utils.StringInSlice(name, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package msgbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+func init() {
+	RegisterAdminHandler("maintenance", handleMaintenanceAPI)
+
+	bot.RegisterCommand("maint", &bot.Command{
+		Help:    "Manage maintenance windows: maint list | maint add DURATION [route=NAME,...] [host=PATTERN,...] [REASON] | maint end ID",
+		Handler: maintenanceCmd,
+	})
+}
+
+// A MaintenanceWindow mutes messages from matching routes and hosts.
+// Host patterns use shell glob syntax. An empty list matches everything.
+type MaintenanceWindow struct {
+	ID        int       `json:"id"`
+	Routes    []string  `json:"routes"`
+	Hosts     []string  `json:"hosts"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// Matches returns if the window mutes a message from route about host at time t.
+func (m *MaintenanceWindow) Matches(route, host string, t time.Time) bool {
+	if t.Before(m.Start) || !t.Before(m.End) {
+		return false
+	}
+
+	if len(m.Routes) > 0 && !utils.StringInSlice(route, m.Routes) {
+		return false
+	}
+
+	if len(m.Hosts) == 0 {
+		return true
+	}
+	if host == "" {
+		return false
+	}
+
+	for _, pattern := range m.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MaintenanceWindow) String() string {
+	s := fmt.Sprintf("#%d until %s", m.ID, m.End.Format(time.RFC1123))
+	if len(m.Routes) > 0 {
+		s += " routes: " + strings.Join(m.Routes, ", ")
+	}
+	if len(m.Hosts) > 0 {
+		s += " hosts: " + strings.Join(m.Hosts, ", ")
+	}
+	if m.Reason != "" {
+		s += " - " + m.Reason
+	}
+	return s
+}
+
+type maintenanceStore struct {
+	sync.Mutex
+	file    string
+	NextID  int                  `json:"next_id"`
+	Windows []*MaintenanceWindow `json:"windows"`
+}
+
+var maintenance = &maintenanceStore{NextID: 1}
+
+func loadMaintenanceWindows(conf *config.Config) error {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	maintenance.file = filepath.Join(conf.Main.DataDir, "maintenance.json")
+	return utils.LoadJSONFile(maintenance.file, maintenance)
+}
+
+// save must be called with the lock held.
+func (s *maintenanceStore) save() {
+	if s.file == "" {
+		return
+	}
+	if err := utils.SaveJSONFile(s.file, s); err != nil {
+		fmt.Printf("Failed saving maintenance windows: %s\n", err)
+	}
+}
+
+// prune removes expired windows. It must be called with the lock held.
+func (s *maintenanceStore) prune(now time.Time) {
+	windows := s.Windows[:0]
+	for _, w := range s.Windows {
+		if now.Before(w.End) {
+			windows = append(windows, w)
+		}
+	}
+	s.Windows = windows
+}
+
+// AddMaintenanceWindow saves a new maintenance window and returns it with
+// its ID set.
+func AddMaintenanceWindow(w *MaintenanceWindow) (*MaintenanceWindow, error) {
+	if len(w.Routes) == 0 && len(w.Hosts) == 0 {
+		return nil, errors.New("maintenance window needs at least one route or host")
+	}
+	if !w.End.After(w.Start) {
+		return nil, errors.New("maintenance window must end after it starts")
+	}
+	for _, pattern := range w.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+	}
+
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	maintenance.prune(time.Now())
+	w.ID = maintenance.NextID
+	maintenance.NextID++
+	maintenance.Windows = append(maintenance.Windows, w)
+	maintenance.save()
+	return w, nil
+}
+
+// EndMaintenanceWindow removes a maintenance window.
+func EndMaintenanceWindow(id int) bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	for i, w := range maintenance.Windows {
+		if w.ID == id {
+			maintenance.Windows = append(maintenance.Windows[:i], maintenance.Windows[i+1:]...)
+			maintenance.save()
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceWindows returns all current and future maintenance windows.
+func MaintenanceWindows() []*MaintenanceWindow {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	maintenance.prune(time.Now())
+	windows := make([]*MaintenanceWindow, len(maintenance.Windows))
+	copy(windows, maintenance.Windows)
+	return windows
+}
+
+// activeMaintenance returns the first maintenance window that mutes a message
+// from route about host, or nil.
+func activeMaintenance(route, host string) *MaintenanceWindow {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	now := time.Now()
+	for _, w := range maintenance.Windows {
+		if w.Matches(route, host, now) {
+			return w
+		}
+	}
+	return nil
+}
+
+type maintenanceRequest struct {
+	Routes   []string  `json:"routes"`
+	Hosts    []string  `json:"hosts"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	Reason   string    `json:"reason"`
+}
+
+func handleMaintenanceAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, p string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, MaintenanceWindows())
+
+	case http.MethodPost:
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		window := &MaintenanceWindow{
+			Routes:    req.Routes,
+			Hosts:     req.Hosts,
+			Start:     req.Start,
+			End:       req.End,
+			Reason:    req.Reason,
+			CreatedBy: "api",
+		}
+		if window.Start.IsZero() {
+			window.Start = time.Now()
+		}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			window.End = window.Start.Add(d)
+		}
+
+		window, err := AddMaintenanceWindow(window)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, window)
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(p)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errors.New("invalid maintenance window ID"))
+			return
+		}
+		if !EndMaintenanceWindow(id) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func maintenanceCmd(b *bot.Bot, event *bot.CommandEvent) error {
+	if len(event.Args) == 0 {
+		return b.Reply(event.Post, "Usage: maint list | maint add DURATION [route=NAME,...] [host=PATTERN,...] [REASON] | maint end ID")
+	}
+
+	// Windows mute alerts, only admins can change them
+	if event.Args[0] != "list" && !b.IsAdmin(event.Post) {
+		return b.Reply(event.Post, "Only admins can change maintenance windows. Ask in the debug channel.")
+	}
+
+	switch event.Args[0] {
+	case "list":
+		windows := MaintenanceWindows()
+		if len(windows) == 0 {
+			return b.Reply(event.Post, "There are no maintenance windows.")
+		}
+
+		lines := make([]string, len(windows))
+		for i, w := range windows {
+			lines[i] = "- " + w.String()
+		}
+		return b.Reply(event.Post, "Maintenance windows:\n\n"+strings.Join(lines, "\n"))
+
+	case "add":
+		if len(event.Args) < 2 {
+			return b.Reply(event.Post, "Usage: maint add DURATION [route=NAME,...] [host=PATTERN,...] [REASON]")
+		}
+
+		d, err := time.ParseDuration(event.Args[1])
+		if err != nil {
+			return b.Reply(event.Post, fmt.Sprintf("Invalid duration %s", event.Args[1]))
+		}
+
+		now := time.Now()
+		window := &MaintenanceWindow{
+			Start:     now,
+			End:       now.Add(d),
+			CreatedBy: b.Username(event.Post.UserId),
+		}
+
+		var reason []string
+		for _, arg := range event.Args[2:] {
+			switch {
+			case strings.HasPrefix(arg, "route="):
+				window.Routes = append(window.Routes, strings.Split(arg[6:], ",")...)
+			case strings.HasPrefix(arg, "host="):
+				window.Hosts = append(window.Hosts, strings.Split(arg[5:], ",")...)
+			default:
+				reason = append(reason, arg)
+			}
+		}
+		window.Reason = strings.Join(reason, " ")
+
+		if _, err := AddMaintenanceWindow(window); err != nil {
+			return b.Reply(event.Post, err.Error())
+		}
+		return b.Reply(event.Post, "Added maintenance window "+window.String())
+
+	case "end":
+		if len(event.Args) != 2 {
+			return b.Reply(event.Post, "Usage: maint end ID")
+		}
+
+		id, err := strconv.Atoi(strings.TrimPrefix(event.Args[1], "#"))
+		if err != nil || !EndMaintenanceWindow(id) {
+			return b.Reply(event.Post, fmt.Sprintf("Maintenance window %s not found", event.Args[1]))
+		}
+		return b.Reply(event.Post, fmt.Sprintf("Ended maintenance window #%d", id))
+	}
+
+	return b.Reply(event.Post, "Usage: maint list | maint add DURATION [route=NAME,...] [host=PATTERN,...] [REASON] | maint end ID")
+}
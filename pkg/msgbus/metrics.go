@@ -0,0 +1,67 @@
+package msgbus
+
+import (
+	"net/http"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounter("yobot_msgbus_requests_total",
+		"Message bus requests by route and response status code.", "route", "code")
+	handlerDuration = metrics.NewHistogram("yobot_msgbus_handler_duration_seconds",
+		"Time taken by route handlers to process a request.", nil, "route")
+	handlerPanics = metrics.NewCounter("yobot_msgbus_handler_panics_total",
+		"Panics recovered in route handlers.", "route")
+	authFailuresTotal = metrics.NewCounter("yobot_msgbus_auth_failures_total",
+		"Failed authentication attempts by route.", "route")
+	rateLimitedTotal = metrics.NewCounter("yobot_msgbus_rate_limited_total",
+		"Requests rejected by rate limits by route.", "route")
+
+	messagesDispatched = metrics.NewCounter("yobot_messages_dispatched_total",
+		"Messages queued for delivery by channel.", "channel")
+	messagesMuted = metrics.NewCounter("yobot_messages_muted_total",
+		"Messages dropped by maintenance windows by route.", "route")
+	messagesHeld = metrics.NewCounter("yobot_messages_held_total",
+		"Messages held for a quiet hours digest by channel.", "channel")
+	messagesDelivered = metrics.NewCounter("yobot_messages_delivered_total",
+		"Messages posted to Mattermost by channel.", "channel")
+	deliveryFailures = metrics.NewCounter("yobot_message_delivery_failures_total",
+		"Failed attempts to post a queued message by channel.", "channel")
+	deadLettersTotal = metrics.NewCounter("yobot_dead_letters_total",
+		"Messages given up on after too many failed attempts.")
+)
+
+func init() {
+	RegisterMuxHandler("/metrics", metricsHandler)
+
+	metrics.NewGaugeFunc("yobot_queue_depth", "Undelivered messages by channel.", "channel",
+		func() map[string]float64 {
+			depth := QueueDepth()
+			values := make(map[string]float64, len(depth))
+			for channel, n := range depth {
+				values[channel] = float64(n)
+			}
+			return values
+		})
+
+	metrics.NewGaugeFunc("yobot_queue_dead_letters", "Messages in the dead letter queue.", "",
+		func() map[string]float64 {
+			queue.Lock()
+			defer queue.Unlock()
+			return map[string]float64{"": float64(len(queue.dead))}
+		})
+}
+
+func metricsHandler(conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Write(w)
+	}
+}
@@ -0,0 +1,390 @@
+package msgbus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	queueMinBackoff = time.Second
+	queueMaxBackoff = 5 * time.Minute
+)
+
+func init() {
+	RegisterAdminHandler("queue", handleQueueAPI)
+}
+
+// queuedMessage is a message waiting to be posted. Each message is saved as
+// a file in the queue directory until it's delivered or becomes a dead letter.
+type queuedMessage struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Text      string    `json:"text"`
+	RootID    string    `json:"root_id,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Alert     *Alert    `json:"alert,omitempty"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// channelQueue holds the pending messages of a single channel. Messages
+// in a channel are delivered in order by a single worker.
+type channelQueue struct {
+	messages []*queuedMessage
+	running  bool
+}
+
+type outbox struct {
+	sync.Mutex
+	dir         string
+	deadDir     string
+	maxAttempts int
+	maxAge      time.Duration
+	seq         uint64
+	quit        chan bool
+	channels    map[string]*channelQueue
+	dead        []*queuedMessage
+}
+
+var queue = &outbox{channels: make(map[string]*channelQueue)}
+
+// sendQueuedMessage posts a message. It's a variable so delivery can be
+// replaced when the bot isn't available. Alerts that can be acted on are
+// tracked once posted.
+var sendQueuedMessage = func(m *queuedMessage) error {
+	b := bot.GetBot()
+	if b == nil {
+		return errors.New("bot is not connected")
+	}
+
+	post := &model.Post{Message: m.Text, RootId: m.RootID}
+	var tracked *trackedAlert
+	if m.Alert.Actionable() {
+		tracked = newTrackedAlert(m, post)
+	}
+
+	created, err := b.PostToTeamChannel(m.Channel, post)
+	if err != nil {
+		return err
+	}
+
+	if tracked != nil {
+		trackAlertPost(tracked, created)
+	}
+	return nil
+}
+
+func startQueue(conf *config.Config, quit chan bool) error {
+	maxAge, err := time.ParseDuration(conf.Queue.MaxAge)
+	if err != nil {
+		return fmt.Errorf("invalid queue max age: %s", err)
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	queue.dir = filepath.Join(conf.Main.DataDir, "queue")
+	queue.deadDir = filepath.Join(queue.dir, "dead")
+	queue.maxAttempts = conf.Queue.MaxAttempts
+	queue.maxAge = maxAge
+	queue.quit = quit
+
+	if err := os.MkdirAll(queue.deadDir, 0755); err != nil {
+		return err
+	}
+
+	pending, err := loadQueuedMessages(queue.dir)
+	if err != nil {
+		return err
+	}
+	queue.dead, err = loadQueuedMessages(queue.deadDir)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		queue.push(m)
+	}
+	if len(pending) > 0 {
+		fmt.Printf("Loaded %d queued messages\n", len(pending))
+	}
+	return nil
+}
+
+func loadQueuedMessages(dir string) ([]*queuedMessage, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	messages := make([]*queuedMessage, 0, len(files))
+	for _, file := range files {
+		var m queuedMessage
+		if err := utils.LoadJSONFile(file, &m); err != nil {
+			fmt.Printf("Skipping bad queue file %s: %s\n", file, err)
+			continue
+		}
+		messages = append(messages, &m)
+	}
+	return messages, nil
+}
+
+// enqueueMessage saves a message to disk and schedules it for delivery.
+// Route and alert are optional and describe where the message came from.
+func enqueueMessage(channel, msg, route string, alert *Alert) {
+	enqueue(&queuedMessage{
+		Channel: channel,
+		Text:    msg,
+		Route:   route,
+		Alert:   alert,
+	})
+}
+
+// SendMessage queues a message to a team:channel or @user, in the thread of
+// rootID if it's set. Like messages from routes, it's retried until it's
+// posted or becomes a dead letter. It returns the ID of the queued message.
+func SendMessage(channel, msg, rootID string) string {
+	return enqueue(&queuedMessage{
+		Channel: channel,
+		Text:    msg,
+		RootID:  rootID,
+	})
+}
+
+func enqueue(m *queuedMessage) string {
+	queue.Lock()
+	defer queue.Unlock()
+
+	m.ID = queue.nextID()
+	m.Created = time.Now()
+
+	if queue.dir == "" { // Queue isn't started, deliver directly
+		go func() {
+			if err := sendQueuedMessage(m); err != nil {
+				fmt.Println(err)
+			}
+		}()
+		return m.ID
+	}
+
+	if err := queue.save(m); err != nil {
+		fmt.Printf("Failed saving queued message: %s\n", err)
+	}
+	queue.push(m)
+	return m.ID
+}
+
+// nextID returns a unique ID that sorts in the order messages were queued.
+// It must be called with the lock held.
+func (q *outbox) nextID() string {
+	q.seq++
+	return fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), q.seq%1000000)
+}
+
+// push adds a message to its channel queue and starts the channel's worker.
+// It must be called with the lock held.
+func (q *outbox) push(m *queuedMessage) {
+	cq, exists := q.channels[m.Channel]
+	if !exists {
+		cq = &channelQueue{}
+		q.channels[m.Channel] = cq
+	}
+	cq.messages = append(cq.messages, m)
+
+	if !cq.running {
+		cq.running = true
+		go q.worker(m.Channel, cq)
+	}
+}
+
+func (q *outbox) worker(channel string, cq *channelQueue) {
+	backoff := queueMinBackoff
+
+	for {
+		q.Lock()
+		if len(cq.messages) == 0 {
+			cq.running = false
+			q.Unlock()
+			return
+		}
+		m := cq.messages[0]
+		q.Unlock()
+
+		err := sendQueuedMessage(m)
+
+		q.Lock()
+		if err == nil {
+			messagesDelivered.Inc(channel)
+			cq.messages = cq.messages[1:]
+			q.remove(q.dir, m)
+			q.Unlock()
+			backoff = queueMinBackoff
+			continue
+		}
+
+		deliveryFailures.Inc(channel)
+		m.Attempts++
+		m.LastError = err.Error()
+		fmt.Printf("Failed delivering message to %s (attempt %d): %s\n", channel, m.Attempts, err)
+
+		// Messages that can't ever be delivered don't hold up the channel
+		if bot.IsPermanent(err) || m.Attempts >= q.maxAttempts || time.Since(m.Created) > q.maxAge {
+			cq.messages = cq.messages[1:]
+			q.kill(m)
+			q.Unlock()
+			backoff = queueMinBackoff
+			continue
+		}
+
+		if err := q.save(m); err != nil {
+			fmt.Printf("Failed saving queued message: %s\n", err)
+		}
+		q.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-q.quit:
+			return
+		}
+
+		backoff *= 2
+		if backoff > queueMaxBackoff {
+			backoff = queueMaxBackoff
+		}
+	}
+}
+
+// save must be called with the lock held.
+func (q *outbox) save(m *queuedMessage) error {
+	return utils.SaveJSONFile(filepath.Join(q.dir, m.ID+".json"), m)
+}
+
+// remove must be called with the lock held.
+func (q *outbox) remove(dir string, m *queuedMessage) {
+	if err := os.Remove(filepath.Join(dir, m.ID+".json")); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed removing queued message: %s\n", err)
+	}
+}
+
+// kill moves a message to the dead letters. It must be called with the lock held.
+func (q *outbox) kill(m *queuedMessage) {
+	fmt.Printf("Giving up on message %s to %s after %d attempts\n", m.ID, m.Channel, m.Attempts)
+	deadLettersTotal.Inc()
+
+	if err := utils.SaveJSONFile(filepath.Join(q.deadDir, m.ID+".json"), m); err != nil {
+		fmt.Printf("Failed saving dead letter: %s\n", err)
+	}
+	q.remove(q.dir, m)
+	q.dead = append(q.dead, m)
+}
+
+// QueueDepth returns the number of undelivered messages per channel.
+func QueueDepth() map[string]int {
+	queue.Lock()
+	defer queue.Unlock()
+
+	depth := make(map[string]int, len(queue.channels))
+	for channel, cq := range queue.channels {
+		if len(cq.messages) > 0 {
+			depth[channel] = len(cq.messages)
+		}
+	}
+	return depth
+}
+
+type queueStatus struct {
+	Depth       int            `json:"depth"`
+	Channels    map[string]int `json:"channels"`
+	DeadLetters int            `json:"dead_letters"`
+}
+
+func handleQueueAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if path == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := queueStatus{Channels: QueueDepth()}
+		for _, depth := range status.Channels {
+			status.Depth += depth
+		}
+		queue.Lock()
+		status.DeadLetters = len(queue.dead)
+		queue.Unlock()
+
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	if !strings.HasPrefix(path, "dead") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(path, "dead"), "/")
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	if id == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, queue.dead)
+		return
+	}
+
+	index := -1
+	for i, m := range queue.dead {
+		if m.ID == id {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	m := queue.dead[index]
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, m)
+
+	case http.MethodPost: // Retry delivery
+		queue.dead = append(queue.dead[:index], queue.dead[index+1:]...)
+		queue.remove(queue.deadDir, m)
+
+		m.ID = queue.nextID()
+		m.Attempts = 0
+		m.Created = time.Now()
+		if err := queue.save(m); err != nil {
+			fmt.Printf("Failed saving queued message: %s\n", err)
+		}
+		queue.push(m)
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodDelete:
+		queue.dead = append(queue.dead[:index], queue.dead[index+1:]...)
+		queue.remove(queue.deadDir, m)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,190 @@
+package msgbus
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/schedule"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+const quietHoursCheckInterval = time.Minute
+
+type quietHours struct {
+	name     string
+	routes   []string
+	channels []string
+	schedule *schedule.Schedule
+}
+
+func (q *quietHours) appliesTo(route, channel string) bool {
+	if len(q.routes) == 0 && len(q.channels) == 0 {
+		return true
+	}
+	return utils.StringInSlice(route, q.routes) || utils.StringInSlice(channel, q.channels)
+}
+
+type heldMessage struct {
+	Route string    `json:"route"`
+	Text  string    `json:"text"`
+	Time  time.Time `json:"time"`
+}
+
+// heldBucket is the set of messages held for a channel by a quiet hours schedule.
+type heldBucket struct {
+	QuietHours string         `json:"quiet_hours"`
+	Channel    string         `json:"channel"`
+	Messages   []*heldMessage `json:"messages"`
+}
+
+var held = struct {
+	sync.Mutex
+	file    string
+	buckets map[string]*heldBucket
+}{buckets: make(map[string]*heldBucket)}
+
+// ParseQuietHours compiles the quiet hours configuration.
+func ParseQuietHours(conf *config.Config) ([]*quietHours, error) {
+	schedules := make([]*quietHours, 0, len(conf.QuietHours))
+	for name, qc := range conf.QuietHours {
+		s, err := schedule.Parse(qc.Ranges, qc.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("quiet hours %s: %s", name, err)
+		}
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("quiet hours %s: %s", name, err)
+		}
+
+		schedules = append(schedules, &quietHours{
+			name:     name,
+			routes:   qc.Routes,
+			channels: qc.Channels,
+			schedule: s,
+		})
+	}
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].name < schedules[j].name })
+	return schedules, nil
+}
+
+func startQuietHours(conf *config.Config, quit chan bool) error {
+	held.Lock()
+	held.file = filepath.Join(conf.Main.DataDir, "quiethours.json")
+	var buckets []*heldBucket
+	err := utils.LoadJSONFile(held.file, &buckets)
+	for _, b := range buckets {
+		held.buckets[b.QuietHours+"|"+b.Channel] = b
+	}
+	held.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(quietHoursCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sendDigests(time.Now())
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// holdMessage saves a message for later delivery if the channel or route
+// is in quiet hours. It returns true if the message was held.
+func holdMessage(route, channel, msg string, alert *Alert) bool {
+	if alert.Critical() {
+		return false
+	}
+
+	now := time.Now()
+	for _, q := range activeQuietHours() {
+		if !q.appliesTo(route, channel) || !q.schedule.Active(now) {
+			continue
+		}
+
+		held.Lock()
+		key := q.name + "|" + channel
+		bucket, exists := held.buckets[key]
+		if !exists {
+			bucket = &heldBucket{QuietHours: q.name, Channel: channel}
+			held.buckets[key] = bucket
+		}
+		bucket.Messages = append(bucket.Messages, &heldMessage{
+			Route: route,
+			Text:  msg,
+			Time:  now,
+		})
+		saveHeldMessages()
+		held.Unlock()
+		return true
+	}
+	return false
+}
+
+// saveHeldMessages must be called with the held lock.
+func saveHeldMessages() {
+	if held.file == "" {
+		return
+	}
+
+	buckets := make([]*heldBucket, 0, len(held.buckets))
+	for _, b := range held.buckets {
+		buckets = append(buckets, b)
+	}
+	if err := utils.SaveJSONFile(held.file, buckets); err != nil {
+		fmt.Printf("Failed saving held messages: %s\n", err)
+	}
+}
+
+// sendDigests posts the held messages of every quiet hours schedule that
+// is no longer active.
+func sendDigests(now time.Time) {
+	schedules := activeQuietHours()
+	active := make(map[string]bool, len(schedules))
+	for _, q := range schedules {
+		active[q.name] = q.schedule.Active(now)
+	}
+
+	held.Lock()
+	var ready []*heldBucket
+	for key, bucket := range held.buckets {
+		// Schedules removed from the configuration are flushed too
+		if !active[bucket.QuietHours] {
+			ready = append(ready, bucket)
+			delete(held.buckets, key)
+		}
+	}
+	if len(ready) > 0 {
+		saveHeldMessages()
+	}
+	held.Unlock()
+
+	for _, bucket := range ready {
+		if len(bucket.Messages) > 0 {
+			enqueueMessage(bucket.Channel, buildDigest(bucket), "", nil)
+		}
+	}
+}
+
+func buildDigest(bucket *heldBucket) string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "### Quiet Hours Digest\n\n%d message(s) were held during quiet hours _%s_.\n",
+		len(bucket.Messages), bucket.QuietHours)
+
+	for _, m := range bucket.Messages {
+		fmt.Fprintf(&msg, "\n---\n\n_%s from %s_\n\n%s\n", m.Time.Format(time.RFC1123), m.Route, m.Text)
+	}
+	return msg.String()
+}
@@ -0,0 +1,241 @@
+package msgbus
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+)
+
+const (
+	throttleNoticeInterval = 10 * time.Minute
+	idleBucketTTL          = time.Hour
+)
+
+// rateLimit is a number of requests allowed per interval. Burst is the
+// number of requests allowed at once.
+type rateLimit struct {
+	rate  float64 // tokens per second
+	burst float64
+}
+
+// parseRateLimit parses a limit like "60/m". Units are s, m, or h.
+func parseRateLimit(limit string, burst int) (*rateLimit, error) {
+	if limit == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(limit, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate limit %q", limit)
+	}
+
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q", limit)
+	}
+
+	var per time.Duration
+	switch parts[1] {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return nil, fmt.Errorf("invalid rate limit unit in %q", limit)
+	}
+
+	if burst <= 0 {
+		burst = int(math.Max(1, n))
+	}
+	return &rateLimit{rate: n / per.Seconds(), burst: float64(burst)}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// fill adds the tokens earned since the bucket was last filled. It returns
+// how long until a token is available, 0 if there's one now.
+func (b *tokenBucket) fill(l *rateLimit, now time.Time) time.Duration {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / l.rate * float64(time.Second)))
+}
+
+type throttleNotice struct {
+	rejected int
+	notified time.Time
+}
+
+var rateLimiter = struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	notices   map[string]*throttleNotice
+	lastPrune time.Time
+}{
+	buckets: make(map[string]*tokenBucket),
+	notices: make(map[string]*throttleNotice),
+}
+
+// validateRateLimits checks the rate limits of all routes.
+func validateRateLimits(conf *config.Config) error {
+	for id, route := range conf.Routes {
+		if _, err := parseRateLimit(route.RateLimit, route.RateBurst); err != nil {
+			return fmt.Errorf("route %s: %s", id, err)
+		}
+		if _, err := parseRateLimit(route.SourceRateLimit, route.SourceRateBurst); err != nil {
+			return fmt.Errorf("route %s: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// routeRateLimits returns the route and per source limits of a route.
+// Limits not set on the route are taken from the default route.
+func routeRateLimits(conf *config.Config, routeID string) (route, source *rateLimit) {
+	rc := conf.Routes[routeID]
+	def := conf.Routes["default"]
+	if def == nil {
+		def = &config.RouteConfig{}
+	}
+
+	if rc.RateLimit != "" {
+		route, _ = parseRateLimit(rc.RateLimit, rc.RateBurst)
+	} else {
+		route, _ = parseRateLimit(def.RateLimit, def.RateBurst)
+	}
+
+	if rc.SourceRateLimit != "" {
+		source, _ = parseRateLimit(rc.SourceRateLimit, rc.SourceRateBurst)
+	} else {
+		source, _ = parseRateLimit(def.SourceRateLimit, def.SourceRateBurst)
+	}
+	return
+}
+
+// checkRateLimit takes a token from the route's bucket and the bucket of the
+// client address. If either is empty, neither loses a token and it returns
+// how long to wait.
+func checkRateLimit(conf *config.Config, routeID string, r *http.Request) (bool, time.Duration) {
+	routeLimit, sourceLimit := routeRateLimits(conf, routeID)
+	if routeLimit == nil && sourceLimit == nil {
+		return true, 0
+	}
+
+	ip := clientIP(conf, r)
+	now := time.Now()
+
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+
+	pruneBuckets(now)
+
+	var sourceBucket, routeBucket *tokenBucket
+	if sourceLimit != nil {
+		sourceBucket = bucket(routeID+"|"+ip, sourceLimit, now)
+		if wait := sourceBucket.fill(sourceLimit, now); wait > 0 {
+			throttled(routeID, fmt.Sprintf("from %s", ip), now)
+			return false, wait
+		}
+	}
+
+	if routeLimit != nil {
+		routeBucket = bucket(routeID, routeLimit, now)
+		if wait := routeBucket.fill(routeLimit, now); wait > 0 {
+			throttled(routeID, "", now)
+			return false, wait
+		}
+	}
+
+	if sourceBucket != nil {
+		sourceBucket.tokens--
+	}
+	if routeBucket != nil {
+		routeBucket.tokens--
+	}
+	return true, 0
+}
+
+// bucket returns a bucket, creating a full one if needed. It must be called
+// with the lock held.
+func bucket(key string, l *rateLimit, now time.Time) *tokenBucket {
+	b, exists := rateLimiter.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		rateLimiter.buckets[key] = b
+	}
+	return b
+}
+
+// pruneBuckets removes buckets that haven't been used recently. It must be
+// called with the lock held.
+func pruneBuckets(now time.Time) {
+	if now.Sub(rateLimiter.lastPrune) < idleBucketTTL {
+		return
+	}
+	rateLimiter.lastPrune = now
+
+	for key, b := range rateLimiter.buckets {
+		if now.Sub(b.last) > idleBucketTTL {
+			delete(rateLimiter.buckets, key)
+		}
+	}
+	for key, n := range rateLimiter.notices {
+		if now.Sub(n.notified) > idleBucketTTL {
+			delete(rateLimiter.notices, key)
+		}
+	}
+}
+
+// throttled counts a rejected request and posts a notice to the debug
+// channel at most every throttleNoticeInterval per route. It must be called
+// with the lock held.
+func throttled(routeID, detail string, now time.Time) {
+	rateLimitedTotal.Inc(routeID)
+	n, exists := rateLimiter.notices[routeID]
+	if !exists {
+		n = &throttleNotice{}
+		rateLimiter.notices[routeID] = n
+	}
+	n.rejected++
+
+	if now.Sub(n.notified) < throttleNoticeInterval {
+		return
+	}
+
+	msg := fmt.Sprintf("Route %s is being rate limited", routeID)
+	if detail != "" {
+		msg += " " + detail
+	}
+	msg += fmt.Sprintf(", %d requests rejected", n.rejected)
+	if !n.notified.IsZero() {
+		msg += fmt.Sprintf(" in the last %s", now.Sub(n.notified).Round(time.Minute))
+	}
+
+	n.notified = now
+	n.rejected = 0
+
+	fmt.Println(msg)
+	if b := bot.GetBot(); b != nil {
+		go b.SendDebugMsg(msg)
+	}
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
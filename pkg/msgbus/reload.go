@@ -0,0 +1,280 @@
+package msgbus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/plugins"
+)
+
+// ReloadHook applies a reloaded configuration. It's called after the message
+// bus switched to the new configuration.
+type ReloadHook func(conf *config.Config) error
+
+// restartSettings are settings used only when the bot starts. Changes to
+// them are reported but don't take effect until a restart.
+var restartSettings = []string{
+	"Main.",
+	"Mattermost.",
+	"HTTP.Address",
+	"HTTP.Listen",
+	"HTTP.SocketMode",
+	"HTTP.Workers",
+	"HTTP.Backlog",
+	"Queue.",
+}
+
+var (
+	reloadHooks     []ReloadHook
+	configOverrides []func(*config.Config)
+	reloadLock      sync.Mutex
+
+	// active is the configuration in use and the settings compiled from
+	// it. A reload replaces them together.
+	active = struct {
+		sync.RWMutex
+		conf       *config.Config
+		escalation map[string][]*escalationStep
+		quietHours []*quietHours
+	}{}
+)
+
+func init() {
+	RegisterAdminHandler("reload", handleReloadAPI)
+	RegisterReloadHook(reloadBotConfig)
+}
+
+// RegisterReloadHook adds a function called when the configuration is reloaded.
+func RegisterReloadHook(hook ReloadHook) {
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// RegisterConfigOverride adds a function that changes a reloaded
+// configuration before it's used, such as to apply command line flags.
+func RegisterConfigOverride(override func(*config.Config)) {
+	configOverrides = append(configOverrides, override)
+}
+
+func reloadBotConfig(conf *config.Config) error {
+	bot.SetConfig(conf)
+	return nil
+}
+
+func currentConfig() *config.Config {
+	active.RLock()
+	defer active.RUnlock()
+	return active.conf
+}
+
+func escalationPolicy(name string) []*escalationStep {
+	active.RLock()
+	defer active.RUnlock()
+	return active.escalation[name]
+}
+
+func activeQuietHours() []*quietHours {
+	active.RLock()
+	defer active.RUnlock()
+	return active.quietHours
+}
+
+// applyConfig validates a configuration and makes it the active one.
+func applyConfig(conf *config.Config) error {
+	if err := validateAuthConfig(conf); err != nil {
+		return err
+	}
+	if err := validateRateLimits(conf); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(conf.Alerts.SilenceDuration); err != nil {
+		return fmt.Errorf("invalid alert silence duration: %s", err)
+	}
+
+	policies, err := ParseEscalationPolicies(conf)
+	if err != nil {
+		return err
+	}
+	schedules, err := ParseQuietHours(conf)
+	if err != nil {
+		return err
+	}
+
+	active.Lock()
+	active.conf = conf
+	active.escalation = policies
+	active.quietHours = schedules
+	active.Unlock()
+	return nil
+}
+
+// ReloadResult describes a configuration reload. Restart lists changed
+// settings that need a restart. Errors are from parts of the bot that failed
+// to apply the new configuration.
+type ReloadResult struct {
+	Changes []string `json:"changes"`
+	Restart []string `json:"restart"`
+	Errors  []string `json:"errors"`
+}
+
+// Reload loads the configuration file again and switches to it. The new
+// configuration is checked like by yobot -t. If it has errors, the current
+// one is kept.
+func Reload() (*ReloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	old := currentConfig()
+	if old == nil {
+		return nil, fmt.Errorf("message bus isn't started")
+	}
+
+	conf, diags := config.Validate(old.Filename())
+	var problems []string
+	for _, d := range diags {
+		if !d.Warning {
+			problems = append(problems, d.String())
+		}
+	}
+	if conf == nil || len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	for _, override := range configOverrides {
+		override(conf)
+	}
+	if err := applyConfig(conf); err != nil {
+		return nil, err
+	}
+
+	result := &ReloadResult{Changes: []string{}, Restart: []string{}, Errors: []string{}}
+	for _, c := range config.Diff(old, conf) {
+		if needsRestart(c.Key) {
+			result.Restart = append(result.Restart, c.String())
+		} else {
+			result.Changes = append(result.Changes, c.String())
+		}
+	}
+
+	resetRouteOverrides(old, conf)
+	flushLibreNMSCache()
+	registerLibreNMSCheck(conf)
+
+	if tlsCerts != nil {
+		if err := tlsCerts.load(&conf.HTTP.TLS); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+
+	for _, hook := range reloadHooks {
+		if err := hook(conf); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+	for _, err := range plugins.Reload(conf) {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	reportReload(result)
+	return result, nil
+}
+
+func needsRestart(key string) bool {
+	if key == "Mattermost.Admins" { // Read by commands when they run
+		return false
+	}
+	for _, prefix := range restartSettings {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetRouteOverrides drops runtime overrides of routes that were removed or
+// whose Enabled setting changed. The configuration file decides again for
+// those routes.
+func resetRouteOverrides(old, conf *config.Config) {
+	routeOverrides.Lock()
+	defer routeOverrides.Unlock()
+
+	for id := range routeOverrides.enabled {
+		before, after := old.Routes[id], conf.Routes[id]
+		if after == nil || before == nil || before.Enabled != after.Enabled {
+			delete(routeOverrides.enabled, id)
+		}
+	}
+}
+
+// reportReload logs the result of a reload and posts it to the debug channel.
+func reportReload(result *ReloadResult) {
+	var msg strings.Builder
+	msg.WriteString("Configuration reloaded")
+	if len(result.Changes)+len(result.Restart) == 0 {
+		msg.WriteString(", no changes")
+	}
+	for _, c := range result.Changes {
+		fmt.Fprintf(&msg, "\n- %s", c)
+	}
+	for _, c := range result.Restart {
+		fmt.Fprintf(&msg, "\n- %s (needs restart)", c)
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(&msg, "\n- Error: %s", e)
+	}
+
+	fmt.Println(msg.String())
+	if b := bot.GetBot(); b != nil {
+		go b.SendDebugMsg(msg.String())
+	}
+}
+
+// reloadOnHangup reloads the configuration when the process receives SIGHUP.
+func reloadOnHangup(quit chan bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if _, err := Reload(); err != nil {
+					reloadFailed(err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+func reloadFailed(err error) {
+	msg := fmt.Sprintf("Configuration reload failed, keeping the current configuration: %s", err)
+	fmt.Println(msg)
+	if b := bot.GetBot(); b != nil {
+		go b.SendDebugMsg(msg)
+	}
+}
+
+func handleReloadAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := Reload()
+	if err != nil {
+		reloadFailed(err)
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
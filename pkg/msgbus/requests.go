@@ -0,0 +1,236 @@
+package msgbus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+)
+
+const (
+	requestStatusTTL     = time.Hour
+	requestStatusMaxSize = 10000
+)
+
+// Request processing states
+const (
+	RequestQueued     = "queued"
+	RequestProcessing = "processing"
+	RequestDone       = "done"
+	RequestFailed     = "failed"
+)
+
+func init() {
+	RegisterMuxHandler("/msgbus/status/", requestStatusHandler)
+}
+
+// RequestStatus is the processing state of a message bus request.
+type RequestStatus struct {
+	ID       string     `json:"id"`
+	Route    string     `json:"route"`
+	State    string     `json:"state"`
+	Code     int        `json:"code,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Received time.Time  `json:"received"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+var requestStatuses = struct {
+	sync.Mutex
+	byID  map[string]*RequestStatus
+	order []*RequestStatus
+}{byID: make(map[string]*RequestStatus)}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// trackRequest starts tracking the status of a new request.
+func trackRequest(id, route, state string) *RequestStatus {
+	status := &RequestStatus{
+		ID:       id,
+		Route:    route,
+		State:    state,
+		Received: time.Now(),
+	}
+
+	requestStatuses.Lock()
+	defer requestStatuses.Unlock()
+
+	// Expire old statuses, the order slice is sorted by received time
+	expired := 0
+	for _, s := range requestStatuses.order {
+		if time.Since(s.Received) < requestStatusTTL && len(requestStatuses.order)-expired < requestStatusMaxSize {
+			break
+		}
+		delete(requestStatuses.byID, s.ID)
+		expired++
+	}
+	requestStatuses.order = append(requestStatuses.order[expired:], status)
+	requestStatuses.byID[id] = status
+	return status
+}
+
+func (s *RequestStatus) setState(state string) {
+	requestStatuses.Lock()
+	s.State = state
+	requestStatuses.Unlock()
+}
+
+func (s *RequestStatus) finish(code int, err string) {
+	requestStatuses.Lock()
+	defer requestStatuses.Unlock()
+
+	now := time.Now()
+	s.Finished = &now
+	s.Code = code
+	s.Error = err
+	s.State = RequestDone
+	if err != "" || code >= 400 {
+		s.State = RequestFailed
+	}
+}
+
+// GetRequestStatus returns a copy of the status of a request.
+func GetRequestStatus(id string) (RequestStatus, bool) {
+	requestStatuses.Lock()
+	defer requestStatuses.Unlock()
+
+	s, exists := requestStatuses.byID[id]
+	if !exists {
+		return RequestStatus{}, false
+	}
+	return *s, true
+}
+
+func requestStatusHandler(conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, exists := GetRequestStatus(strings.TrimPrefix(r.URL.Path, "/msgbus/status/"))
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Only the route's own credentials can see a request status
+		if err := authenticateRoute(conf, status.Route, r); err != nil {
+			writeAuthError(conf, w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// discardWriter is the ResponseWriter for asynchronous requests. The client
+// already has its response so only the status code is kept.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(code int)        {}
+
+type busJob struct {
+	ctx     context.Context
+	handler BusHandler
+	r       *http.Request
+	status  *RequestStatus
+}
+
+var busJobs chan *busJob
+
+func startWorkers(conf *config.Config, quit chan bool) {
+	busJobs = make(chan *busJob, conf.HTTP.Backlog)
+
+	for i := 0; i < conf.HTTP.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-busJobs:
+					job.run()
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// queueJob schedules an asynchronous request. It returns false if the
+// backlog is full.
+func queueJob(job *busJob) bool {
+	select {
+	case busJobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *busJob) run() {
+	j.status.setState(RequestProcessing)
+	w := &statusWriter{ResponseWriter: &discardWriter{header: make(http.Header)}}
+	err := runBusHandler(j.ctx, j.handler, w, j.r)
+	j.status.finish(w.status(), err)
+}
+
+// runBusHandler calls a route handler, records how long it took, and
+// recovers from a panic. The panic is returned as an error message.
+func runBusHandler(ctx context.Context, handler BusHandler, w *statusWriter, r *http.Request) (err string) {
+	route := GetCtxRouteID(ctx)
+	start := time.Now()
+
+	defer func() {
+		handlerDuration.Since(start, route)
+		if p := recover(); p != nil {
+			handlerPanics.Inc(route)
+			fmt.Printf("Handler for request %s panicked: %v\n", GetCtxRequestID(ctx), p)
+			w.WriteHeader(http.StatusInternalServerError)
+			err = fmt.Sprint(p)
+		}
+	}()
+
+	handler(ctx, w, r)
+	return ""
+}
@@ -0,0 +1,296 @@
+package msgbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/jobs"
+	"github.com/lfkeitel/yobot/pkg/plugins"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+const (
+	dispatchHistorySize = 100
+	dispatchMessageSize = 500
+)
+
+func init() {
+	RegisterAdminHandler("routes", handleRoutesAPI)
+	RegisterAdminHandler("test", handleTestMessageAPI)
+	RegisterAdminHandler("dispatches", handleDispatchesAPI)
+	RegisterAdminHandler("cache", handleCacheAPI)
+	RegisterAdminHandler("plugins", handlePluginsAPI)
+	RegisterAdminHandler("jobs", handleJobsAPI)
+}
+
+// routeOverrides holds routes enabled or disabled at runtime. They take
+// precedence over the Enabled setting in the configuration until the bot
+// restarts.
+var routeOverrides = struct {
+	sync.Mutex
+	enabled map[string]bool
+}{enabled: make(map[string]bool)}
+
+// routeEnabled returns if a route accepts requests.
+func routeEnabled(conf *config.Config, routeID string) bool {
+	routeOverrides.Lock()
+	enabled, exists := routeOverrides.enabled[routeID]
+	routeOverrides.Unlock()
+
+	if exists {
+		return enabled
+	}
+	route := conf.Routes[routeID]
+	return route != nil && route.Enabled
+}
+
+// SetRouteEnabled enables or disables a route until the bot restarts.
+func SetRouteEnabled(routeID string, enabled bool) {
+	routeOverrides.Lock()
+	routeOverrides.enabled[routeID] = enabled
+	routeOverrides.Unlock()
+
+	if enabled {
+		fmt.Printf("Route %s enabled at runtime\n", routeID)
+	} else {
+		fmt.Printf("Route %s disabled at runtime\n", routeID)
+	}
+}
+
+// Dispatch is a message dispatched from a route.
+type Dispatch struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	RequestID string    `json:"request_id,omitempty"`
+	Channels  []string  `json:"channels"`
+	Held      []string  `json:"held,omitempty"`
+	MutedBy   int       `json:"muted_by,omitempty"`
+	Message   string    `json:"message"`
+}
+
+var dispatches = struct {
+	sync.Mutex
+	recent []*Dispatch
+	next   int
+}{}
+
+func recordDispatch(d *Dispatch) {
+	if len(d.Message) > dispatchMessageSize {
+		cut := dispatchMessageSize
+		for cut > 0 && !utf8.RuneStart(d.Message[cut]) { // Don't split a rune
+			cut--
+		}
+		d.Message = d.Message[:cut] + "..."
+	}
+
+	dispatches.Lock()
+	defer dispatches.Unlock()
+
+	if len(dispatches.recent) < dispatchHistorySize {
+		dispatches.recent = append(dispatches.recent, d)
+		return
+	}
+	dispatches.recent[dispatches.next] = d
+	dispatches.next = (dispatches.next + 1) % dispatchHistorySize
+}
+
+// RecentDispatches returns the most recent dispatches, newest first.
+func RecentDispatches() []*Dispatch {
+	dispatches.Lock()
+	defer dispatches.Unlock()
+
+	recent := make([]*Dispatch, 0, len(dispatches.recent))
+	for i := len(dispatches.recent) - 1; i >= 0; i-- {
+		recent = append(recent, dispatches.recent[(dispatches.next+i)%len(dispatches.recent)])
+	}
+	return recent
+}
+
+type routeStatus struct {
+	Name            string   `json:"name"`
+	Handler         string   `json:"handler"`
+	Enabled         bool     `json:"enabled"`
+	Overridden      bool     `json:"overridden"`
+	Async           bool     `json:"async"`
+	ChannelOverride bool     `json:"channel_override"`
+	Channels        []string `json:"channels"`
+}
+
+func getRouteStatus(conf *config.Config, routeID string) *routeStatus {
+	route := conf.Routes[routeID]
+	routeOverrides.Lock()
+	_, overridden := routeOverrides.enabled[routeID]
+	routeOverrides.Unlock()
+
+	return &routeStatus{
+		Name:            routeID,
+		Handler:         utils.FirstString(route.Alias, routeID),
+		Enabled:         routeEnabled(conf, routeID),
+		Overridden:      overridden,
+		Async:           route.Async,
+		ChannelOverride: route.ChannelOverride,
+		Channels:        routeChannels(conf, routeID),
+	}
+}
+
+func handleRoutesAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if path == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ids := make([]string, 0, len(conf.Routes))
+		for id := range conf.Routes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		routes := make([]*routeStatus, len(ids))
+		for i, id := range ids {
+			routes[i] = getRouteStatus(conf, id)
+		}
+		writeJSON(w, http.StatusOK, routes)
+		return
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	routeID := split[0]
+	if conf.Routes[routeID] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	action := ""
+	if len(split) == 2 {
+		action = split[1]
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	case "enable", "disable":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		SetRouteEnabled(routeID, action == "enable")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getRouteStatus(conf, routeID))
+}
+
+type testMessage struct {
+	Channel string `json:"channel"`
+	Route   string `json:"route"`
+	Message string `json:"message"`
+}
+
+// handleTestMessageAPI sends a message to a channel, or through a route's
+// channels with maintenance windows and quiet hours applied.
+func handleTestMessageAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req testMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if (req.Channel == "") == (req.Route == "") {
+		writeJSONError(w, http.StatusBadRequest, errors.New("either channel or route is required"))
+		return
+	}
+	if req.Message == "" {
+		req.Message = "Test message from yobot"
+	}
+
+	if req.Channel != "" {
+		enqueueMessage(req.Channel, req.Message, "", nil)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"channels": []string{req.Channel}})
+		return
+	}
+
+	if conf.Routes[req.Route] == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("route %s not found", req.Route))
+		return
+	}
+
+	requestID := newRequestID()
+	ctx := SetCtxRouteID(context.Background(), req.Route)
+	ctx = SetCtxConfig(ctx, conf)
+	ctx = SetCtxRequestID(ctx, requestID)
+	DispatchMessage(ctx, "%s", req.Message)
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"request_id": requestID,
+		"channels":   routeChannels(conf, req.Route),
+	})
+}
+
+func handleDispatchesAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, RecentDispatches())
+}
+
+func handleCacheAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if path != "flush" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flushed := map[string]int{"librenms": flushLibreNMSCache()}
+	if b := bot.GetBot(); b != nil {
+		flushed["channels"] = b.FlushChannelCache()
+	}
+	fmt.Println("Caches flushed by admin API")
+	writeJSON(w, http.StatusOK, flushed)
+}
+
+func handlePluginsAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"supported": plugins.PluginsSupported,
+		"dir":       conf.Main.ModulesDir,
+		"loaded":    plugins.Loaded(),
+		"plugins":   plugins.Statuses(),
+	})
+}
+
+func handleJobsAPI(conf *config.Config, w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs.Statuses())
+}
@@ -0,0 +1,138 @@
+package msgbus
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+// SettingError is a problem with a route setting.
+type SettingError struct {
+	Setting string
+	Message string
+}
+
+func (e *SettingError) Error() string {
+	return e.Setting + ": " + e.Message
+}
+
+// SettingsCheck checks the settings of a route using a handler.
+type SettingsCheck func(settings map[string]interface{}) []*SettingError
+
+var settingsChecks = map[string]SettingsCheck{}
+
+func init() {
+	config.RegisterValidator(validateConfig)
+
+	RegisterSettingsCheck("git", requireSettings("secret"))
+	RegisterSettingsCheck("git-issues", requireSettings("secret"))
+	RegisterSettingsCheck("librenms", checkLibreNMSSettings)
+}
+
+// RegisterSettingsCheck adds a check for the settings of routes using a
+// handler. It's run when the configuration is tested.
+func RegisterSettingsCheck(handler string, check SettingsCheck) {
+	if _, exists := settingsChecks[handler]; exists {
+		panic(fmt.Sprintf("settings check %s is already registered", handler))
+	}
+	settingsChecks[handler] = check
+}
+
+// requireSettings returns a check for required string settings.
+func requireSettings(names ...string) SettingsCheck {
+	return func(settings map[string]interface{}) []*SettingError {
+		var errs []*SettingError
+		for _, name := range names {
+			if s, ok := settings[name].(string); !ok || s == "" {
+				errs = append(errs, &SettingError{Setting: name, Message: "required"})
+			}
+		}
+		return errs
+	}
+}
+
+func checkLibreNMSSettings(settings map[string]interface{}) []*SettingError {
+	var errs []*SettingError
+	if _, ok := settings["ack_upstream"].(bool); !ok && settings["ack_upstream"] != nil {
+		errs = append(errs, &SettingError{Setting: "ack_upstream", Message: "must be true or false"})
+	}
+
+	// The API is only used for contact routing and acknowledging alerts
+	ackUpstream, _ := settings["ack_upstream"].(bool)
+	if settings["routes"] != nil || ackUpstream {
+		errs = append(errs, requireSettings("address", "apitoken")(settings)...)
+	}
+
+	contacts, routeErrs := parseContactRoutes(settings["routes"])
+	for _, err := range routeErrs {
+		errs = append(errs, &SettingError{Setting: "routes", Message: err.Error()})
+	}
+	for _, c := range contacts {
+		if !strings.Contains(c.channel, ":") && !strings.HasPrefix(c.channel, "@") {
+			errs = append(errs, &SettingError{
+				Setting: "routes",
+				Message: fmt.Sprintf("channel %q must be in team:channel or @user form", c.channel),
+			})
+		}
+	}
+	return errs
+}
+
+// validateConfig reports the problems applyConfig would refuse and checks
+// routes have a handler with valid settings.
+func validateConfig(conf *config.Config) []*config.Diagnostic {
+	var diags []*config.Diagnostic
+
+	if err := validateAuthConfig(conf); err != nil {
+		diags = append(diags, conf.Problem("", "%s", err))
+	}
+	if err := validateRateLimits(conf); err != nil {
+		diags = append(diags, conf.Problem("", "%s", err))
+	}
+	if _, err := time.ParseDuration(conf.Alerts.SilenceDuration); err != nil {
+		diags = append(diags, conf.Problem("alerts.silenceduration", "%s", err))
+	}
+	if _, err := ParseEscalationPolicies(conf); err != nil {
+		diags = append(diags, conf.Problem("escalation", "%s", err))
+	}
+	if _, err := ParseQuietHours(conf); err != nil {
+		diags = append(diags, conf.Problem("quiethours", "%s", err))
+	}
+
+	for id, route := range conf.Routes {
+		if id == "default" {
+			continue
+		}
+		if id == "status" {
+			// Shadowed by the request status path
+			diags = append(diags, conf.Problem("routes.status", "status is reserved, name the route something else and set its alias"))
+			continue
+		}
+
+		handler := utils.FirstString(route.Alias, id)
+		if _, exists := busHandlers[handler]; !exists {
+			key := "routes." + id
+			if route.Alias != "" {
+				key += ".alias"
+			}
+			if len(conf.External) > 0 {
+				// External plugins register their routes when they're
+				// started, which testing the configuration doesn't do
+				diags = append(diags, conf.Warning(key, "no handler named %s, unless an external plugin registers it", handler))
+			} else {
+				diags = append(diags, conf.Problem(key, "no handler named %s, check the alias or that its module is loaded", handler))
+			}
+			continue
+		}
+
+		if check := settingsChecks[handler]; check != nil {
+			for _, err := range check(route.Settings) {
+				diags = append(diags, conf.Problem(fmt.Sprintf("routes.%s.settings.%s", id, err.Setting), "%s", err.Message))
+			}
+		}
+	}
+	return diags
+}
@@ -0,0 +1,238 @@
+package oncall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+)
+
+const usage = "Usage: oncall [NAME] | oncall list | oncall create NAME daily|weekly [DAY] HH:MM MEMBER... [tz=ZONE] [announce=CHANNEL] | " +
+	"oncall delete NAME | oncall override NAME USER DURATION | oncall unoverride ID | oncall holiday NAME add|remove YYYY-MM-DD"
+
+func init() {
+	bot.RegisterCommand("oncall", &bot.Command{
+		Help:    "Show and manage on-call rotations: " + strings.TrimPrefix(usage, "Usage: "),
+		Handler: oncallCmd,
+	})
+
+	msgbus.RegisterMuxHandler("/oncall/", oncallHTTPHandler)
+}
+
+func oncallCmd(b *bot.Bot, event *bot.CommandEvent) error {
+	return b.Reply(event.Post, runCommand(event.Args))
+}
+
+// runCommand runs an oncall command and returns the response. It's shared by
+// the chat and slash commands.
+func runCommand(args []string) string {
+	if len(args) == 0 {
+		return whoCmd(Rotations())
+	}
+
+	switch args[0] {
+	case "who":
+		if len(args) > 1 {
+			return whoCmd(args[1:])
+		}
+		return whoCmd(Rotations())
+
+	case "list":
+		return listCmd()
+
+	case "create":
+		return createCmd(args[1:])
+
+	case "delete":
+		if len(args) != 2 {
+			return "Usage: oncall delete NAME"
+		}
+		if err := DeleteRotation(args[1]); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Deleted rotation %s", args[1])
+
+	case "override":
+		if len(args) != 4 {
+			return "Usage: oncall override NAME USER DURATION"
+		}
+		d, err := time.ParseDuration(args[3])
+		if err != nil {
+			return fmt.Sprintf("Invalid duration %s", args[3])
+		}
+		now := time.Now()
+		o, err := AddOverride(args[1], args[2], now, now.Add(d))
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Override #%d: @%s is on call for %s until %s", o.ID, o.User, o.Rotation, o.End.Format(time.RFC1123))
+
+	case "unoverride":
+		if len(args) != 2 {
+			return "Usage: oncall unoverride ID"
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil || !RemoveOverride(id) {
+			return fmt.Sprintf("Override %s not found", args[1])
+		}
+		return fmt.Sprintf("Removed override #%d", id)
+
+	case "holiday":
+		if len(args) != 4 || (args[2] != "add" && args[2] != "remove") {
+			return "Usage: oncall holiday NAME add|remove YYYY-MM-DD"
+		}
+		if err := SetHoliday(args[1], args[3], args[2] == "add"); err != nil {
+			return err.Error()
+		}
+		if args[2] == "add" {
+			return fmt.Sprintf("Added holiday %s to %s", args[3], args[1])
+		}
+		return fmt.Sprintf("Removed holiday %s from %s", args[3], args[1])
+	}
+
+	if len(args) == 1 {
+		return whoCmd(args)
+	}
+	return usage
+}
+
+func whoCmd(names []string) string {
+	if len(names) == 0 {
+		return "There are no on-call rotations."
+	}
+
+	now := time.Now()
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		shift, err := OnCall(name, now)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("- **%s**: %s", name, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("- **%s**: @%s until %s", name, shift.Member, shift.End.Format(time.RFC1123)))
+	}
+	return "On call:\n\n" + strings.Join(lines, "\n")
+}
+
+func listCmd() string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(rotations) == 0 {
+		return "There are no on-call rotations."
+	}
+
+	var msg strings.Builder
+	msg.WriteString("Rotations:\n")
+	for _, name := range rotationNames() {
+		r := rotations[name]
+		handoff := "daily"
+		if r.weekly {
+			handoff = "weekly on " + r.day.String()
+		}
+		fmt.Fprintf(&msg, "\n- **%s** %s at %02d:%02d %s: %s", name, handoff, r.minute/60, r.minute%60,
+			r.Location, strings.Join(r.Members, ", "))
+	}
+
+	if len(current.Overrides) > 0 {
+		msg.WriteString("\n\nOverrides:\n")
+		for _, o := range current.Overrides {
+			fmt.Fprintf(&msg, "\n- #%d **%s** @%s from %s until %s", o.ID, o.Rotation, o.User,
+				o.Start.Format(time.RFC1123), o.End.Format(time.RFC1123))
+		}
+	}
+	return msg.String()
+}
+
+func createCmd(args []string) string {
+	if len(args) < 4 {
+		return "Usage: oncall create NAME daily|weekly [DAY] HH:MM MEMBER... [tz=ZONE] [announce=CHANNEL]"
+	}
+
+	name := args[0]
+	rc := &config.RotationConfig{Handoff: strings.ToLower(args[1])}
+	args = args[2:]
+
+	if rc.Handoff == "weekly" && !strings.Contains(args[0], ":") {
+		rc.Day = args[0]
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return "Usage: oncall create NAME daily|weekly [DAY] HH:MM MEMBER... [tz=ZONE] [announce=CHANNEL]"
+	}
+	rc.Time = args[0]
+
+	for _, arg := range args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "tz="):
+			rc.Timezone = arg[3:]
+		case strings.HasPrefix(arg, "announce="):
+			rc.Announce = arg[9:]
+		default:
+			rc.Members = append(rc.Members, strings.TrimPrefix(arg, "@"))
+		}
+	}
+	rc.Start = time.Now().Format(dateFormat)
+
+	if err := AddRotation(name, rc); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Created rotation %s", name)
+}
+
+type slashResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+func oncallHTTPHandler(conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/oncall/")
+
+		switch {
+		case p == "slash":
+			slashHandler(conf, w, r)
+		case strings.HasSuffix(p, ".ics"):
+			icalHandler(conf, w, r, strings.TrimSuffix(p, ".ics"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+// slashHandler answers a Mattermost slash command.
+func slashHandler(conf *config.Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+	if token == "" {
+		token = r.PostFormValue("token")
+	}
+	if conf.OnCall.SlashToken == "" || token != conf.OnCall.SlashToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	resp := &slashResponse{
+		ResponseType: "ephemeral",
+		Text:         runCommand(strings.Fields(r.PostFormValue("text"))),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		fmt.Println(err)
+	}
+}
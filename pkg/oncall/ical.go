@@ -0,0 +1,78 @@
+package oncall
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+)
+
+const (
+	icalTimeFormat = "20060102T150405Z"
+	icalPast       = 7 * 24 * time.Hour
+	icalFuture     = 90 * 24 * time.Hour
+)
+
+// icalHandler exports a rotation's shifts and overrides as an iCalendar feed.
+func icalHandler(conf *config.Config, w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if conf.OnCall.ICalToken != "" && r.URL.Query().Get("token") != conf.OnCall.ICalToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	lock.Lock()
+	rotation, exists := rotations[name]
+	var overrides []Override
+	for _, o := range current.Overrides {
+		if o.Rotation == name {
+			overrides = append(overrides, *o)
+		}
+	}
+	lock.Unlock()
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	shifts := rotation.Shifts(now.Add(-icalPast), now.Add(icalFuture))
+
+	var cal strings.Builder
+	cal.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//yobot//oncall//EN\r\n")
+	fmt.Fprintf(&cal, "X-WR-CALNAME:On-call %s\r\n", icalEscape(name))
+
+	for _, s := range shifts {
+		writeEvent(&cal, fmt.Sprintf("%s-%d@yobot", name, s.Start.Unix()), "On call: "+s.Member, s, now)
+	}
+	for _, o := range overrides {
+		s := Shift{Member: o.User, Start: o.Start, End: o.End}
+		writeEvent(&cal, fmt.Sprintf("%s-override-%d@yobot", name, o.ID), "On call (override): "+o.User, s, now)
+	}
+	cal.WriteString("END:VCALENDAR\r\n")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(cal.String()))
+}
+
+func writeEvent(cal *strings.Builder, uid, summary string, s Shift, now time.Time) {
+	cal.WriteString("BEGIN:VEVENT\r\n")
+	fmt.Fprintf(cal, "UID:%s\r\n", icalEscape(uid))
+	fmt.Fprintf(cal, "DTSTAMP:%s\r\n", now.UTC().Format(icalTimeFormat))
+	fmt.Fprintf(cal, "DTSTART:%s\r\n", s.Start.UTC().Format(icalTimeFormat))
+	fmt.Fprintf(cal, "DTEND:%s\r\n", s.End.UTC().Format(icalTimeFormat))
+	fmt.Fprintf(cal, "SUMMARY:%s\r\n", icalEscape(summary))
+	cal.WriteString("END:VEVENT\r\n")
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func icalEscape(s string) string {
+	return icalEscaper.Replace(s)
+}
@@ -0,0 +1,409 @@
+// Package oncall keeps track of who is on call. Rotations are defined in the
+// configuration file or created in chat, and members can be overridden for a
+// period of time.
+package oncall
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+const handoffCheckInterval = time.Minute
+
+var mentionRegex = regexp.MustCompile(`@oncall(?:-([\w.-]+))?\b`)
+
+func init() {
+	msgbus.RegisterMessageFilter(expandMentions)
+	msgbus.RegisterReloadHook(reloadConfig)
+	config.RegisterValidator(validateRotations)
+}
+
+// Override puts User on call for a rotation between Start and End.
+type Override struct {
+	ID       int       `json:"id"`
+	Rotation string    `json:"rotation"`
+	User     string    `json:"user"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// state is everything changed from chat. It's saved in the module data directory.
+type state struct {
+	Rotations map[string]*config.RotationConfig `json:"rotations"`
+	Holidays  map[string][]string               `json:"holidays"`
+	Overrides []*Override                       `json:"overrides"`
+	NextID    int                               `json:"next_id"`
+	Announced map[string]string                 `json:"announced"`
+}
+
+var (
+	lock      sync.Mutex
+	appconf   *config.Config
+	stateFile string
+	current   = &state{}
+	rotations = map[string]*Rotation{}
+)
+
+// Start loads the rotations and starts announcing handoffs.
+func Start(conf *config.Config, quit chan bool) error {
+	lock.Lock()
+	appconf = conf
+	stateFile = filepath.Join(conf.ModuleDataDir("oncall"), "state.json")
+	err := utils.LoadJSONFile(stateFile, current)
+	if err == nil {
+		err = compileRotations()
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(handoffCheckInterval)
+		defer ticker.Stop()
+
+		announceHandoffs(time.Now())
+		for {
+			select {
+			case <-ticker.C:
+				announceHandoffs(time.Now())
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadConfig switches to the rotations of a reloaded configuration. The
+// current rotations are kept if the new ones are invalid.
+func reloadConfig(conf *config.Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if appconf == nil { // Not started
+		return nil
+	}
+
+	old := appconf
+	appconf = conf
+	if err := compileRotations(); err != nil {
+		appconf = old
+		return fmt.Errorf("on-call: %s", err)
+	}
+	return nil
+}
+
+// validateRotations checks the rotations in the configuration file.
+func validateRotations(conf *config.Config) []*config.Diagnostic {
+	var diags []*config.Diagnostic
+	for name, rc := range conf.OnCall.Rotations {
+		if _, err := NewRotation(name, rc); err != nil {
+			diags = append(diags, conf.Problem("oncall.rotations."+name, "%s", err))
+		}
+	}
+	return diags
+}
+
+// compileRotations must be called with the lock held.
+func compileRotations() error {
+	if current.Rotations == nil {
+		current.Rotations = make(map[string]*config.RotationConfig)
+	}
+	if current.Holidays == nil {
+		current.Holidays = make(map[string][]string)
+	}
+	if current.Announced == nil {
+		current.Announced = make(map[string]string)
+	}
+	if current.NextID == 0 {
+		current.NextID = 1
+	}
+
+	compiled := make(map[string]*Rotation, len(appconf.OnCall.Rotations)+len(current.Rotations))
+	add := func(name string, rc *config.RotationConfig) error {
+		merged := *rc
+		merged.Holidays = append(append([]string{}, rc.Holidays...), current.Holidays[name]...)
+
+		r, err := NewRotation(name, &merged)
+		if err != nil {
+			return err
+		}
+		compiled[name] = r
+		return nil
+	}
+
+	for name, rc := range appconf.OnCall.Rotations {
+		if err := add(name, rc); err != nil {
+			return err
+		}
+	}
+	for name, rc := range current.Rotations {
+		if _, exists := compiled[name]; exists {
+			continue // Configuration file takes precedence
+		}
+		if err := add(name, rc); err != nil {
+			return err
+		}
+	}
+
+	rotations = compiled
+	return nil
+}
+
+// save must be called with the lock held.
+func save() {
+	now := time.Now()
+	overrides := current.Overrides[:0]
+	for _, o := range current.Overrides {
+		if now.Before(o.End) {
+			overrides = append(overrides, o)
+		}
+	}
+	current.Overrides = overrides
+
+	if err := utils.SaveJSONFile(stateFile, current); err != nil {
+		fmt.Printf("Failed saving on-call state: %s\n", err)
+	}
+}
+
+// Rotations returns the names of all rotations.
+func Rotations() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	return rotationNames()
+}
+
+// rotationNames must be called with the lock held.
+func rotationNames() []string {
+	names := make([]string, 0, len(rotations))
+	for name := range rotations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OnCall returns the member of a rotation on call at time t.
+func OnCall(name string, t time.Time) (Shift, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	return onCall(name, t)
+}
+
+// onCall must be called with the lock held.
+func onCall(name string, t time.Time) (Shift, error) {
+	r, exists := rotations[name]
+	if !exists {
+		return Shift{}, fmt.Errorf("rotation %s doesn't exist", name)
+	}
+
+	for _, o := range current.Overrides {
+		if o.Rotation == name && !t.Before(o.Start) && t.Before(o.End) {
+			return Shift{Member: o.User, Start: o.Start, End: o.End}, nil
+		}
+	}
+	return r.ShiftAt(t)
+}
+
+// AddRotation creates a rotation from chat.
+func AddRotation(name string, rc *config.RotationConfig) error {
+	if _, err := NewRotation(name, rc); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, exists := rotations[name]; exists {
+		return fmt.Errorf("rotation %s already exists", name)
+	}
+
+	current.Rotations[name] = rc
+	if err := compileRotations(); err != nil {
+		delete(current.Rotations, name)
+		return err
+	}
+	save()
+	return nil
+}
+
+// DeleteRotation removes a rotation created in chat.
+func DeleteRotation(name string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, exists := current.Rotations[name]; !exists {
+		if _, exists := rotations[name]; exists {
+			return errors.New("rotations from the configuration file can't be deleted")
+		}
+		return fmt.Errorf("rotation %s doesn't exist", name)
+	}
+
+	delete(current.Rotations, name)
+	delete(current.Holidays, name)
+	delete(current.Announced, name)
+	compileRotations()
+	save()
+	return nil
+}
+
+// SetHoliday adds or removes a holiday from a rotation.
+func SetHoliday(name, date string, holiday bool) error {
+	if _, err := time.Parse(dateFormat, date); err != nil {
+		return fmt.Errorf("invalid date %s, dates are YYYY-MM-DD", date)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, exists := rotations[name]; !exists {
+		return fmt.Errorf("rotation %s doesn't exist", name)
+	}
+
+	holidays := current.Holidays[name]
+	index := utils.IndexOfString(date, holidays)
+	if holiday && index == -1 {
+		current.Holidays[name] = append(holidays, date)
+	} else if !holiday && index > -1 {
+		current.Holidays[name] = append(holidays[:index], holidays[index+1:]...)
+	}
+
+	if err := compileRotations(); err != nil {
+		return err
+	}
+	save()
+	return nil
+}
+
+// AddOverride puts a user on call for a rotation for a period of time.
+func AddOverride(name, user string, start, end time.Time) (*Override, error) {
+	if !end.After(start) {
+		return nil, errors.New("override must end after it starts")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, exists := rotations[name]; !exists {
+		return nil, fmt.Errorf("rotation %s doesn't exist", name)
+	}
+
+	o := &Override{
+		ID:       current.NextID,
+		Rotation: name,
+		User:     strings.TrimPrefix(user, "@"),
+		Start:    start,
+		End:      end,
+	}
+	current.NextID++
+	current.Overrides = append(current.Overrides, o)
+	save()
+	return o, nil
+}
+
+// RemoveOverride deletes an override.
+func RemoveOverride(id int) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for i, o := range current.Overrides {
+		if o.ID == id {
+			current.Overrides = append(current.Overrides[:i], current.Overrides[i+1:]...)
+			save()
+			return true
+		}
+	}
+	return false
+}
+
+// announceHandoffs posts a message to a rotation's announcement channel
+// when the member on call changes.
+func announceHandoffs(now time.Time) {
+	type handoff struct {
+		channel, msg string
+	}
+	var handoffs []handoff
+
+	lock.Lock()
+	for _, name := range rotationNames() {
+		shift, err := onCall(name, now)
+		if err != nil {
+			continue
+		}
+
+		previous := current.Announced[name]
+		if previous == shift.Member {
+			continue
+		}
+		current.Announced[name] = shift.Member
+
+		r := rotations[name]
+		if r.Announce == "" || previous == "" {
+			continue
+		}
+
+		handoffs = append(handoffs, handoff{
+			channel: r.Announce,
+			msg: fmt.Sprintf("### On-Call\n\n@%s is now on call for **%s** until %s, taking over from @%s.",
+				shift.Member, name, shift.End.In(r.Location).Format(time.RFC1123), previous),
+		})
+	}
+	save()
+	lock.Unlock()
+
+	// Queued so a handoff during a Mattermost outage is posted later
+	for _, h := range handoffs {
+		msgbus.SendMessage(h.channel, h.msg, "")
+	}
+}
+
+// expandMentions replaces @oncall-NAME with the member on call for rotation
+// NAME. @oncall alone is replaced with the members on call for the route's
+// rotation, or every rotation if the route doesn't have one.
+func expandMentions(route, msg string) string {
+	if !strings.Contains(msg, "@oncall") {
+		return msg
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	now := time.Now()
+	return mentionRegex.ReplaceAllStringFunc(msg, func(mention string) string {
+		var names []string
+		if name := mentionRegex.FindStringSubmatch(mention)[1]; name != "" {
+			names = []string{name}
+		} else if rc := appconf.Routes[route]; rc != nil && rc.OnCall != "" {
+			names = []string{rc.OnCall}
+		} else {
+			names = rotationNames()
+		}
+
+		var users []string
+		for _, name := range names {
+			shift, err := onCall(name, now)
+			if err != nil {
+				continue
+			}
+			if user := "@" + shift.Member; !utils.StringInSlice(user, users) {
+				users = append(users, user)
+			}
+		}
+
+		if len(users) == 0 {
+			return mention
+		}
+		return strings.Join(users, " ")
+	})
+}
@@ -0,0 +1,173 @@
+package oncall
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/schedule"
+	"github.com/lfkeitel/yobot/pkg/utils"
+)
+
+const dateFormat = "2006-01-02"
+
+// Rotation is a compiled on-call rotation.
+type Rotation struct {
+	Name     string
+	Members  []string
+	Announce string
+	Location *time.Location
+
+	weekly   bool
+	day      time.Weekday
+	minute   int
+	first    time.Time
+	holidays map[string]bool
+}
+
+// Shift is a period of time a member is on call.
+type Shift struct {
+	Member string
+	Start  time.Time
+	End    time.Time
+}
+
+// NewRotation compiles a rotation configuration.
+func NewRotation(name string, rc *config.RotationConfig) (*Rotation, error) {
+	if len(rc.Members) == 0 {
+		return nil, fmt.Errorf("rotation %s has no members", name)
+	}
+
+	loc, err := schedule.LoadLocation(rc.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("rotation %s: %s", name, err)
+	}
+
+	r := &Rotation{
+		Name:     name,
+		Members:  make([]string, len(rc.Members)),
+		Announce: rc.Announce,
+		Location: loc,
+		holidays: make(map[string]bool, len(rc.Holidays)),
+	}
+	for i, m := range rc.Members {
+		r.Members[i] = strings.TrimPrefix(m, "@")
+	}
+
+	switch strings.ToLower(rc.Handoff) {
+	case "daily":
+	case "", "weekly":
+		r.weekly = true
+		days, err := schedule.ParseDays(strings.ToLower(rc.Day))
+		if rc.Day == "" {
+			days[time.Monday] = true
+		} else if err != nil {
+			return nil, fmt.Errorf("rotation %s: %s", name, err)
+		}
+		r.day = -1
+		for d, set := range days {
+			if set {
+				if r.day != -1 {
+					return nil, fmt.Errorf("rotation %s: weekly handoff must be on one day", name)
+				}
+				r.day = time.Weekday(d)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("rotation %s: handoff must be daily or weekly", name)
+	}
+
+	handoffTime := utils.FirstString(rc.Time, "09:00")
+	if r.minute, err = schedule.ParseClock(handoffTime); err != nil || r.minute >= 24*60 {
+		return nil, fmt.Errorf("rotation %s: invalid handoff time %q", name, handoffTime)
+	}
+
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, loc)
+	if rc.Start != "" {
+		if start, err = time.ParseInLocation(dateFormat, rc.Start, loc); err != nil {
+			return nil, fmt.Errorf("rotation %s: invalid start date %q", name, rc.Start)
+		}
+	}
+	r.first = r.firstHandoff(start)
+
+	for _, h := range rc.Holidays {
+		if _, err := time.Parse(dateFormat, h); err != nil {
+			return nil, fmt.Errorf("rotation %s: invalid holiday %q", name, h)
+		}
+		r.holidays[h] = true
+	}
+	return r, nil
+}
+
+// firstHandoff returns the first handoff on or after the start date.
+func (r *Rotation) firstHandoff(start time.Time) time.Time {
+	h := time.Date(start.Year(), start.Month(), start.Day(), r.minute/60, r.minute%60, 0, 0, r.Location)
+	if r.weekly {
+		for h.Weekday() != r.day {
+			h = h.AddDate(0, 0, 1)
+		}
+	}
+	return h
+}
+
+func (r *Rotation) nextHandoff(h time.Time) time.Time {
+	if r.weekly {
+		return h.AddDate(0, 0, 7)
+	}
+	return h.AddDate(0, 0, 1)
+}
+
+// IsHoliday returns if no handoff happens on the day of t.
+func (r *Rotation) IsHoliday(t time.Time) bool {
+	return r.holidays[t.In(r.Location).Format(dateFormat)]
+}
+
+// ShiftAt returns the regular shift covering t, not taking overrides into
+// account. Handoffs falling on a holiday are skipped so the current member
+// stays on call until the next handoff.
+func (r *Rotation) ShiftAt(t time.Time) (Shift, error) {
+	if t.Before(r.first) {
+		return Shift{}, errors.New("rotation hasn't started")
+	}
+
+	index := 0
+	start := r.first
+	for h := r.nextHandoff(r.first); !h.After(t); h = r.nextHandoff(h) {
+		if r.IsHoliday(h) {
+			continue
+		}
+		index++
+		start = h
+	}
+
+	end := r.nextHandoff(start)
+	for r.IsHoliday(end) {
+		end = r.nextHandoff(end)
+	}
+
+	return Shift{
+		Member: r.Members[index%len(r.Members)],
+		Start:  start,
+		End:    end,
+	}, nil
+}
+
+// Shifts returns the regular shifts overlapping from and to.
+func (r *Rotation) Shifts(from, to time.Time) []Shift {
+	if from.Before(r.first) {
+		from = r.first
+	}
+
+	var shifts []Shift
+	for t := from; t.Before(to); {
+		shift, err := r.ShiftAt(t)
+		if err != nil {
+			break
+		}
+		shifts = append(shifts, shift)
+		t = shift.End
+	}
+	return shifts
+}
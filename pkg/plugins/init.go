@@ -3,38 +3,92 @@ package plugins
 import (
 	"github.com/lfkeitel/yobot/pkg/bot"
 	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/metrics"
 )
 
+// Functions registered by plugins that don't implement Plugin.
 type (
 	InitFunc     func(conf *config.Config, bot *bot.Bot)
 	ShutdownFunc func()
+	ReloadFunc   func(conf *config.Config)
 )
 
 var (
 	inits     = []InitFunc{}
 	shutdowns = []ShutdownFunc{}
+	reloads   = []ReloadFunc{}
 	ran       = false
+	loaded    []string
+
+	pluginPanics = metrics.NewCounter("yobot_plugin_panics_total",
+		"Panics recovered in plugin functions.", "plugin", "stage")
 )
 
+// RegisterInit adds a function called when the bot starts.
+//
+// Deprecated: Implement Plugin and use Register.
 func RegisterInit(init InitFunc) {
 	inits = append(inits, init)
 }
 
+// RegisterShutdown adds a function called when the bot stops.
+//
+// Deprecated: Implement Plugin and use Register.
 func RegisterShutdown(sd ShutdownFunc) {
 	shutdowns = append(shutdowns, sd)
 }
 
-func Init(conf *config.Config, bot *bot.Bot) {
+// RegisterReload adds a function called with the new configuration after
+// it's reloaded.
+//
+// Deprecated: Implement Reloader and use Register.
+func RegisterReload(reload ReloadFunc) {
+	reloads = append(reloads, reload)
+}
+
+// Start initializes and starts the plugins. It only runs once.
+func Start(conf *config.Config, bot *bot.Bot) {
 	if ran {
 		return
 	}
+	ran = true
+
+	startPlugins(conf, bot)
 	for _, init := range inits {
-		init(conf, bot)
+		safeCall("legacy", "init", func() error {
+			init(conf, bot)
+			return nil
+		})
+	}
+}
+
+// Loaded returns the names of the loaded plugin modules.
+func Loaded() []string {
+	names := make([]string, len(loaded))
+	copy(names, loaded)
+	return names
+}
+
+// Reload passes a reloaded configuration to the plugins and returns the
+// errors of plugins that couldn't apply it.
+func Reload(conf *config.Config) []error {
+	errs := reloadPlugins(conf)
+	for _, reload := range reloads {
+		safeCall("legacy", "reload", func() error {
+			reload(conf)
+			return nil
+		})
 	}
+	return errs
 }
 
+// Shutdown stops the plugins.
 func Shutdown() {
 	for _, sd := range shutdowns {
-		sd()
+		safeCall("legacy", "shutdown", func() error {
+			sd()
+			return nil
+		})
 	}
+	stopPlugins()
 }
@@ -0,0 +1,393 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/health"
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+const (
+	initTimeout   = 30 * time.Second
+	startTimeout  = 30 * time.Second
+	stopTimeout   = 5 * time.Second
+	reloadTimeout = 30 * time.Second
+)
+
+// Plugin states
+const (
+	StateRegistered  = "registered"
+	StateInitialized = "initialized"
+	StateRunning     = "running"
+	StateFailed      = "failed"
+	StateStopped     = "stopped"
+)
+
+// Plugin is a component started and stopped with the bot. Plugins are
+// initialized in dependency order, then started in the same order, and
+// stopped in reverse. A plugin that fails or panics is reported and skipped
+// along with the plugins depending on it.
+type Plugin interface {
+	// Name is unique and used in logs, health checks, and DependsOn.
+	Name() string
+
+	// Init checks and keeps the plugin's configuration. It's called before
+	// any plugin is started.
+	Init(ctx context.Context, conf *Config) error
+
+	// Start starts the plugin. ctx is cancelled when the bot stops, goroutines
+	// started by the plugin should end with it.
+	Start(ctx context.Context, b *bot.Bot) error
+
+	// Stop waits for the plugin to stop until ctx is done.
+	Stop(ctx context.Context) error
+}
+
+// HealthChecker is a plugin reporting its health. The check is registered
+// as "plugin NAME" once the plugin is started.
+type HealthChecker interface {
+	Health() error
+}
+
+// Reloader is a plugin applying a reloaded configuration.
+type Reloader interface {
+	Reload(ctx context.Context, conf *Config) error
+}
+
+// Dependent is a plugin that must start after other plugins.
+type Dependent interface {
+	DependsOn() []string
+}
+
+// Config is the configuration given to a plugin. It embeds the whole
+// configuration and decodes the plugin's own [[modules.NAME]] settings.
+type Config struct {
+	*config.Config
+	name string
+}
+
+// Settings returns the instances of the plugin's module configuration.
+func (c *Config) Settings() []map[string]interface{} {
+	return c.Modules[c.name]
+}
+
+// Decode decodes the plugin's settings into v as described by
+// config.DecodeSettings. v is a pointer to a slice of structs, one per
+// instance, or a pointer to a struct if the plugin can only have one
+// instance. Without an instance, a struct is left untouched.
+func (c *Config) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("decode needs a pointer")
+	}
+	if rv.Elem().Kind() == reflect.Slice {
+		return c.DecodeModule(c.name, v)
+	}
+
+	instances := c.Settings()
+	if len(instances) > 1 {
+		return fmt.Errorf("modules.%s can only be set once", c.name)
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+	return config.DecodeSettings(fmt.Sprintf("modules.%s[0]", c.name), instances[0], v)
+}
+
+// DataDir returns the plugin's data directory.
+func (c *Config) DataDir() string {
+	return c.ModuleDataDir(c.name)
+}
+
+// Store returns the plugin's storage namespace.
+func (c *Config) Store() *storage.Store {
+	return storage.Namespace(c.name)
+}
+
+type managed struct {
+	plugin Plugin
+	state  string
+	err    error
+}
+
+var (
+	registry = struct {
+		sync.Mutex
+		plugins []*managed
+		byName  map[string]*managed
+		started []*managed // In start order
+		cancel  context.CancelFunc
+	}{byName: make(map[string]*managed)}
+)
+
+// Register adds a plugin. It's usually called from an init function.
+func Register(p Plugin) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	name := p.Name()
+	if _, exists := registry.byName[name]; exists {
+		panic(fmt.Sprintf("plugin %s is already registered", name))
+	}
+	m := &managed{plugin: p, state: StateRegistered}
+	registry.plugins = append(registry.plugins, m)
+	registry.byName[name] = m
+}
+
+// startPlugins initializes and starts the registered plugins. The registry
+// isn't locked while plugins run so they can use the registry themselves.
+func startPlugins(conf *config.Config, b *bot.Bot) {
+	registry.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.cancel = cancel
+	order := startOrder()
+	registry.Unlock()
+
+	for _, m := range order {
+		registry.Lock()
+		failed := m.state == StateFailed
+		registry.Unlock()
+		if failed {
+			continue
+		}
+		name := m.plugin.Name()
+
+		initCtx, cancelInit := context.WithTimeout(ctx, initTimeout)
+		err := callTimeout(name, "init", initTimeout, func() error {
+			return m.plugin.Init(initCtx, &Config{Config: conf, name: name})
+		})
+		cancelInit()
+
+		registry.Lock()
+		if err != nil {
+			m.fail(fmt.Errorf("init: %s", err))
+		} else {
+			m.state = StateInitialized
+		}
+		registry.Unlock()
+	}
+
+	for _, m := range order {
+		registry.Lock()
+		err := failedDependency(m)
+		if m.state != StateInitialized {
+			registry.Unlock()
+			continue
+		}
+		if err != nil {
+			m.fail(err)
+			registry.Unlock()
+			continue
+		}
+		registry.Unlock()
+
+		name := m.plugin.Name()
+		err = callTimeout(name, "start", startTimeout, func() error { return m.plugin.Start(ctx, b) })
+
+		registry.Lock()
+		if err != nil {
+			m.fail(fmt.Errorf("start: %s", err))
+			registry.Unlock()
+			continue
+		}
+		m.state = StateRunning
+		registry.started = append(registry.started, m)
+		registry.Unlock()
+
+		if hc, ok := m.plugin.(HealthChecker); ok {
+			health.RegisterCheck("plugin "+name, false, func() error {
+				return safeCall(name, "health", hc.Health)
+			})
+		}
+		fmt.Printf("Started plugin %s\n", name)
+	}
+}
+
+// callTimeout calls a plugin's f and returns an error if it doesn't return
+// within timeout. f keeps running in its goroutine, so a stuck plugin only
+// fails itself.
+func callTimeout(plugin, stage string, timeout time.Duration, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- safeCall(plugin, stage, f)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("didn't return in %s", timeout)
+	}
+}
+
+// fail marks a plugin as failed and reports it. It must be called with the
+// registry locked.
+func (m *managed) fail(err error) {
+	name := m.plugin.Name()
+	m.state = StateFailed
+	m.err = err
+	fmt.Printf("Plugin %s failed: %s\n", name, err)
+	health.RegisterCheck("plugin "+name, false, func() error { return err })
+}
+
+// startOrder returns the plugins sorted so each plugin comes after its
+// dependencies. Plugins with missing or circular dependencies are marked as
+// failed. It must be called with the registry locked.
+func startOrder() []*managed {
+	var order []*managed
+	visiting := map[*managed]bool{}
+	visited := map[*managed]bool{}
+
+	var visit func(m *managed) error
+	visit = func(m *managed) error {
+		if visited[m] {
+			return m.err
+		}
+		if visiting[m] {
+			return fmt.Errorf("circular dependency on %s", m.plugin.Name())
+		}
+		visiting[m] = true
+		defer func() { visiting[m] = false }()
+
+		for _, dep := range dependencies(m) {
+			d, exists := registry.byName[dep]
+			if !exists {
+				m.fail(fmt.Errorf("depends on %s which isn't loaded", dep))
+				break
+			}
+			if err := visit(d); err != nil && m.state != StateFailed {
+				m.fail(fmt.Errorf("depends on %s: %s", dep, err))
+			}
+		}
+
+		visited[m] = true
+		order = append(order, m)
+		return m.err
+	}
+
+	for _, m := range registry.plugins {
+		visit(m)
+	}
+	return order
+}
+
+func dependencies(m *managed) []string {
+	if d, ok := m.plugin.(Dependent); ok {
+		return d.DependsOn()
+	}
+	return nil
+}
+
+// failedDependency returns an error if a dependency of m isn't running. It
+// must be called with the registry locked.
+func failedDependency(m *managed) error {
+	for _, dep := range dependencies(m) {
+		if d := registry.byName[dep]; d == nil || d.state != StateRunning {
+			return fmt.Errorf("depends on %s which isn't running", dep)
+		}
+	}
+	return nil
+}
+
+// stopPlugins stops the started plugins in reverse order. Each plugin has
+// stopTimeout to stop.
+func stopPlugins() {
+	registry.Lock()
+	if registry.cancel != nil {
+		registry.cancel()
+	}
+	started := registry.started
+	registry.started = nil
+	registry.Unlock()
+
+	for i := len(started) - 1; i >= 0; i-- {
+		m := started[i]
+		name := m.plugin.Name()
+
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		err := callTimeout(name, "stop", stopTimeout, func() error { return m.plugin.Stop(ctx) })
+		cancel()
+
+		registry.Lock()
+		if err != nil {
+			m.fail(fmt.Errorf("stop: %s", err))
+		} else {
+			m.state = StateStopped
+		}
+		registry.Unlock()
+	}
+}
+
+// reloadPlugins passes a reloaded configuration to running plugins.
+func reloadPlugins(conf *config.Config) []error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	var errs []error
+	for _, m := range registry.started {
+		r, ok := m.plugin.(Reloader)
+		if !ok {
+			continue
+		}
+		name := m.plugin.Name()
+
+		ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+		err := safeCall(name, "reload", func() error {
+			return r.Reload(ctx, &Config{Config: conf, name: name})
+		})
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s: %s", name, err))
+		}
+	}
+	return errs
+}
+
+// Status is the state of a plugin.
+type Status struct {
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	Error     string   `json:"error,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// Statuses returns the state of the registered plugins sorted by name.
+func Statuses() []*Status {
+	registry.Lock()
+	defer registry.Unlock()
+
+	statuses := make([]*Status, len(registry.plugins))
+	for i, m := range registry.plugins {
+		statuses[i] = &Status{
+			Name:      m.plugin.Name(),
+			State:     m.state,
+			DependsOn: dependencies(m),
+		}
+		if m.err != nil {
+			statuses[i].Error = m.err.Error()
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// safeCall calls f and turns a panic into an error.
+func safeCall(plugin, stage string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pluginPanics.Inc(plugin, stage)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
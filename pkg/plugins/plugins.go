@@ -27,6 +27,7 @@ func Load(path string, modules []string) error {
 		if _, err := plugin.Open(p); err != nil {
 			return err
 		}
+		loaded = append(loaded, module)
 		fmt.Printf("Loaded %s\n", module)
 	}
 	return nil
@@ -0,0 +1,200 @@
+package remind
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/schedule"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	usage     = "Usage: remind me|@USER|~CHANNEL|TEAM:CHANNEL WHEN [to] MESSAGE | remind list | remind cancel ID"
+	timeStyle = "Mon Jan 2 15:04 MST"
+)
+
+func init() {
+	bot.RegisterCommand("remind", &bot.Command{
+		Help:    "Set a reminder, like \"remind me in 2h to check the BGP session\" or \"remind ~noc tomorrow 9am the window starts\": " + strings.TrimPrefix(usage, "Usage: "),
+		Handler: remindCmd,
+	})
+}
+
+func remindCmd(b *bot.Bot, event *bot.CommandEvent) error {
+	if len(event.Args) == 0 {
+		return b.Reply(event.Post, usage)
+	}
+
+	loc := userLocation(b, event.Post.UserId)
+	switch strings.ToLower(event.Args[0]) {
+	case "list":
+		return b.Reply(event.Post, listCmd(event.Post.UserId, loc))
+
+	case "cancel", "delete":
+		if len(event.Args) != 2 {
+			return b.Reply(event.Post, "Usage: remind cancel ID")
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(event.Args[1], "#"), 10, 64)
+		if err != nil {
+			return b.Reply(event.Post, "Usage: remind cancel ID")
+		}
+		if err := Cancel(id, event.Post.UserId); err != nil {
+			return b.Reply(event.Post, err.Error())
+		}
+		return b.Reply(event.Post, fmt.Sprintf("Cancelled reminder %d", id))
+	}
+	return b.Reply(event.Post, addCmd(b, event, loc))
+}
+
+func listCmd(userID string, loc *time.Location) string {
+	list, err := List(userID)
+	if err != nil {
+		return fmt.Sprintf("Error: %s", err)
+	}
+	if len(list) == 0 {
+		return "You don't have any reminders."
+	}
+
+	now := time.Now()
+	var msg strings.Builder
+	msg.WriteString("Your reminders:\n")
+	for _, r := range list {
+		fmt.Fprintf(&msg, "\n- **%d** %s (in %s) for %s: %s", r.ID, r.At.In(loc).Format(timeStyle),
+			formatDuration(r.At.Sub(now)), r.Target, firstLine(r.Message))
+	}
+	return msg.String()
+}
+
+// addCmd parses "TARGET WHEN [to] MESSAGE".
+func addCmd(b *bot.Bot, event *bot.CommandEvent, loc *time.Location) string {
+	if len(event.Args) < 3 {
+		return usage
+	}
+
+	now := time.Now().In(loc)
+	at, rest, err := parseWhen(event.Args[1:], now)
+	if err != nil {
+		return err.Error()
+	}
+	if len(rest) > 0 && (strings.EqualFold(rest[0], "to") || strings.EqualFold(rest[0], "that")) {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return "What should I remind about? " + usage
+	}
+
+	r := &Reminder{
+		UserID:   event.Post.UserId,
+		Username: b.Username(event.Post.UserId),
+		Target:   event.Args[0],
+		Message:  messageText(event.Post.Message, rest),
+		At:       at,
+		Timezone: loc.String(),
+	}
+	if err := resolveTarget(b, event, r); err != nil {
+		return err.Error()
+	}
+	if err := Add(r); err != nil {
+		return err.Error()
+	}
+
+	who := r.Target
+	if r.Target == "me" {
+		who = "you"
+	}
+	return fmt.Sprintf("I'll remind %s %s (in %s). Cancel with `remind cancel %d`.",
+		who, at.Format(timeStyle), formatDuration(at.Sub(time.Now())), r.ID)
+}
+
+// resolveTarget sets the channel a reminder is posted to. Reminders posted
+// in the channel of the request are replies in its thread.
+func resolveTarget(b *bot.Bot, event *bot.CommandEvent, r *Reminder) error {
+	post := event.Post
+	request, err := b.GetChannel(post.ChannelId)
+	if err != nil {
+		return err
+	}
+
+	var channel *model.Channel
+	target := r.Target
+	switch {
+	case strings.EqualFold(target, "me"):
+		r.Target = "me"
+		if request.Type == model.CHANNEL_DIRECT {
+			channel = request
+		} else {
+			channel, err = b.FindDirectChannel(r.Username)
+			r.Link = fmt.Sprintf("%s/_redirect/pl/%s", strings.TrimSuffix(event.Config.Mattermost.Server, "/"), post.Id)
+		}
+
+	case strings.HasPrefix(target, "@"):
+		channel, err = b.FindDirectChannel(target[1:])
+
+	case strings.Contains(target, ":"):
+		channel, err = b.FindChannelWithTeam(target)
+
+	case strings.HasPrefix(target, "~"), strings.HasPrefix(target, "#"):
+		if request.TeamId == "" {
+			return fmt.Errorf("I don't know the team of %s here, use TEAM:CHANNEL", target)
+		}
+		r.Target = "~" + target[1:]
+		channel, err = b.FindChannel(target[1:], request.TeamId)
+
+	default:
+		return fmt.Errorf("I don't know who %s is. %s", target, usage)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", target, err)
+	}
+
+	r.ChannelID = channel.Id
+	if channel.Id == post.ChannelId {
+		r.RootID = post.RootId
+		if r.RootID == "" {
+			r.RootID = post.Id
+		}
+	}
+	return nil
+}
+
+// userLocation returns the time zone in a user's Mattermost profile or the
+// local time zone.
+func userLocation(b *bot.Bot, userID string) *time.Location {
+	user, err := b.GetUser(userID)
+	if err != nil {
+		return time.Local
+	}
+	loc, err := schedule.LoadLocation(user.GetPreferredTimezone())
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// messageText returns the message from the post so it keeps its formatting.
+// words are the last words of the post, split like strings.Fields.
+func messageText(post string, words []string) string {
+	fields := strings.Fields(post)
+	if len(fields) < len(words) {
+		return strings.Join(words, " ")
+	}
+
+	skip := len(fields) - len(words)
+	text := post
+	for i := 0; i < skip; i++ {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		text = text[len(fields[i]):]
+	}
+	return strings.TrimSpace(text)
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + "..."
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package remind
+
+import "testing"
+
+func TestMessageText(t *testing.T) {
+	tests := []struct {
+		post  string
+		words []string
+		want  string
+	}{
+		{
+			post:  "remind me in 2h to **check** the  BGP session",
+			words: []string{"**check**", "the", "BGP", "session"},
+			want:  "**check** the  BGP session",
+		},
+		{
+			post:  "remind me in 2h\nline one\n\n- line two\n",
+			words: []string{"line", "one", "-", "line", "two"},
+			want:  "line one\n\n- line two",
+		},
+		{
+			post:  "remind\u00a0me in\u00a02h check\u00a0it",
+			words: []string{"check", "it"},
+			want:  "check\u00a0it",
+		},
+		{
+			post:  "remind me\u2003tomorrow\u3000the window starts",
+			words: []string{"the", "window", "starts"},
+			want:  "the window starts",
+		},
+		{
+			post:  "check",
+			words: []string{"check", "it"},
+			want:  "check it",
+		},
+	}
+
+	for _, test := range tests {
+		if got := messageText(test.post, test.words); got != test.want {
+			t.Errorf("messageText(%q) = %q, expected %q", test.post, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package remind delivers reminders users create in chat. Reminders are kept
+// in storage so they survive restarts.
+package remind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/jobs"
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+const (
+	checkInterval = 10 * time.Second
+
+	// Reminders that can't be posted are retried for this long
+	retryFor = time.Hour
+)
+
+// Reminder is a message posted to a channel at a time. A reminder for the
+// user who created it in another channel is sent as a direct message with a
+// link to the request.
+type Reminder struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Target    string    `json:"target"` // "me", "@user", "~channel", or "team:channel"
+	ChannelID string    `json:"channel_id"`
+	RootID    string    `json:"root_id,omitempty"`
+	Link      string    `json:"link,omitempty"`
+	Message   string    `json:"message"`
+	At        time.Time `json:"at"`
+	Timezone  string    `json:"timezone,omitempty"`
+	Created   time.Time `json:"created"`
+	Failing   time.Time `json:"failing,omitempty"` // First failed delivery
+}
+
+var (
+	// Held while delivering so a cancelled reminder isn't posted
+	lock  sync.Mutex
+	store = storage.Namespace("reminders")
+)
+
+// Start adds the job delivering reminders.
+func Start() error {
+	return jobs.Add(&jobs.Job{
+		Name:  "remind/deliver",
+		Every: checkInterval,
+		Run:   deliver,
+	})
+}
+
+func key(id int64) string {
+	return fmt.Sprintf("reminder/%08d", id)
+}
+
+// Add saves a reminder and assigns its ID.
+func Add(r *Reminder) error {
+	if !r.At.After(time.Now()) {
+		return errors.New("that time has already passed")
+	}
+
+	id, err := store.Incr("next_id", 1)
+	if err != nil {
+		return err
+	}
+	r.ID = id
+	r.Created = time.Now()
+	return store.Set(key(id), r)
+}
+
+// Cancel removes a reminder created by a user.
+func Cancel(id int64, userID string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	r := &Reminder{}
+	found, err := store.Get(key(id), r)
+	if err != nil {
+		return err
+	}
+	if !found || r.UserID != userID {
+		return fmt.Errorf("you don't have a reminder %d", id)
+	}
+	return store.Delete(key(id))
+}
+
+// List returns the reminders sorted by time. With a user ID only that user's
+// reminders are returned.
+func List(userID string) ([]*Reminder, error) {
+	keys, err := store.Keys("reminder/")
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Reminder, 0, len(keys))
+	for _, k := range keys {
+		r := &Reminder{}
+		if found, err := store.Get(k, r); err != nil {
+			return nil, err
+		} else if !found {
+			continue
+		}
+		if userID == "" || r.UserID == userID {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list, nil
+}
+
+// deliver posts the reminders that are due. Reminders missed while Yobot was
+// stopped are posted late.
+func deliver(ctx context.Context) error {
+	list, err := List("")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if len(list) == 0 || list[0].At.After(now) {
+		return nil
+	}
+
+	b := bot.GetBot()
+	if b == nil {
+		return errors.New("bot isn't running")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var failed int
+	for _, r := range list {
+		if r.At.After(now) || ctx.Err() != nil {
+			break
+		}
+		if found, _ := store.Get(key(r.ID), &Reminder{}); !found {
+			continue // Cancelled
+		}
+
+		if err := b.SendMsgChannel(r.ChannelID, r.text(now), r.RootID); err != nil {
+			failed++
+			if r.Failing.IsZero() {
+				r.Failing = now
+				store.Set(key(r.ID), r)
+			} else if now.Sub(r.Failing) > retryFor {
+				fmt.Printf("Dropping reminder %d for %s to %s after failing for %s: %s\n",
+					r.ID, r.Username, r.Target, retryFor, err)
+				store.Delete(key(r.ID))
+			}
+			continue
+		}
+		if err := store.Delete(key(r.ID)); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d reminders couldn't be posted", failed)
+	}
+	return nil
+}
+
+// text is the message posted for a reminder.
+func (r *Reminder) text(now time.Time) string {
+	msg := "Reminder: " + r.Message
+	if r.Target != "me" {
+		msg = fmt.Sprintf("Reminder from @%s: %s", r.Username, r.Message)
+	}
+	if late := now.Sub(r.At); late > 5*time.Minute {
+		msg += fmt.Sprintf("\n\n_This reminder is %s late._", formatDuration(late))
+	}
+	if r.Link != "" {
+		msg += fmt.Sprintf("\n\n[Original request](%s)", r.Link)
+	}
+	return msg
+}
@@ -0,0 +1,237 @@
+package remind
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/schedule"
+)
+
+// defaultTime is used for days given without a time, 09:00.
+const defaultTime = 9 * 60
+
+var errNoTime = errors.New("the time must be given like \"in 2h\", \"tomorrow 9am\", \"at 15:00\", \"friday at noon\", or \"on 2024-06-01 at 8:00\"")
+
+var (
+	compactDuration = regexp.MustCompile(`^(\d+[a-z]+)+$`)
+	durationPart    = regexp.MustCompile(`(\d+)([a-z]+)`)
+)
+
+var durationUnits = map[string]time.Duration{
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tues": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thurs": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// parseWhen parses the time at the start of words in now's location and
+// returns it with the words after it:
+//
+//	in 2h, in 1 hour 30 minutes, in 3 days
+//	tomorrow, tomorrow 9am, tomorrow at 14:30
+//	today at 5pm, at 5pm
+//	friday, on friday at noon
+//	2024-06-01, on 2024-06-01 at 8:00
+//
+// Days without a time are at 09:00. A time without a day that has already
+// passed today is tomorrow.
+func parseWhen(words []string, now time.Time) (time.Time, []string, error) {
+	if len(words) == 0 {
+		return time.Time{}, nil, errNoTime
+	}
+
+	first := strings.ToLower(words[0])
+	if first == "in" {
+		d, n, err := parseDuration(words[1:])
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		return now.Add(d).Truncate(time.Second), words[1+n:], nil
+	}
+	if first == "on" && len(words) > 1 {
+		words = words[1:]
+		first = strings.ToLower(words[0])
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch {
+	case first == "today":
+		minutes, rest, err := parseAt(words[1:], true)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		return atMinutes(today, minutes), rest, nil
+
+	case first == "tomorrow":
+		minutes, rest, err := parseAt(words[1:], false)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		return atMinutes(today.AddDate(0, 0, 1), minutes), rest, nil
+
+	case first == "at":
+		minutes, rest, err := parseAt(words, true)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		t := atMinutes(today, minutes)
+		if !t.After(now) {
+			t = atMinutes(today.AddDate(0, 0, 1), minutes)
+		}
+		return t, rest, nil
+	}
+
+	if day, exists := weekdays[first]; exists {
+		minutes, rest, err := parseAt(words[1:], false)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		// The next one, today if the time hasn't passed yet
+		offset := (int(day) - int(now.Weekday()) + 7) % 7
+		t := atMinutes(today.AddDate(0, 0, offset), minutes)
+		if !t.After(now) {
+			t = atMinutes(today.AddDate(0, 0, offset+7), minutes)
+		}
+		return t, rest, nil
+	}
+
+	if date, err := time.ParseInLocation("2006-01-02", first, now.Location()); err == nil {
+		minutes, rest, err := parseAt(words[1:], false)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		return atMinutes(date, minutes), rest, nil
+	}
+
+	// A bare time like "5pm"
+	if minutes, err := schedule.ParseTimeOfDay(first); err == nil {
+		t := atMinutes(today, minutes)
+		if !t.After(now) {
+			t = atMinutes(today.AddDate(0, 0, 1), minutes)
+		}
+		return t, words[1:], nil
+	}
+	return time.Time{}, nil, errNoTime
+}
+
+// parseDuration parses durations like "2h", "1h30m", "90 minutes", or
+// "1 hour and 30 minutes" at the start of words. It returns the number of
+// words used.
+func parseDuration(words []string) (time.Duration, int, error) {
+	var total time.Duration
+	n := 0
+	for n < len(words) {
+		word := strings.ToLower(words[n])
+		if word == "and" && n > 0 {
+			n++
+			continue
+		}
+
+		if d, ok := parseCompactDuration(word); ok {
+			total += d
+			n++
+			continue
+		}
+
+		count, err := strconv.Atoi(word)
+		if err != nil || n+1 >= len(words) {
+			break
+		}
+		unit, exists := durationUnits[strings.ToLower(words[n+1])]
+		if !exists {
+			break
+		}
+		total += time.Duration(count) * unit
+		n += 2
+	}
+
+	// A trailing "and" belongs to the message
+	if n > 0 && strings.ToLower(words[n-1]) == "and" {
+		n--
+	}
+	if total <= 0 {
+		return 0, 0, errors.New("the duration must be given like \"in 2h\" or \"in 1 hour 30 minutes\"")
+	}
+	return total, n, nil
+}
+
+// parseCompactDuration parses a word like "2h", "45min", or "1h30m".
+func parseCompactDuration(word string) (time.Duration, bool) {
+	if !compactDuration.MatchString(word) {
+		return 0, false
+	}
+
+	var total time.Duration
+	for _, part := range durationPart.FindAllStringSubmatch(word, -1) {
+		unit, exists := durationUnits[part[2]]
+		if !exists {
+			return 0, false
+		}
+		count, _ := strconv.Atoi(part[1])
+		total += time.Duration(count) * unit
+	}
+	return total, true
+}
+
+// parseAt parses an optional "[at] TIME" at the start of words. Without a
+// time it returns 09:00, or an error if required is set.
+func parseAt(words []string, required bool) (int, []string, error) {
+	at := len(words) > 0 && strings.ToLower(words[0]) == "at"
+	if at {
+		words = words[1:]
+	}
+	if len(words) > 0 {
+		if minutes, err := schedule.ParseTimeOfDay(words[0]); err == nil {
+			return minutes, words[1:], nil
+		} else if at {
+			return 0, nil, err
+		}
+	}
+	if at || required {
+		return 0, nil, errors.New("the time must be given like \"at 9:00\" or \"at 3pm\"")
+	}
+	return defaultTime, words, nil
+}
+
+// atMinutes returns the time minutes after the start of day.
+func atMinutes(day time.Time, minutes int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minutes/60, minutes%60, 0, 0, day.Location())
+}
+
+// formatDuration formats how long until a reminder like "2d 3h" or "15m".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "less than a minute"
+	}
+
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+
+	var parts []string
+	if days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if hours > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", hours))
+	}
+	if minutes > 0 && days == 0 {
+		parts = append(parts, fmt.Sprintf("%dm", minutes))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,109 @@
+package remind
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWhen(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, chicago)
+	}
+	now := at(10, 19, 10, 30) // A Monday
+
+	tests := []struct {
+		words string
+		want  time.Time
+		rest  string
+		err   bool
+	}{
+		{words: "in 2h to check", want: at(10, 19, 12, 30), rest: "to check"},
+		{words: "in 1h30m check", want: at(10, 19, 12, 0), rest: "check"},
+		{words: "in 1 hour and 30 minutes and then", want: at(10, 19, 12, 0), rest: "and then"},
+		{words: "in 3 days", want: at(10, 22, 10, 30)},
+		{words: "in soon", err: true},
+		{words: "in", err: true},
+		{words: "tomorrow check", want: at(10, 20, 9, 0), rest: "check"},
+		{words: "tomorrow 9am check", want: at(10, 20, 9, 0), rest: "check"},
+		{words: "Tomorrow at 14:30", want: at(10, 20, 14, 30)},
+		{words: "tomorrow at soon", err: true},
+		{words: "today at 5pm check", want: at(10, 19, 17, 0), rest: "check"},
+		{words: "today check", err: true},
+		{words: "at 5pm", want: at(10, 19, 17, 0)},
+		{words: "at 9am", want: at(10, 20, 9, 0)},
+		{words: "at 10:30", want: at(10, 20, 10, 30)},
+		{words: "friday check", want: at(10, 23, 9, 0), rest: "check"},
+		{words: "on Friday at noon", want: at(10, 23, 12, 0)},
+		{words: "monday at 11am", want: at(10, 19, 11, 0)},
+		{words: "mon at 10am", want: at(10, 26, 10, 0)},
+		{words: "mon", want: at(10, 26, 9, 0)},
+		{words: "2026-12-01 check", want: at(12, 1, 9, 0), rest: "check"},
+		{words: "on 2026-12-01 at 8:00", want: at(12, 1, 8, 0)},
+		{words: "5pm check", want: at(10, 19, 17, 0), rest: "check"},
+		{words: "10am", want: at(10, 20, 10, 0)},
+		{words: "soon", err: true},
+		{words: "", err: true},
+	}
+
+	for _, test := range tests {
+		got, rest, err := parseWhen(strings.Fields(test.words), now)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseWhen(%q) = %s, expected an error", test.words, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseWhen(%q): %s", test.words, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("parseWhen(%q) = %s, expected %s", test.words, got, test.want)
+		}
+		if strings.Join(rest, " ") != test.rest {
+			t.Errorf("parseWhen(%q) left %q, expected %q", test.words, rest, test.rest)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		words string
+		want  time.Duration
+		n     int
+		err   bool
+	}{
+		{words: "2h", want: 2 * time.Hour, n: 1},
+		{words: "45min check", want: 45 * time.Minute, n: 1},
+		{words: "1h30m and check", want: 90 * time.Minute, n: 1},
+		{words: "2h 15m", want: 2*time.Hour + 15*time.Minute, n: 2},
+		{words: "90 Minutes", want: 90 * time.Minute, n: 2},
+		{words: "1 week 2 days", want: 9 * 24 * time.Hour, n: 4},
+		{words: "1 hour and 30 minutes", want: 90 * time.Minute, n: 5},
+		{words: "0h", err: true},
+		{words: "2x", err: true},
+		{words: "2 parsecs", err: true},
+		{words: "and 2h", err: true},
+		{words: "", err: true},
+	}
+
+	for _, test := range tests {
+		got, n, err := parseDuration(strings.Fields(test.words))
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDuration(%q) = %s, expected an error", test.words, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDuration(%q): %s", test.words, err)
+		} else if got != test.want || n != test.n {
+			t.Errorf("parseDuration(%q) = %s, %d, expected %s, %d", test.words, got, n, test.want, test.n)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Cron is a cron expression with the fields minute, hour, day of month,
+// month, and day of week. Each field is a bit set of the values it matches.
+type Cron struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	anyDay                        bool // Day of month or week is *
+}
+
+// cronField is the range and names of the values of a field.
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: monthNames},
+	{name: "day of week", min: 0, max: 7},
+}
+
+// ParseCron parses a cron expression such as "*/15 9-17 * * mon-fri". Fields
+// are lists of values, ranges, and steps, months and days can be given by
+// name, and 7 is also Sunday. The macros @hourly, @daily, @weekly, @monthly,
+// and @yearly are supported. As in cron, when both the day of month and the
+// day of week are restricted, a day matching either matches.
+//
+// Phrases starting with "every" are also accepted:
+//
+//	every hour
+//	every day at 9:00
+//	every weekday at 8:30am
+//	every mon,wed and fri at 3pm
+//	every month on the 1st at noon
+func ParseCron(spec string) (*Cron, error) {
+	expr := strings.ToLower(strings.TrimSpace(spec))
+	if macro, exists := cronMacros[expr]; exists {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && (fields[0] == "every" || fields[0] == "each") {
+		var err error
+		if expr, err = phraseToCron(fields[1:]); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s", spec, err)
+		}
+		fields = strings.Fields(expr)
+	}
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, it needs 5 fields", spec)
+	}
+
+	sets := make([]uint64, 5)
+	for i, field := range fields {
+		set, err := cronFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s", spec, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday is 0 and 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	c := &Cron{
+		spec:   strings.TrimSpace(spec),
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDay: strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*"),
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", spec)
+	}
+	return c, nil
+}
+
+func (f *cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		start, end := f.min, f.max
+		if part != "*" {
+			span := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = f.value(span[0]); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(span) == 2 {
+				if end, err = f.value(span[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = f.max // "5/10" is every 10 from 5
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid %s range %q", f.name, part)
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (f *cronField) value(s string) (int, error) {
+	if v, exists := f.names[s]; exists {
+		return v, nil
+	}
+	if f.name == "day of week" {
+		if d, exists := dayNames[s]; exists {
+			return int(d), nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+func (c *Cron) String() string {
+	return c.spec
+}
+
+// everyHour is the hour field of expressions like "0 * * * *".
+const everyHour = 1<<24 - 1
+
+// Next returns the first time after t matching the expression in t's
+// location. It returns the zero time if nothing matches in the next five
+// years, such as for February 30.
+//
+// When clocks are turned forward, times in the skipped hour don't match.
+// When they're turned back, times in the repeated hour only match once,
+// unless the hour field matches every hour.
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		if c.hour != everyHour && repeated(t) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// repeated returns if the wall clock time of t already happened earlier
+// because clocks were turned back.
+func repeated(t time.Time) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-2 * time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+	earlier := t.Add(-time.Duration(before-offset) * time.Second)
+	return earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
+
+func (c *Cron) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// phraseToCron converts the words after "every" in a schedule phrase to a
+// cron expression.
+func phraseToCron(words []string) (string, error) {
+	if len(words) == 1 && words[0] == "hour" {
+		return "0 * * * *", nil
+	}
+
+	// The time is required for everything else
+	at := -1
+	for i, word := range words {
+		if word == "at" {
+			at = i
+		}
+	}
+	if at < 1 || at != len(words)-2 {
+		return "", errors.New("the time must be given at the end like \"at 9:00\"")
+	}
+	minute, err := ParseTimeOfDay(words[at+1])
+	if err != nil {
+		return "", err
+	}
+	if minute == 24*60 {
+		minute = 0
+	}
+	words = words[:at]
+
+	dom, dow := "*", "*"
+	switch {
+	case len(words) == 1 && words[0] == "day":
+	case len(words) == 1 && (words[0] == "weekday" || words[0] == "weekdays"):
+		dow = "1-5"
+	case len(words) == 1 && (words[0] == "weekend" || words[0] == "weekends"):
+		dow = "0,6"
+	case words[0] == "month":
+		// month on [the] DAY
+		if len(words) < 3 || words[1] != "on" {
+			return "", errors.New("the day of the month must be given like \"every month on the 1st\"")
+		}
+		day := strings.TrimRight(words[len(words)-1], "stndrh")
+		if len(words) > 4 || (len(words) == 4 && words[2] != "the") {
+			return "", errors.New("the day of the month must be given like \"every month on the 1st\"")
+		}
+		if n, err := strconv.Atoi(day); err != nil || n < 1 || n > 31 {
+			return "", fmt.Errorf("invalid day of the month %q", words[len(words)-1])
+		}
+		dom = day
+	default:
+		days, err := phraseDays(words)
+		if err != nil {
+			return "", err
+		}
+		dow = days
+	}
+	return fmt.Sprintf("%d %d %s * %s", minute%60, minute/60, dom, dow), nil
+}
+
+var fullDayNames = map[string]string{
+	"sunday": "sun", "monday": "mon", "tuesday": "tue", "wednesday": "wed",
+	"thursday": "thu", "friday": "fri", "saturday": "sat",
+}
+
+// phraseDays converts day names like "mon,wed and fridays" or "mon-fri" to
+// the day of week field of a cron expression.
+func phraseDays(words []string) (string, error) {
+	var days []string
+	for _, word := range words {
+		for _, name := range strings.Split(word, ",") {
+			if name == "" || name == "and" {
+				continue
+			}
+			span := strings.SplitN(name, "-", 2)
+			for i, day := range span {
+				day = strings.TrimSuffix(day, "s")
+				if short, exists := fullDayNames[day]; exists {
+					day = short
+				}
+				if _, exists := dayNames[day]; !exists {
+					return "", fmt.Errorf("unknown day %q", name)
+				}
+				span[i] = day
+			}
+			days = append(days, strings.Join(span, "-"))
+		}
+	}
+	if len(days) == 0 {
+		return "", errors.New("days are required")
+	}
+	return strings.Join(days, ","), nil
+}
+
+// ParseTimeOfDay parses a time like "15:00", "3pm", "3:30pm", "noon", or
+// "midnight" and returns the number of minutes since midnight.
+func ParseTimeOfDay(s string) (int, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case "noon":
+		return 12 * 60, nil
+	case "midnight":
+		return 0, nil
+	}
+
+	pm := strings.HasSuffix(s, "pm")
+	if !pm && !strings.HasSuffix(s, "am") {
+		return ParseClock(s)
+	}
+
+	clock := strings.TrimSuffix(strings.TrimSuffix(s, "pm"), "am")
+	if !strings.Contains(clock, ":") {
+		clock += ":00"
+	}
+	minutes, err := ParseClock(clock)
+	if err != nil || minutes < 60 || minutes >= 13*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	// 12am is midnight and 12pm is noon
+	minutes %= 12 * 60
+	if pm {
+		minutes += 12 * 60
+	}
+	return minutes, nil
+}
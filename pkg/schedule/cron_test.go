@@ -0,0 +1,232 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 * ",
+		"* * * * 8",
+		"* * * foo *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"0 0 30 2 *",
+		"@often",
+		"every",
+		"every day",
+		"every day at 25:00",
+		"every blursday at 9:00",
+		"every month at 9:00",
+		"every month on the 32nd at 9:00",
+		"every 13pm",
+	}
+
+	for _, spec := range tests {
+		if c, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) = %q, expected an error", spec, c)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, chicago)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		{
+			name: "every minute",
+			spec: "* * * * *",
+			from: at(2026, 10, 19, 10, 30).Add(30 * time.Second),
+			want: []time.Time{at(2026, 10, 19, 10, 31), at(2026, 10, 19, 10, 32)},
+		},
+		{
+			name: "steps and ranges",
+			spec: "*/20 9-10 * * *",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 10, 19, 10, 40), at(2026, 10, 20, 9, 0), at(2026, 10, 20, 9, 20)},
+		},
+		{
+			name: "end of month",
+			spec: "0 12 31 * *",
+			from: at(2026, 10, 31, 12, 0),
+			want: []time.Time{at(2026, 12, 31, 12, 0), at(2027, 1, 31, 12, 0), at(2027, 3, 31, 12, 0)},
+		},
+		{
+			name: "end of year",
+			spec: "@daily",
+			from: at(2026, 12, 31, 8, 0),
+			want: []time.Time{at(2027, 1, 1, 0, 0), at(2027, 1, 2, 0, 0)},
+		},
+		{
+			name: "leap day",
+			spec: "0 0 29 2 *",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2028, 2, 29, 0, 0), at(2032, 2, 29, 0, 0)},
+		},
+		{
+			name: "weekdays",
+			spec: "30 8 * * mon-fri",
+			from: at(2026, 10, 23, 9, 0),
+			want: []time.Time{at(2026, 10, 26, 8, 30), at(2026, 10, 27, 8, 30)},
+		},
+		{
+			name: "sunday is 7",
+			spec: "0 9 * * 7",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 10, 25, 9, 0), at(2026, 11, 1, 9, 0)},
+		},
+		{
+			name: "day of month or week",
+			spec: "0 9 1 * fri",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 10, 23, 9, 0), at(2026, 10, 30, 9, 0), at(2026, 11, 1, 9, 0)},
+		},
+		{
+			name: "day of month and every week",
+			spec: "0 9 1 * */1",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 11, 1, 9, 0), at(2026, 12, 1, 9, 0)},
+		},
+		{
+			name: "months by name",
+			spec: "0 0 1 jan,jul *",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2027, 1, 1, 0, 0), at(2027, 7, 1, 0, 0)},
+		},
+		{
+			name: "skipped hour when clocks go forward",
+			spec: "30 2 * * *",
+			from: at(2026, 3, 7, 3, 0),
+			want: []time.Time{at(2026, 3, 9, 2, 30)},
+		},
+		{
+			name: "hourly when clocks go forward",
+			spec: "@hourly",
+			from: at(2026, 3, 8, 0, 30),
+			want: []time.Time{at(2026, 3, 8, 1, 0), at(2026, 3, 8, 3, 0), at(2026, 3, 8, 4, 0)},
+		},
+		{
+			name: "repeated hour when clocks go back",
+			spec: "30 1 * * *",
+			from: at(2026, 11, 1, 0, 0),
+			want: []time.Time{at(2026, 11, 1, 1, 30), at(2026, 11, 2, 1, 30)},
+		},
+		{
+			name: "hourly when clocks go back",
+			spec: "0 * * * *",
+			from: at(2026, 11, 1, 0, 30),
+			want: []time.Time{
+				at(2026, 11, 1, 1, 0),
+				at(2026, 11, 1, 1, 0).Add(time.Hour), // 01:00 CST
+				at(2026, 11, 1, 2, 0),
+			},
+		},
+		{
+			name: "every day phrase",
+			spec: "every day at 12am",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 10, 20, 0, 0)},
+		},
+		{
+			name: "every weekday phrase",
+			spec: "every weekday at 12pm",
+			from: at(2026, 10, 23, 12, 0),
+			want: []time.Time{at(2026, 10, 26, 12, 0)},
+		},
+		{
+			name: "every days phrase",
+			spec: "Every Mon,Wednesday and fridays at 3:15pm",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 10, 19, 15, 15), at(2026, 10, 21, 15, 15), at(2026, 10, 23, 15, 15)},
+		},
+		{
+			name: "every month phrase",
+			spec: "every month on the 1st at noon",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 11, 1, 12, 0), at(2026, 12, 1, 12, 0)},
+		},
+		{
+			name: "every hour phrase",
+			spec: "every hour",
+			from: at(2026, 10, 19, 10, 30),
+			want: []time.Time{at(2026, 10, 19, 11, 0)},
+		},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("%s: ParseCron(%q): %s", test.name, test.spec, err)
+			continue
+		}
+
+		from := test.from
+		for _, want := range test.want {
+			got := c.Next(from)
+			if !got.Equal(want) {
+				t.Errorf("%s: Next(%s) = %s, expected %s", test.name, from, got, want)
+				break
+			}
+			from = got
+		}
+	}
+}
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		err  bool
+	}{
+		{s: "15:00", want: 15 * 60},
+		{s: "9:05", want: 9*60 + 5},
+		{s: "3pm", want: 15 * 60},
+		{s: "3:30PM", want: 15*60 + 30},
+		{s: "8am", want: 8 * 60},
+		{s: "12am", want: 0},
+		{s: "12pm", want: 12 * 60},
+		{s: "12:30am", want: 30},
+		{s: "noon", want: 12 * 60},
+		{s: "midnight", want: 0},
+		{s: "0pm", err: true},
+		{s: "13pm", err: true},
+		{s: "25:00", err: true},
+		{s: "9:60", err: true},
+		{s: "soon", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTimeOfDay(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseTimeOfDay(%q) = %d, expected an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTimeOfDay(%q): %s", test.s, err)
+		} else if got != test.want {
+			t.Errorf("ParseTimeOfDay(%q) = %d, expected %d", test.s, got, test.want)
+		}
+	}
+}
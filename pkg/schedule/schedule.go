@@ -0,0 +1,207 @@
+// Package schedule implements weekly time range schedules such as
+// "mon-fri 18:00-08:00" evaluated in a specific time zone, and cron
+// expressions.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Range is a daily time span that applies to a set of weekdays. Start and End
+// are minutes from midnight. If End is before Start, the range continues past
+// midnight into the next day.
+type Range struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// Schedule is a set of time ranges in a specific location.
+type Schedule struct {
+	Location *time.Location
+	Ranges   []Range
+}
+
+// Parse creates a Schedule from range specifications. Each range has the form
+// "[days] HH:MM-HH:MM" where days is a comma separated list of day names or
+// day spans such as "mon-fri,sun". If days is omitted the range applies every
+// day. An empty timezone means the local time zone.
+func Parse(ranges []string, timezone string) (*Schedule, error) {
+	loc, err := LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Schedule{
+		Location: loc,
+		Ranges:   make([]Range, 0, len(ranges)),
+	}
+
+	for _, spec := range ranges {
+		r, err := ParseRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.Ranges = append(s.Ranges, r)
+	}
+	return s, nil
+}
+
+// LoadLocation is time.LoadLocation except an empty name is the local time zone.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// ParseRange parses a single range specification.
+func ParseRange(spec string) (Range, error) {
+	var r Range
+	fields := strings.Fields(spec)
+
+	var days, times string
+	switch len(fields) {
+	case 1:
+		days, times = "*", fields[0]
+	case 2:
+		days, times = fields[0], fields[1]
+	default:
+		return r, fmt.Errorf("invalid time range %q", spec)
+	}
+
+	var err error
+	r.Days, err = ParseDays(days)
+	if err != nil {
+		return r, err
+	}
+
+	span := strings.SplitN(times, "-", 2)
+	if len(span) != 2 {
+		return r, fmt.Errorf("invalid time range %q", spec)
+	}
+
+	if r.Start, err = ParseClock(span[0]); err != nil {
+		return r, err
+	}
+	if r.End, err = ParseClock(span[1]); err != nil {
+		return r, err
+	}
+	if r.Start == r.End {
+		return r, fmt.Errorf("empty time range %q", spec)
+	}
+	return r, nil
+}
+
+// ParseDays parses a comma separated list of day names and day spans.
+// The special value "*" means every day.
+func ParseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	if spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		span := strings.SplitN(part, "-", 2)
+		start, ok := dayNames[span[0]]
+		if !ok {
+			return days, fmt.Errorf("invalid day %q", span[0])
+		}
+
+		end := start
+		if len(span) == 2 {
+			if end, ok = dayNames[span[1]]; !ok {
+				return days, fmt.Errorf("invalid day %q", span[1])
+			}
+		}
+
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// ParseClock parses a time of day in the form HH:MM and returns the number
+// of minutes since midnight. "24:00" is allowed to mean the end of the day.
+func ParseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// Active returns if t falls within any range of the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return false
+	}
+
+	t = t.In(s.Location)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, r := range s.Ranges {
+		if r.Start < r.End {
+			if r.Days[day] && minute >= r.Start && minute < r.End {
+				return true
+			}
+			continue
+		}
+
+		// Range crosses midnight
+		if r.Days[day] && minute >= r.Start {
+			return true
+		}
+		if r.Days[yesterday] && minute < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNoRanges is returned by Validate when a schedule has no ranges.
+var ErrNoRanges = errors.New("schedule has no time ranges")
+
+// Validate returns an error if the schedule can never be active.
+func (s *Schedule) Validate() error {
+	if s == nil || len(s.Ranges) == 0 {
+		return ErrNoRanges
+	}
+	return nil
+}
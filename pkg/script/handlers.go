@@ -0,0 +1,236 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/utils"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// message is a message returned by a route script. Without channels, the
+// route's channels are used.
+type message struct {
+	text     string
+	channels []string
+	alert    *msgbus.Alert
+}
+
+func routeScript(name string) *script {
+	lock.Lock()
+	defer lock.Unlock()
+	return routes[name]
+}
+
+func commandScript(name string) *script {
+	lock.Lock()
+	defer lock.Unlock()
+	return commands[name]
+}
+
+// routeHandler runs the handle function of a script with the request and
+// dispatches the messages it returns.
+func routeHandler(name string) msgbus.BusHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		s := routeScript(name)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		result, err := s.call(ctx, requestValue(ctx, r, body))
+		if err != nil {
+			fmt.Printf("Script %s failed: %s\n", s.name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		messages, err := toMessages(result)
+		if err != nil {
+			fmt.Printf("Script %s returned %s\n", s.name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		for _, m := range messages {
+			mctx := ctx
+			if m.alert != nil {
+				mctx = msgbus.SetCtxAlert(ctx, m.alert)
+			}
+			if len(m.channels) == 0 {
+				msgbus.DispatchMessage(mctx, "%s", m.text)
+			} else {
+				msgbus.DispatchMessageToChannels(mctx, m.channels, m.text)
+			}
+		}
+		w.Write([]byte(`{"accepted": true}`))
+	}
+}
+
+// requestValue returns the request given to route scripts.
+func requestValue(ctx context.Context, r *http.Request, body []byte) starlark.Value {
+	headers := starlark.NewDict(len(r.Header))
+	for name := range r.Header {
+		headers.SetKey(starlark.String(strings.ToLower(name)), starlark.String(r.Header.Get(name)))
+	}
+
+	query := starlark.NewDict(0)
+	for name, values := range r.URL.Query() {
+		query.SetKey(starlark.String(name), starlark.String(values[0]))
+	}
+
+	// Bodies that aren't JSON have json set to None
+	var parsed starlark.Value = starlark.None
+	if v, err := decodeJSON(&starlark.Thread{}, string(body)); err == nil {
+		parsed = v
+	}
+
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"route":       starlark.String(msgbus.GetCtxRouteID(ctx)),
+		"request_id":  starlark.String(msgbus.GetCtxRequestID(ctx)),
+		"method":      starlark.String(r.Method),
+		"path":        starlark.String(r.URL.Path),
+		"query":       query,
+		"headers":     headers,
+		"body":        starlark.String(body),
+		"json":        parsed,
+		"remote_addr": starlark.String(r.RemoteAddr),
+	})
+}
+
+// toMessages converts the result of a route script. It can be None, a
+// message, or a list of messages. A message is a string or a dict with
+// message, channels, and the alert fields host, severity, and fingerprint.
+func toMessages(v starlark.Value) ([]*message, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.List, starlark.Tuple:
+		var messages []*message
+		iter := starlark.Iterate(v)
+		defer iter.Done()
+		var item starlark.Value
+		for iter.Next(&item) {
+			m, err := toMessage(item)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, m)
+		}
+		return messages, nil
+	}
+
+	m, err := toMessage(v)
+	if err != nil {
+		return nil, err
+	}
+	return []*message{m}, nil
+}
+
+func toMessage(v starlark.Value) (*message, error) {
+	if s, ok := starlark.AsString(v); ok {
+		return &message{text: s}, nil
+	}
+
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("a %s, messages must be strings or dicts", v.Type())
+	}
+
+	m := &message{}
+	alert := &msgbus.Alert{}
+	for _, item := range d.Items() {
+		key, _ := starlark.AsString(item[0])
+		switch key {
+		case "message":
+			m.text, ok = starlark.AsString(item[1])
+		case "channels":
+			m.channels, ok = toStrings(item[1])
+		case "host":
+			alert.Host, ok = starlark.AsString(item[1])
+		case "severity":
+			alert.Severity, ok = starlark.AsString(item[1])
+		case "fingerprint":
+			alert.Fingerprint, ok = starlark.AsString(item[1])
+		default:
+			return nil, fmt.Errorf("a message with unknown key %s", item[0])
+		}
+		if !ok {
+			return nil, fmt.Errorf("a message with an invalid %s", key)
+		}
+	}
+
+	if m.text == "" {
+		return nil, errors.New("a message without text")
+	}
+	if alert.Severity != "" || alert.Host != "" || alert.Fingerprint != "" {
+		alert.Severity = strings.ToLower(utils.StringOrDefault(alert.Severity, msgbus.SeverityInfo))
+		m.alert = alert
+	}
+	return m, nil
+}
+
+func toStrings(v starlark.Value) ([]string, bool) {
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, false
+	}
+
+	var ss []string
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		s, ok := starlark.AsString(item)
+		if !ok {
+			return nil, false
+		}
+		ss = append(ss, s)
+	}
+	return ss, true
+}
+
+// commandHandler runs the run function of a script and replies with the
+// string it returns.
+func commandHandler(name string) bot.CommandHandler {
+	return func(b *bot.Bot, event *bot.CommandEvent) error {
+		s := commandScript(name)
+
+		args := make([]starlark.Value, len(event.Args))
+		for i, arg := range event.Args {
+			args[i] = starlark.String(arg)
+		}
+
+		command := starlarkstruct.FromStringDict(starlark.String("command"), starlark.StringDict{
+			"name":       starlark.String(event.Command),
+			"args":       starlark.Tuple(args),
+			"user_id":    starlark.String(event.Post.UserId),
+			"username":   starlark.String(b.Username(event.Post.UserId)),
+			"channel_id": starlark.String(event.Post.ChannelId),
+			"post_id":    starlark.String(event.Post.Id),
+		})
+
+		result, err := s.call(context.Background(), command)
+		if err != nil {
+			fmt.Printf("Script %s failed: %s\n", s.name, err)
+			return b.Reply(event.Post, fmt.Sprintf("%s failed, see the bot's log", event.Command))
+		}
+
+		switch result := result.(type) {
+		case starlark.NoneType:
+			return nil
+		case starlark.String:
+			return b.Reply(event.Post, string(result))
+		}
+		return fmt.Errorf("script %s returned a %s, replies must be strings", s.name, result.Type())
+	}
+}
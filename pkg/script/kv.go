@@ -0,0 +1,138 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/storage"
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// storeKey is the thread local with the store used by a run. Dry runs of
+// route scripts use a store kept in memory.
+const storeKey = "kv"
+
+// kvStore keeps the state of scripts as JSON encoded values.
+type kvStore struct {
+	store *storage.Store
+}
+
+// in returns the store used by the run in thread.
+func (kv *kvStore) in(thread *starlark.Thread) *storage.Store {
+	if store, ok := thread.Local(storeKey).(*storage.Store); ok {
+		return store
+	}
+	return kv.store
+}
+
+// module returns the kv builtin module given to scripts.
+func (kv *kvStore) module() *starlarkstruct.Module {
+	return &starlarkstruct.Module{
+		Name: "kv",
+		Members: starlark.StringDict{
+			"get":    starlark.NewBuiltin("kv.get", kv.get),
+			"set":    starlark.NewBuiltin("kv.set", kv.set),
+			"delete": starlark.NewBuiltin("kv.delete", kv.delete),
+			"keys":   starlark.NewBuiltin("kv.keys", kv.keys),
+			"incr":   starlark.NewBuiltin("kv.incr", kv.incr),
+		},
+	}
+}
+
+// get(key, default=None) returns the value of key.
+func (kv *kvStore) get(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "default?", &def); err != nil {
+		return nil, err
+	}
+
+	var value json.RawMessage
+	found, err := kv.in(thread).Get(key, &value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	if !found {
+		return def, nil
+	}
+	return decodeJSON(thread, string(value))
+}
+
+// set(key, value, ttl=0) stores a value that can be encoded as JSON. With a
+// ttl, the key is removed after that many seconds.
+func (kv *kvStore) set(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	var value starlark.Value
+	ttl := 0
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "value", &value, "ttl?", &ttl); err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("%s: ttl can't be negative", b.Name())
+	}
+
+	encoded, err := encodeJSON(thread, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	return starlark.None, kv.in(thread).SetTTL(key, json.RawMessage(encoded), time.Duration(ttl)*time.Second)
+}
+
+// delete(key) removes a key.
+func (kv *kvStore) delete(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key); err != nil {
+		return nil, err
+	}
+	return starlark.None, kv.in(thread).Delete(key)
+}
+
+// keys(prefix="") returns the sorted keys starting with prefix.
+func (kv *kvStore) keys(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var prefix string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "prefix?", &prefix); err != nil {
+		return nil, err
+	}
+
+	keys, err := kv.in(thread).Keys(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	values := make([]starlark.Value, len(keys))
+	for i, key := range keys {
+		values[i] = starlark.String(key)
+	}
+	return starlark.NewList(values), nil
+}
+
+// incr(key, by=1) adds to an integer value and returns the result. A missing
+// key counts as 0.
+func (kv *kvStore) incr(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	by := 1
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "by?", &by); err != nil {
+		return nil, err
+	}
+
+	n, err := kv.in(thread).Incr(key, int64(by))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	return starlark.MakeInt64(n), nil
+}
+
+func encodeJSON(thread *starlark.Thread, value starlark.Value) (string, error) {
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{value}, nil)
+	if err != nil {
+		return "", err
+	}
+	s, _ := starlark.AsString(encoded)
+	return s, nil
+}
+
+func decodeJSON(thread *starlark.Thread, s string) (starlark.Value, error) {
+	return starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(s)}, nil)
+}
@@ -0,0 +1,126 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/storage"
+	"go.starlark.net/lib/json"
+	starlarktime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+)
+
+// Functions scripts define to handle requests and commands
+const (
+	handleFunc = "handle"
+	runFunc    = "run"
+)
+
+// runLimits stop scripts that run too long. Steps is the number of Starlark
+// execution steps, 0 for no limit.
+type runLimits struct {
+	timeout time.Duration
+	steps   uint64
+}
+
+// script is a compiled script file.
+type script struct {
+	name    string
+	file    string
+	globals starlark.StringDict
+	entry   starlark.Callable
+	kv      *kvStore
+	limits  runLimits
+}
+
+// compile runs the top level of a script file and checks that it defines
+// the entry function. Without kv, the script gets a store kept in memory.
+func compile(name, file, entry string, kv *kvStore, limits runLimits) (*script, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		kv = &kvStore{store: storage.Memory()}
+	}
+
+	s := &script{name: name, file: file, kv: kv, limits: limits}
+	var globals starlark.StringDict
+	err = s.exec(context.Background(), func(thread *starlark.Thread) error {
+		var err error
+		globals, err = starlark.ExecFile(thread, file, src, s.predeclared())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Script state must be kept in the key/value store, concurrent runs
+	// can't change globals
+	globals.Freeze()
+	s.globals = globals
+
+	fn, ok := globals[entry].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't define a %s function", file, entry)
+	}
+	s.entry = fn
+	return s, nil
+}
+
+// predeclared returns the builtins available to the script.
+func (s *script) predeclared() starlark.StringDict {
+	return starlark.StringDict{
+		"json": json.Module,
+		"time": starlarktime.Module,
+		"kv":   s.kv.module(),
+	}
+}
+
+// help returns the help text a command script sets in its help global.
+func (s *script) help() string {
+	if help, ok := starlark.AsString(s.globals["help"]); ok {
+		return help
+	}
+	return "Script " + s.name
+}
+
+// call runs the entry function of the script.
+func (s *script) call(ctx context.Context, args ...starlark.Value) (starlark.Value, error) {
+	var result starlark.Value
+	err := s.exec(ctx, func(thread *starlark.Thread) error {
+		var err error
+		result, err = starlark.Call(thread, s.entry, args, nil)
+		return err
+	})
+	if err != nil {
+		scriptErrors.Inc(s.name)
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			return nil, fmt.Errorf("%s", evalErr.Backtrace())
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// exec runs f in a new thread stopped after the time and step limits. The
+// kv module uses the script's store in ctx.
+func (s *script) exec(ctx context.Context, f func(*starlark.Thread) error) error {
+	l := s.limits
+	thread := &starlark.Thread{
+		Name: s.name,
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Printf("Script %s: %s\n", s.name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(l.steps)
+	thread.SetLocal(storeKey, s.kv.store.In(ctx))
+
+	timer := time.AfterFunc(l.timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %s", l.timeout))
+	})
+	defer timer.Stop()
+	return f(thread)
+}
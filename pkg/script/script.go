@@ -0,0 +1,228 @@
+// Package script runs route handlers and chat commands written in Starlark,
+// a small Python-like language. Scripts can only use the builtins given to
+// them and are stopped when they take too long.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/bot"
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/metrics"
+	"github.com/lfkeitel/yobot/pkg/msgbus"
+	"github.com/lfkeitel/yobot/pkg/storage"
+)
+
+var (
+	lock     sync.Mutex
+	routes   = map[string]*script{} // Route handler name to script
+	commands = map[string]*script{} // Command name to script
+	stores   = map[string]*kvStore{}
+
+	scriptErrors = metrics.NewCounter("yobot_script_errors_total",
+		"Script runs that failed or were stopped.", "script")
+)
+
+func init() {
+	msgbus.RegisterReloadHook(reload)
+	config.RegisterValidator(validate)
+}
+
+// Load compiles the scripts in the configuration and registers their route
+// handlers and commands. Scripts that fail to load are reported in the error
+// and the others are still registered.
+func Load(conf *config.Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var problems []string
+	for _, name := range sortedKeys(conf.Scripts.Routes) {
+		s, err := loadScript(conf, "route "+name, conf.Scripts.Routes[name], handleFunc)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if err := registerMsgBus(name, routeHandler(name)); err != nil {
+			problems = append(problems, fmt.Sprintf("script route %s: %s", name, err))
+			continue
+		}
+		routes[name] = s
+	}
+
+	for _, name := range sortedKeys(conf.Scripts.Commands) {
+		s, err := loadScript(conf, "command "+name, conf.Scripts.Commands[name], runFunc)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if err := registerCommand(name, &bot.Command{Help: s.help(), Handler: commandHandler(name)}); err != nil {
+			problems = append(problems, fmt.Sprintf("script command %s: %s", name, err))
+			continue
+		}
+		commands[name] = s
+	}
+
+	if len(routes)+len(commands) > 0 {
+		fmt.Printf("Loaded %d script routes and %d script commands\n", len(routes), len(commands))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// loadScript compiles a script and checks it defines entry. It must be
+// called with the lock held.
+func loadScript(conf *config.Config, name, file, entry string) (*script, error) {
+	limits, err := parseLimits(&conf.Scripts)
+	if err != nil {
+		return nil, err
+	}
+
+	file = scriptPath(conf, file)
+	kv, err := openStore(conf, file)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %s", name, err)
+	}
+	s, err := compile(name, file, entry, kv, limits)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %s", name, err)
+	}
+	return s, nil
+}
+
+// openStore returns the key/value store of a script file, the storage
+// namespace scripts/NAME. Scripts with the same file name share a store.
+// Values saved in DATA_DIR/scripts/NAME.json by older versions are imported.
+// It must be called with the lock held.
+func openStore(conf *config.Config, file string) (*kvStore, error) {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if kv, exists := stores[name]; exists {
+		return kv, nil
+	}
+
+	store := storage.Namespace("scripts/" + name)
+	if err := store.ImportJSONFile(filepath.Join(conf.ModuleDataDir("scripts"), name+".json")); err != nil {
+		return nil, err
+	}
+	kv := &kvStore{store: store}
+	stores[name] = kv
+	return kv, nil
+}
+
+// scriptPath returns the path of a script file. Relative paths are relative
+// to the main configuration file.
+func scriptPath(conf *config.Config, file string) string {
+	if filepath.IsAbs(file) || conf.Filename() == "" {
+		return file
+	}
+	return filepath.Join(filepath.Dir(conf.Filename()), file)
+}
+
+// reload compiles the scripts again so changes to them are used. Adding or
+// removing scripts needs a restart of Yobot.
+func reload(conf *config.Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var problems []string
+	reloadAll := func(kind string, loaded map[string]*script, files map[string]string, entry string) {
+		for name := range loaded {
+			if _, exists := files[name]; !exists {
+				problems = append(problems, fmt.Sprintf("script %s %s was removed, restart Yobot to remove it", kind, name))
+			}
+		}
+		for name, file := range files {
+			if loaded[name] == nil {
+				problems = append(problems, fmt.Sprintf("script %s %s was added, restart Yobot to add it", kind, name))
+				continue
+			}
+			s, err := loadScript(conf, kind+" "+name, file, entry)
+			if err != nil {
+				problems = append(problems, err.Error()) // Keep the working version
+				continue
+			}
+			loaded[name] = s
+		}
+	}
+	reloadAll("route", routes, conf.Scripts.Routes, handleFunc)
+	reloadAll("command", commands, conf.Scripts.Commands, runFunc)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validate(conf *config.Config) []*config.Diagnostic {
+	var diags []*config.Diagnostic
+	limits, err := parseLimits(&conf.Scripts)
+	if err != nil {
+		return []*config.Diagnostic{conf.Problem("scripts.timeout", "%s", err)}
+	}
+
+	check := func(kind string, files map[string]string, entry string) {
+		for name, file := range files {
+			key := fmt.Sprintf("scripts.%s.%s", kind, name)
+			if file == "" {
+				diags = append(diags, conf.Problem(key, "script file required"))
+				continue
+			}
+			if _, err := compile(name, scriptPath(conf, file), entry, nil, limits); err != nil {
+				diags = append(diags, conf.Problem(key, "%s", err))
+			}
+		}
+	}
+	check("routes", conf.Scripts.Routes, handleFunc)
+	check("commands", conf.Scripts.Commands, runFunc)
+	return diags
+}
+
+func parseLimits(conf *config.ScriptsConfig) (runLimits, error) {
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return runLimits{}, fmt.Errorf("invalid script timeout: %s", err)
+	}
+	if timeout <= 0 {
+		return runLimits{}, errors.New("invalid script timeout: must be positive")
+	}
+	return runLimits{timeout: timeout, steps: uint64(conf.MaxSteps)}, nil
+}
+
+// registerMsgBus and registerCommand return an error instead of panicking if
+// the name is taken.
+func registerMsgBus(id string, handler msgbus.BusHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	msgbus.RegisterMsgBus(id, handler)
+	return nil
+}
+
+func registerCommand(name string, cmd *bot.Command) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	bot.RegisterCommand(name, cmd)
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,414 @@
+// Package storage keeps values that survive restarts in a database in the
+// data directory. Values are stored as JSON in namespaces, usually one per
+// module, and can expire.
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lfkeitel/yobot/pkg/config"
+	"github.com/lfkeitel/yobot/pkg/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	dbFile        = "yobot.db"
+	openTimeout   = 2 * time.Second
+	sweepInterval = 10 * time.Minute
+)
+
+// ErrClosed is returned when the database isn't open.
+var ErrClosed = errors.New("storage isn't open")
+
+var db struct {
+	sync.RWMutex
+	bolt *bolt.DB
+	mem  *memory
+	stop chan struct{}
+}
+
+// Open opens the database in the data directory. Only one Yobot can have it
+// open at a time.
+func Open(conf *config.Config) error {
+	file := filepath.Join(conf.Main.DataDir, dbFile)
+	bdb, err := bolt.Open(file, 0600, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("%s is in use by another Yobot", file)
+	} else if err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	db.bolt = bdb
+	db.stop = make(chan struct{})
+	go sweep(db.stop)
+	return nil
+}
+
+// OpenMemory keeps values in memory instead of the database. It's used when
+// testing the configuration and replaying requests so they don't change the
+// stored values.
+func OpenMemory() {
+	db.Lock()
+	defer db.Unlock()
+	db.mem = newMemory()
+}
+
+// Close closes the database.
+func Close() error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.mem = nil
+	if db.bolt == nil {
+		return nil
+	}
+	close(db.stop)
+	err := db.bolt.Close()
+	db.bolt = nil
+	return err
+}
+
+// sweep removes expired values until stop is closed.
+func sweep(stop chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := removeExpired(); err != nil {
+			fmt.Printf("Error removing expired values: %s\n", err)
+		}
+	}
+}
+
+func removeExpired() error {
+	db.RLock()
+	defer db.RUnlock()
+	if db.bolt == nil {
+		return nil
+	}
+
+	now := time.Now()
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			// Buckets can't be changed in ForEach
+			var expired [][]byte
+			b.ForEach(func(k, v []byte) error {
+				if _, ok := decodeEntry(v, now); !ok {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Store is a namespace of values.
+type Store struct {
+	namespace string
+	mem       *memory // Set for stores only kept in memory
+}
+
+// Namespace returns the store of a namespace. The database is opened when
+// Yobot starts, stores can be kept before then.
+func Namespace(name string) *Store {
+	return &Store{namespace: name}
+}
+
+// Memory returns a store that's only kept in memory.
+func Memory() *Store {
+	return &Store{namespace: "memory", mem: newMemory()}
+}
+
+// memoryKey is the context key of the memory used by dry runs.
+type memoryKey struct{}
+
+// WithMemory returns a context for a dry run, such as replaying a captured
+// request. Stores used through In with the context keep their values in
+// memory instead of changing the stored values. The memory starts empty.
+func WithMemory(ctx context.Context) context.Context {
+	return context.WithValue(ctx, memoryKey{}, newMemory())
+}
+
+// In returns the store to use while handling ctx. It's s unless ctx is a
+// dry run from WithMemory.
+func (s *Store) In(ctx context.Context) *Store {
+	if mem, ok := ctx.Value(memoryKey{}).(*memory); ok && s.mem == nil {
+		return &Store{namespace: s.namespace, mem: mem}
+	}
+	return s
+}
+
+// Name is the namespace of the store.
+func (s *Store) Name() string {
+	return s.namespace
+}
+
+// bucket is a namespace in the database or memory.
+type bucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(f func(k, v []byte) error) error
+}
+
+func (s *Store) view(f func(b bucket) error) error {
+	if s.mem != nil {
+		return s.mem.view(s.namespace, f)
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	if db.mem != nil {
+		return db.mem.view(s.namespace, f)
+	}
+	if db.bolt == nil {
+		return ErrClosed
+	}
+	return db.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.namespace))
+		if b == nil {
+			return f(memBucket{})
+		}
+		return f(b)
+	})
+}
+
+func (s *Store) update(f func(b bucket) error) error {
+	if s.mem != nil {
+		return s.mem.update(s.namespace, f)
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	if db.mem != nil {
+		return db.mem.update(s.namespace, f)
+	}
+	if db.bolt == nil {
+		return ErrClosed
+	}
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(s.namespace))
+		if err != nil {
+			return err
+		}
+		return f(b)
+	})
+}
+
+// Get decodes the value of key into v. It returns false if the key isn't
+// set or has expired.
+func (s *Store) Get(key string, v interface{}) (bool, error) {
+	var value []byte
+	err := s.view(func(b bucket) error {
+		if data, ok := decodeEntry(b.Get([]byte(key)), time.Now()); ok {
+			value = append(value, data...) // Only valid in the transaction
+		}
+		return nil
+	})
+	if err != nil || value == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(value, v)
+}
+
+// Set stores v encoded as JSON.
+func (s *Store) Set(key string, v interface{}) error {
+	return s.SetTTL(key, v, 0)
+}
+
+// SetTTL stores v encoded as JSON until ttl has passed. A ttl of 0 keeps
+// the value forever.
+func (s *Store) SetTTL(key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	return s.update(func(b bucket) error {
+		return b.Put([]byte(key), encodeEntry(value, expires))
+	})
+}
+
+// Delete removes a key.
+func (s *Store) Delete(key string) error {
+	return s.update(func(b bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+// Keys returns the sorted keys starting with prefix.
+func (s *Store) Keys(prefix string) ([]string, error) {
+	keys := []string{}
+	now := time.Now()
+	err := s.view(func(b bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if _, ok := decodeEntry(v, now); ok && strings.HasPrefix(string(k), prefix) {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Incr adds by to the integer value of key and returns the result. A key
+// that isn't set counts as 0. The expiration of the key is kept.
+func (s *Store) Incr(key string, by int64) (int64, error) {
+	var n int64
+	err := s.update(func(b bucket) error {
+		var expires time.Time
+		if entry := b.Get([]byte(key)); entry != nil {
+			value, ok := decodeEntry(entry, time.Now())
+			if ok {
+				var err error
+				if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+					return fmt.Errorf("%s isn't an integer", key)
+				}
+				expires = entryExpires(entry)
+			}
+		}
+
+		n += by
+		return b.Put([]byte(key), encodeEntry([]byte(strconv.FormatInt(n, 10)), expires))
+	})
+	return n, err
+}
+
+// Entries are the expiration time as Unix nanoseconds, 0 if they don't
+// expire, followed by the JSON value.
+func encodeEntry(value []byte, expires time.Time) []byte {
+	entry := make([]byte, 8+len(value))
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(entry, uint64(expires.UnixNano()))
+	}
+	copy(entry[8:], value)
+	return entry
+}
+
+func decodeEntry(entry []byte, now time.Time) ([]byte, bool) {
+	if len(entry) < 8 {
+		return nil, false
+	}
+	if expires := entryExpires(entry); !expires.IsZero() && !now.Before(expires) {
+		return nil, false
+	}
+	return entry[8:], true
+}
+
+func entryExpires(entry []byte) time.Time {
+	n := binary.BigEndian.Uint64(entry)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+// memory keeps namespaces in memory.
+type memory struct {
+	sync.Mutex
+	buckets map[string]memBucket
+}
+
+func newMemory() *memory {
+	return &memory{buckets: make(map[string]memBucket)}
+}
+
+func (m *memory) view(namespace string, f func(b bucket) error) error {
+	m.Lock()
+	defer m.Unlock()
+	return f(m.buckets[namespace])
+}
+
+func (m *memory) update(namespace string, f func(b bucket) error) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.buckets[namespace] == nil {
+		m.buckets[namespace] = make(memBucket)
+	}
+	return f(m.buckets[namespace])
+}
+
+type memBucket map[string][]byte
+
+func (b memBucket) Get(key []byte) []byte {
+	return b[string(key)]
+}
+
+func (b memBucket) Put(key, value []byte) error {
+	b[string(key)] = value
+	return nil
+}
+
+func (b memBucket) Delete(key []byte) error {
+	delete(b, string(key))
+	return nil
+}
+
+func (b memBucket) ForEach(f func(k, v []byte) error) error {
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := f([]byte(key), b[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportJSONFile stores the values of a JSON object saved in file and renames
+// the file so it's only imported once. A missing file isn't an error.
+func (s *Store) ImportJSONFile(file string) error {
+	data := make(map[string]json.RawMessage)
+	if err := utils.LoadJSONFile(file, &data); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	err := s.update(func(b bucket) error {
+		for key, value := range data {
+			if err := b.Put([]byte(key), encodeEntry(value, time.Time{})); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(file, file+".imported")
+}
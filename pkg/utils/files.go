@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LoadJSONFile decodes the JSON file at path into v. A missing file is not
+// an error and v is left untouched.
+func LoadJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SaveJSONFile encodes v as JSON and atomically replaces the file at path.
+func SaveJSONFile(path string, v interface{}) error {
+	return saveJSONFile(path, v, 0644)
+}
+
+// SavePrivateJSONFile is SaveJSONFile for files only the owner can read.
+func SavePrivateJSONFile(path string, v interface{}) error {
+	return saveJSONFile(path, v, 0600)
+}
+
+func saveJSONFile(path string, v interface{}, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// A file left by a failed save would keep its permissions
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// IsPasswordHash returns if s is a bcrypt or argon2id hash.
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") ||
+		strings.HasPrefix(s, "$2y$") || strings.HasPrefix(s, "$argon2id$")
+}
+
+// CheckPassword compares a password with a stored password. The stored
+// password can be a bcrypt hash, an argon2id hash in the PHC string format,
+// or plaintext.
+func CheckPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return checkArgon2id(stored, password)
+	case IsPasswordHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// checkArgon2id verifies a hash like $argon2id$v=19$m=65536,t=3,p=2$SALT$HASH.
+func checkArgon2id(stored, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, computed) == 1
+}
+
+// HashPassword returns a bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
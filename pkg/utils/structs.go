@@ -9,6 +9,9 @@ import (
 // FillStruct will panic if s is not a pointer.
 // FillStruct should only be used for initilization. There may be
 // performance issues when using the function frequently.
+//
+// Deprecated: FillStruct ignores unknown settings and most type errors. Use
+// config.DecodeSettings or plugins.Config.Decode.
 func FillStruct(s interface{}, m map[string]interface{}) error {
 	if reflect.ValueOf(s).Kind() != reflect.Ptr {
 		panic("s must be a pointer to a struct")